@@ -16,6 +16,13 @@ import (
 	"github.com/sirupsen/logrus"
 )
 
+const (
+	// seekPrioritizeBytes is how much data after a missed offset the torrent client is asked for first
+	seekPrioritizeBytes = 8 * 1024 * 1024
+	// seekNeededIn is how soon the viewer wants the missed bytes
+	seekNeededIn = 10 * time.Second
+)
+
 func UploadFilePartHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method == http.MethodGet {
 		fileId := mux.Vars(r)["file_id"]
@@ -52,6 +59,8 @@ func UploadFilePartHandler(w http.ResponseWriter, r *http.Request) {
 				readCtx, readCancel := context.WithTimeout(context.TODO(), time.Second * 600)
 				defer readCancel()
 
+				PrioritizeRangeInTorrentClient(fileId, fileRange.Start, fileRange.Start + seekPrioritizeBytes - 1, seekNeededIn)
+
 				logrus.Debugf("Got file inProgress=true from db: %v, waiting for data (%v %v %v)", fileName, filesReader.GetManager().HasNullBytes(filePart), filePart == nil, err)
 				filePart, _, err = filesReader.GetManager().WaitForFilePart(readCtx, fileName, fileRange.Start)
 			}
@@ -65,6 +74,9 @@ func UploadFilePartHandler(w http.ResponseWriter, r *http.Request) {
 			defer readCancel()
 
 			logrus.Debugf("Got file name from client: %v, waiting for data", fileName)
+			if fileRange.Start > 0 {
+				PrioritizeRangeInTorrentClient(fileId, fileRange.Start, fileRange.Start + seekPrioritizeBytes - 1, seekNeededIn)
+			}
 			filePart, _, err = filesReader.GetManager().WaitForFilePart(readCtx, fileName, fileRange.Start)
 		}
 
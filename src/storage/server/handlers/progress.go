@@ -0,0 +1,67 @@
+package handlers
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+
+	"hypertube_storage/parser/env"
+
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+)
+
+// ProgressHandler proxies the progress stream of file_id from the torrent client,
+// events are passed on as they come
+func ProgressHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		SendFailResponseWithCode(w, "Incorrect method", http.StatusMethodNotAllowed)
+		return
+	}
+	fileId := mux.Vars(r)["file_id"]
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		SendFailResponseWithCode(w, "Streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+
+	url := fmt.Sprintf("http://%s/jobs/%s/progress", env.GetParser().GetLoaderServiceHost(), fileId)
+	req, err := http.NewRequestWithContext(r.Context(), http.MethodGet, url, nil)
+	if err != nil {
+		SendFailResponseWithCode(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		logrus.Errorf("Error calling loader service: %v", err)
+		SendFailResponseWithCode(w, "Failed to call torrent client", http.StatusBadGateway)
+		return
+	}
+	defer res.Body.Close()
+
+	w.Header().Set("Content-Type", res.Header.Get("Content-Type"))
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(res.StatusCode)
+	flusher.Flush()
+
+	buf := make([]byte, 4096)
+	for {
+		n, err := res.Body.Read(buf)
+		if n > 0 {
+			if _, err := w.Write(buf[:n]); err != nil {
+				logrus.Debugf("Error writing progress of %v: %v", fileId, err)
+				return
+			}
+			flusher.Flush()
+		}
+		if err == io.EOF {
+			return
+		}
+		if err != nil {
+			logrus.Debugf("Error reading progress of %v: %v", fileId, err)
+			return
+		}
+	}
+}
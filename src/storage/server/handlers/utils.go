@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"sync"
 	"time"
 
 	"hypertube_storage/model"
@@ -13,6 +14,30 @@ import (
 	"github.com/sirupsen/logrus"
 )
 
+const (
+	// prioritizeTimeout bounds one prioritize call to the torrent client
+	prioritizeTimeout = 3 * time.Second
+	// prioritizeRetryInterval is how often a prioritize is repeated while the download is starting
+	prioritizeRetryInterval = time.Second
+	// prioritizeMaxWait is how long a prioritize waits for the download to start
+	prioritizeMaxWait = time.Minute
+)
+
+var prioritizeClient = &http.Client{Timeout: prioritizeTimeout}
+
+// prioritizeRequest is a prioritize request being repeated in the background
+type prioritizeRequest struct {
+	start, end int64
+}
+
+// prioritizeLast keeps the latest prioritize request of each file, a
+// repeated request gives way to a newer one. Requests are told apart by
+// their addresses, so a finished request can't be taken for a newer one
+var prioritizeLast = struct {
+	sync.Mutex
+	requests map[string]*prioritizeRequest
+}{requests: make(map[string]*prioritizeRequest)}
+
 
 func SendFailResponseWithCode(w http.ResponseWriter, text string, code int) {
 	var packet []byte
@@ -99,4 +124,71 @@ func SendTaskToTorrentClient(fileId string) (string, bool) {
 	return info.Data.FileName, true
 }
 
+// PrioritizeRangeInTorrentClient asks the torrent client in the background to
+// download bytes start..end of the file before anything else, they are needed
+// in neededIn. A download which is just starting has no active job yet, the
+// request is repeated until it has one, prioritizeMaxWait passes or a newer
+// request for the file comes
+func PrioritizeRangeInTorrentClient(fileId string, start, end int64, neededIn time.Duration) {
+	req := &prioritizeRequest{start: start, end: end}
+	prioritizeLast.Lock()
+	prioritizeLast.requests[fileId] = req
+	prioritizeLast.Unlock()
+
+	go func() {
+		defer prioritizeDone(fileId, req)
+		deadline := time.Now().Add(neededIn)
+		giveUp := time.Now().Add(prioritizeMaxWait)
+		for {
+			status, err := prioritizeRange(fileId, start, end, time.Until(deadline))
+			if err != nil {
+				logrus.Errorf("Error calling loader service: %v", err)
+				return
+			}
+			if status == http.StatusOK {
+				return
+			}
+			if status != http.StatusNotFound {
+				logrus.Warnf("Not ok status from torrent client on prioritize: %v", status)
+				return
+			}
+			if time.Now().Add(prioritizeRetryInterval).After(giveUp) {
+				logrus.Warnf("Download of %v didn't start in %v, bytes %v-%v aren't prioritized", fileId, prioritizeMaxWait, start, end)
+				return
+			}
+			time.Sleep(prioritizeRetryInterval)
+			if !prioritizeLatest(fileId, req) {
+				return
+			}
+		}
+	}()
+}
+
+// prioritizeRange makes one prioritize call and returns its status. neededIn
+// is sent in whole seconds, a passed deadline as 0
+func prioritizeRange(fileId string, start, end int64, neededIn time.Duration) (int, error) {
+	if neededIn < 0 {
+		neededIn = 0
+	}
+	res, err := prioritizeClient.Get(fmt.Sprintf("http://%s/prioritize?file_id=%s&start=%d&end=%d&deadline=%d",
+		env.GetParser().GetLoaderServiceHost(), fileId, start, end, int(neededIn.Seconds())))
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+	return res.StatusCode, nil
+}
 
+func prioritizeLatest(fileId string, req *prioritizeRequest) bool {
+	prioritizeLast.Lock()
+	defer prioritizeLast.Unlock()
+	return prioritizeLast.requests[fileId] == req
+}
+
+func prioritizeDone(fileId string, req *prioritizeRequest) {
+	prioritizeLast.Lock()
+	defer prioritizeLast.Unlock()
+	if prioritizeLast.requests[fileId] == req {
+		delete(prioritizeLast.requests, fileId)
+	}
+}
@@ -0,0 +1,180 @@
+package bandwidth
+
+import (
+	"sync"
+	"time"
+
+	"torrentClient/parser/env"
+)
+
+var syncOnce sync.Once
+var limiter *Limiter
+
+// GetLimiter returns the limiter of peer connections, its limits are taken
+// from the environment at first
+func GetLimiter() *Limiter {
+	syncOnce.Do(func() {
+		parser := env.GetParser()
+		limiter = &Limiter{
+			global: newPair(Limits{
+				Download: parser.GetDownloadRateLimit(),
+				Upload:   parser.GetUploadRateLimit(),
+			}),
+			torrents: make(map[[20]byte]pair),
+			torrentDefault: Limits{
+				Download: parser.GetTorrentDownloadRateLimit(),
+				Upload:   parser.GetTorrentUploadRateLimit(),
+			},
+		}
+	})
+	return limiter
+}
+
+// NewBucket returns a bucket filling at rate bytes per second, 0 is unlimited
+func NewBucket(rate int64) *Bucket {
+	b := &Bucket{}
+	b.SetRate(rate)
+	return b
+}
+
+// SetRate changes the rate of the bucket, the tokens taken so far are kept
+func (b *Bucket) SetRate(rate int64) {
+	if rate < 0 {
+		rate = 0
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refillLocked(time.Now())
+	b.rate = rate
+	if b.tokens > float64(rate) {
+		b.tokens = float64(rate)
+	}
+}
+
+// Rate returns the rate of the bucket in bytes per second, 0 is unlimited
+func (b *Bucket) Rate() int64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.rate
+}
+
+// Take takes n bytes from the bucket and returns how long the caller has to
+// wait before using them
+func (b *Bucket) Take(n int) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.rate == 0 {
+		return 0
+	}
+	b.refillLocked(time.Now())
+	b.tokens -= float64(n)
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / float64(b.rate) * float64(time.Second))
+}
+
+// refillLocked adds the bytes earned since the last call, at most a second of rate
+func (b *Bucket) refillLocked(now time.Time) {
+	if !b.last.IsZero() && b.rate > 0 {
+		b.tokens += now.Sub(b.last).Seconds() * float64(b.rate)
+		if b.tokens > float64(b.rate) {
+			b.tokens = float64(b.rate)
+		}
+	}
+	b.last = now
+}
+
+func newPair(limits Limits) pair {
+	return pair{download: NewBucket(limits.Download), upload: NewBucket(limits.Upload)}
+}
+
+func (p pair) limits() Limits {
+	return Limits{Download: p.download.Rate(), Upload: p.upload.Rate()}
+}
+
+func (p pair) set(limits Limits) {
+	p.download.SetRate(limits.Download)
+	p.upload.SetRate(limits.Upload)
+}
+
+// Global returns the limits of all peer connections
+func (l *Limiter) Global() Limits {
+	return l.global.limits()
+}
+
+// SetGlobal changes the limits of all peer connections, open connections included
+func (l *Limiter) SetGlobal(limits Limits) {
+	l.global.set(limits)
+}
+
+// TorrentDefault returns the limits torrents get unless they are set their own
+func (l *Limiter) TorrentDefault() Limits {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.torrentDefault
+}
+
+// Torrent returns the limits of the torrent, the default ones if it isn't added
+func (l *Limiter) Torrent(infoHash [20]byte) Limits {
+	if p, ok := l.torrent(infoHash); ok {
+		return p.limits()
+	}
+	return l.TorrentDefault()
+}
+
+// AddTorrent gives a torrent joining swarms of infoHashes the default limits,
+// limits it already has are kept
+func (l *Limiter) AddTorrent(infoHashes [][20]byte) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	p, ok := l.find(infoHashes)
+	if !ok {
+		p = newPair(l.torrentDefault)
+	}
+	for _, infoHash := range infoHashes {
+		l.torrents[infoHash] = p
+	}
+}
+
+// SetTorrent changes the limits of a torrent joining swarms of infoHashes,
+// a hybrid torrent shares them between its v1 and v2 swarms
+func (l *Limiter) SetTorrent(infoHashes [][20]byte, limits Limits) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	p, ok := l.find(infoHashes)
+	if ok {
+		p.set(limits)
+	} else {
+		p = newPair(limits)
+	}
+	for _, infoHash := range infoHashes {
+		l.torrents[infoHash] = p
+	}
+}
+
+func (l *Limiter) find(infoHashes [][20]byte) (pair, bool) {
+	for _, infoHash := range infoHashes {
+		if p, ok := l.torrents[infoHash]; ok {
+			return p, true
+		}
+	}
+	return pair{}, false
+}
+
+// RemoveTorrent forgets the limits of the torrent
+func (l *Limiter) RemoveTorrent(infoHashes [][20]byte) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, infoHash := range infoHashes {
+		delete(l.torrents, infoHash)
+	}
+}
+
+// torrent returns the buckets of the torrent, ok is false if it isn't added
+func (l *Limiter) torrent(infoHash [20]byte) (p pair, ok bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	p, ok = l.torrents[infoHash]
+	return p, ok
+}
@@ -0,0 +1,74 @@
+package bandwidth
+
+import (
+	"net"
+	"time"
+)
+
+// Wrap limits reads and writes of a peer connection of the torrent of
+// infoHash by the global limits and the torrent's ones once it's added
+func (l *Limiter) Wrap(conn net.Conn, infoHash [20]byte) net.Conn {
+	return &limitedConn{
+		Conn:     conn,
+		limiter:  l,
+		infoHash: infoHash,
+		closed:   make(chan struct{}),
+	}
+}
+
+// Read reads and then waits for what it has read to fit the download limits.
+// While it waits nothing more is read, so the peer slows down
+func (c *limitedConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		delays := []time.Duration{c.limiter.global.download.Take(n)}
+		if torrent, ok := c.limiter.torrent(c.infoHash); ok {
+			delays = append(delays, torrent.download.Take(n))
+		}
+		c.wait(delays...)
+	}
+	return n, err
+}
+
+// Write waits for the upload limits and writes b at once. Messages are
+// written from several goroutines, so writes are serialized to keep
+// them whole on the wire
+func (c *limitedConn) Write(b []byte) (int, error) {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	delays := []time.Duration{c.limiter.global.upload.Take(len(b))}
+	if torrent, ok := c.limiter.torrent(c.infoHash); ok {
+		delays = append(delays, torrent.upload.Take(len(b)))
+	}
+	if !c.wait(delays...) {
+		return 0, net.ErrClosed
+	}
+	return c.Conn.Write(b)
+}
+
+func (c *limitedConn) Close() error {
+	c.closeOnce.Do(func() { close(c.closed) })
+	return c.Conn.Close()
+}
+
+// wait sleeps for the longest of delays, it returns false if the connection is closed meanwhile
+func (c *limitedConn) wait(delays ...time.Duration) bool {
+	var longest time.Duration
+	for _, d := range delays {
+		if d > longest {
+			longest = d
+		}
+	}
+	if longest == 0 {
+		return true
+	}
+	timer := time.NewTimer(longest)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-c.closed:
+		return false
+	}
+}
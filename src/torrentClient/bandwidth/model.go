@@ -0,0 +1,51 @@
+package bandwidth
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// Bucket is a token bucket of bytes. Takes may run it into debt, the
+// caller then waits until the debt is paid at rate
+type Bucket struct {
+	mu sync.Mutex
+	// rate is in bytes per second, 0 is unlimited
+	rate   int64
+	tokens float64
+	last   time.Time
+}
+
+// Limits are rates in bytes per second, 0 is unlimited
+type Limits struct {
+	Download int64 `json:"download"`
+	Upload   int64 `json:"upload"`
+}
+
+// pair is the download and upload buckets of a level, global or a torrent
+type pair struct {
+	download *Bucket
+	upload   *Bucket
+}
+
+// Limiter keeps the global buckets and the buckets of torrents by infohash
+type Limiter struct {
+	mu       sync.Mutex
+	global   pair
+	torrents map[[20]byte]pair
+	// torrentDefault is given to torrents without limits of their own
+	torrentDefault Limits
+}
+
+// limitedConn takes what it reads and writes from the buckets of its torrent
+// and the global ones
+type limitedConn struct {
+	net.Conn
+	limiter  *Limiter
+	infoHash [20]byte
+	// writeMu keeps a message whole while its writer waits for the limits
+	writeMu sync.Mutex
+
+	closeOnce sync.Once
+	closed    chan struct{}
+}
@@ -0,0 +1,85 @@
+package bencodeRaw
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+)
+
+// DictValue returns the raw bencoded value stored under key
+// in the top-level dictionary of data
+func DictValue(data []byte, key string) ([]byte, error) {
+	if len(data) == 0 || data[0] != 'd' {
+		return nil, fmt.Errorf("expected dictionary")
+	}
+	pos := 1
+	for pos < len(data) && data[pos] != 'e' {
+		keyStart := pos
+		keyEnd, err := SkipValue(data, pos)
+		if err != nil {
+			return nil, err
+		}
+		if data[keyStart] < '0' || data[keyStart] > '9' {
+			return nil, fmt.Errorf("dictionary key at %v is not a string", keyStart)
+		}
+		valueStart := keyEnd
+		valueEnd, err := SkipValue(data, valueStart)
+		if err != nil {
+			return nil, err
+		}
+		if string(stringBody(data[keyStart:keyEnd])) == key {
+			return data[valueStart:valueEnd], nil
+		}
+		pos = valueEnd
+	}
+	return nil, fmt.Errorf("key '%v' not found", key)
+}
+
+func stringBody(raw []byte) []byte {
+	colon := bytes.IndexByte(raw, ':')
+	return raw[colon+1:]
+}
+
+// SkipValue returns the position right after the value starting at pos
+func SkipValue(data []byte, pos int) (int, error) {
+	if pos >= len(data) {
+		return 0, fmt.Errorf("unexpected end of data")
+	}
+	switch c := data[pos]; {
+	case c == 'i':
+		end := bytes.IndexByte(data[pos:], 'e')
+		if end < 0 {
+			return 0, fmt.Errorf("unterminated integer at %v", pos)
+		}
+		return pos + end + 1, nil
+	case c == 'l' || c == 'd':
+		pos++
+		for pos < len(data) && data[pos] != 'e' {
+			next, err := SkipValue(data, pos)
+			if err != nil {
+				return 0, err
+			}
+			pos = next
+		}
+		if pos >= len(data) {
+			return 0, fmt.Errorf("unterminated container")
+		}
+		return pos + 1, nil
+	case c >= '0' && c <= '9':
+		colon := bytes.IndexByte(data[pos:], ':')
+		if colon < 0 {
+			return 0, fmt.Errorf("malformed string length at %v", pos)
+		}
+		strLen, err := strconv.Atoi(string(data[pos : pos+colon]))
+		if err != nil || strLen < 0 {
+			return 0, fmt.Errorf("malformed string length at %v", pos)
+		}
+		end := pos + colon + 1 + strLen
+		if end > len(data) {
+			return 0, fmt.Errorf("string at %v exceeds data", pos)
+		}
+		return end, nil
+	default:
+		return 0, fmt.Errorf("unexpected byte '%c' at %v", c, pos)
+	}
+}
@@ -4,12 +4,17 @@ import (
 	"bytes"
 	"fmt"
 	"net"
+	"sync/atomic"
 	"time"
 
+	"torrentClient/bandwidth"
 	"torrentClient/bitfield"
 	"torrentClient/handshake"
 	"torrentClient/message"
+	"torrentClient/mse"
+	"torrentClient/parser/env"
 	"torrentClient/peers"
+	"torrentClient/utp"
 
 	"github.com/sirupsen/logrus"
 )
@@ -37,59 +42,236 @@ func completeHandshake(conn net.Conn, infohash, peerID [20]byte) (*handshake.Han
 	return res, nil
 }
 
-func recvBitfield(conn net.Conn) (bitfield.Bitfield, error) {
+// recvBitfield reads the peer's pieces, a BITFIELD or with the Fast
+// Extension HAVE ALL or HAVE NONE. haveAll is set for HAVE ALL, the bitfield
+// is sized later as the number of pieces may be unknown yet
+func recvBitfield(conn net.Conn, infoHash [20]byte) (bf bitfield.Bitfield, haveAll bool, err error) {
 	conn.SetDeadline(time.Now().Add(5 * time.Second))
 	defer conn.SetDeadline(time.Time{}) // Disable the deadline
 
 	msg, err := message.Read(conn)
 	if err != nil {
-		return nil, err
+		return nil, false, err
 	}
 	if msg == nil {
 		err := fmt.Errorf("expected bitfield but got %s", msg)
-		return nil, err
+		return nil, false, err
 	}
-	if msg.ID != message.MsgBitfield {
+	switch msg.ID {
+	case message.MsgBitfield:
+		return msg.Payload, false, nil
+	case message.MsgHaveAll:
+		return localSizedBitfield(infoHash, 0xFF), true, nil
+	case message.MsgHaveNone:
+		return localSizedBitfield(infoHash, 0), false, nil
+	default:
 		err := fmt.Errorf("expected bitfield but got ID %d", msg.ID)
+		return nil, false, err
+	}
+}
+
+// dialPeer connects over the address family of the peer. IPv6 routes are
+// often broken somewhere on the way, so IPv6 peers get a shorter timeout.
+// Peers which announced uTP are tried over it first, the rest over TCP,
+// then the other transport is tried
+func dialPeer(peer peers.Peer) (net.Conn, error) {
+	timeout := 10 * time.Second
+	network := "tcp4"
+	if peer.Family() == peers.FamilyIPv6 {
+		timeout = 5 * time.Second
+		network = "tcp6"
+	}
+	dialTcp := func() (net.Conn, error) {
+		return net.DialTimeout(network, peer.GetAddr(), timeout)
+	}
+
+	socket := utp.GetSocket()
+	if socket == nil {
+		return dialTcp()
+	}
+	dialUtp := func() (net.Conn, error) {
+		return socket.Dial(peer.GetAddr(), timeout)
+	}
+
+	first, second := dialTcp, dialUtp
+	if peer.Flags&peers.FlagUTP != 0 {
+		first, second = dialUtp, dialTcp
+	}
+	conn, err := first()
+	if err == nil {
+		return conn, nil
+	}
+	conn, secondErr := second()
+	if secondErr != nil {
+		return nil, fmt.Errorf("%v; %v", err, secondErr)
+	}
+	return conn, nil
+}
+
+// connectPeer dials the peer and negotiates encryption. Under the prefer
+// policy a peer which fails the MSE handshake is dialed again in plaintext
+func connectPeer(peer peers.Peer, infoHash [20]byte) (net.Conn, error) {
+	conn, err := dialPeer(peer)
+	if err != nil {
 		return nil, err
 	}
+	policy := mse.ParsePolicy(env.GetParser().GetEncryptionPolicy())
+	if policy == mse.PolicyDisable {
+		return conn, nil
+	}
 
-	return msg.Payload, nil
+	encrypted, err := mse.Initiate(conn, infoHash, policy.Provide())
+	if err == nil {
+		return encrypted, nil
+	}
+	conn.Close()
+	if policy == mse.PolicyRequire {
+		return nil, fmt.Errorf("encryption error: %v", err)
+	}
+	logrus.Debugf("Encryption with %v failed, falling back to plaintext: %v", peer.GetAddr(), err)
+	return dialPeer(peer)
 }
 
 // New connects with a peer, completes a handshake, and receives a handshake
-// returns an err if any of those fail.
+// returns an err if any of those fail. At most MAX_HALF_OPEN peers are dialed
+// at once and no peer is dialed while MAX_PEERS connections are open
 func New(peer peers.Peer, peerID, infoHash [20]byte) (*Client, error) {
-	conn, err := net.DialTimeout("tcp", peer.GetAddr(), 10 * time.Second)
+	if OpenConnections() >= env.GetParser().GetMaxPeers() {
+		return nil, fmt.Errorf("too many peer connections, not connecting to %v", peer.GetAddr())
+	}
+	acquireDial()
+	c, err := dial(peer, peerID, infoHash)
+	releaseDial()
+	if err != nil {
+		return nil, err
+	}
+	c.countConnection()
+	return c, nil
+}
+
+// dial connects with the peer and exchanges handshakes and bitfields
+func dial(peer peers.Peer, peerID, infoHash [20]byte) (*Client, error) {
+	conn, err := connectPeer(peer, infoHash)
 	if err != nil {
 		return nil, fmt.Errorf("dial error: %v; was connecting to %v", err, peer.GetAddr())
 	} else {
 		logrus.Infof("Connected to peer on %v", peer.GetAddr())
 	}
 
-	_, err = completeHandshake(conn, infoHash, peerID)
+	peerHandshake, err := completeHandshake(conn, infoHash, peerID)
 	if err != nil {
 		conn.Close()
 		return nil, fmt.Errorf("handshake error: %v", err)
 	}
 
-	bf, err := recvBitfield(conn)
+	if err := sendLocalBitfield(conn, infoHash, peerHandshake.SupportsFast()); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("bitfield write error: %v", err)
+	}
+
+	bf, haveAll, err := recvBitfield(conn, infoHash)
 	if err != nil {
 		conn.Close()
 		return nil, err
 	}
 
 	return &Client{
-		Conn:     conn,
+		Conn:     bandwidth.GetLimiter().Wrap(conn, infoHash),
 		Choked:   true,
 		Bitfield: bf,
+		haveAll:  haveAll,
 		peer:     peer,
 		infoHash: infoHash,
 		peerID:   peerID,
+
+		peerHandshake: peerHandshake,
+		done:          make(chan struct{}),
 	}, nil
 }
 
-// Read reads and consumes a message from the connection
+// Accept completes the handshake of an incoming connection. find returns
+// the peer id we use in the swarm of the infohash or an error if the torrent
+// isn't served. The peer may have no pieces and skip its bitfield, so unlike
+// New the bitfield isn't awaited, the reader goroutine applies it
+func Accept(conn net.Conn, find func(infoHash [20]byte) ([20]byte, error)) (*Client, error) {
+	conn.SetDeadline(time.Now().Add(3 * time.Second))
+	peerHandshake, err := handshake.Read(conn)
+	if err != nil {
+		conn.SetDeadline(time.Time{})
+		return nil, fmt.Errorf("handshake read error: %v", err)
+	}
+	peerID, err := find(peerHandshake.InfoHash)
+	if err != nil {
+		conn.SetDeadline(time.Time{})
+		return nil, err
+	}
+	if peerHandshake.PeerID == peerID {
+		conn.SetDeadline(time.Time{})
+		return nil, fmt.Errorf("connection to ourselves")
+	}
+	res := handshake.New(peerHandshake.InfoHash, peerID)
+	_, err = conn.Write(res.Serialize())
+	conn.SetDeadline(time.Time{})
+	if err != nil {
+		return nil, fmt.Errorf("handshake write error: %v", err)
+	}
+
+	if err := sendLocalBitfield(conn, peerHandshake.InfoHash, peerHandshake.SupportsFast()); err != nil {
+		return nil, fmt.Errorf("bitfield write error: %v", err)
+	}
+
+	c := &Client{
+		Conn:     bandwidth.GetLimiter().Wrap(conn, peerHandshake.InfoHash),
+		Choked:   true,
+		Bitfield: localSizedBitfield(peerHandshake.InfoHash, 0),
+		peer:     peerFromAddr(conn.RemoteAddr()),
+		incoming: true,
+		infoHash: peerHandshake.InfoHash,
+		peerID:   peerID,
+
+		peerHandshake: peerHandshake,
+		done:          make(chan struct{}),
+	}
+	c.countConnection()
+	return c, nil
+}
+
+func peerFromAddr(addr net.Addr) peers.Peer {
+	if tcpAddr, ok := addr.(*net.TCPAddr); ok {
+		return peers.Peer{IP: tcpAddr.IP, Port: uint16(tcpAddr.Port)}
+	}
+	if udpAddr, ok := addr.(*net.UDPAddr); ok {
+		return peers.Peer{IP: udpAddr.IP, Port: uint16(udpAddr.Port), Flags: peers.FlagUTP}
+	}
+	return peers.Peer{}
+}
+
+// Close closes the connection with the peer and signals Done
+func (c *Client) Close() error {
+	err := c.Conn.Close()
+	c.closeOnce.Do(func() {
+		if c.done != nil {
+			close(c.done)
+		}
+		if c.counted {
+			atomic.AddInt32(&openConnections, -1)
+		}
+	})
+	return err
+}
+
+// InfoHash returns the infohash the handshake was done with, the swarm of the peer
+func (c *Client) InfoHash() [20]byte {
+	return c.infoHash
+}
+
+// Done returns a channel which is closed when the client is closed
+func (c *Client) Done() <-chan struct{} {
+	return c.done
+}
+
+// Read reads and consumes a message from the connection. Only for use
+// before Start, then messages come from Messages
 func (c *Client) Read() (*message.Message, error) {
 	msg, err := message.Read(c.Conn)
 	return msg, err
@@ -102,14 +284,25 @@ func (c *Client) SendRequest(index, begin, length int) error {
 	return err
 }
 
+// SendCancel sends a Cancel message to the peer
+func (c *Client) SendCancel(index, begin, length int) error {
+	msg := message.FormatCancel(index, begin, length)
+	_, err := c.Conn.Write(msg.Serialize())
+	return err
+}
+
 // SendInterested sends an Interested message to the peer
 func (c *Client) SendInterested() error {
 	msg := message.Message{ID: message.MsgInterested}
 	_, err := c.Conn.Write(msg.Serialize())
 	if err != nil {
 		logrus.Errorf("Error sending interested msg: %v", err)
+		return err
 	}
-	return err
+	c.Mu.Lock()
+	c.amInterested = true
+	c.Mu.Unlock()
+	return nil
 }
 
 // SendNotInterested sends a NotInterested message to the peer
@@ -118,8 +311,12 @@ func (c *Client) SendNotInterested() error {
 	_, err := c.Conn.Write(msg.Serialize())
 	if err != nil {
 		logrus.Errorf("Error sending not interested msg: %v", err)
+		return err
 	}
-	return err
+	c.Mu.Lock()
+	c.amInterested = false
+	c.Mu.Unlock()
+	return nil
 }
 
 // SendUnchoke sends an Unchoke message to the peer
@@ -128,7 +325,47 @@ func (c *Client) SendUnchoke() error {
 	_, err := c.Conn.Write(msg.Serialize())
 	if err != nil {
 		logrus.Errorf("Error sending unchoke msg: %v", err)
+		return err
+	}
+	c.Mu.Lock()
+	c.amUnchoking = true
+	c.Mu.Unlock()
+	return nil
+}
+
+// SendChoke sends a Choke message to the peer
+func (c *Client) SendChoke() error {
+	msg := message.Message{ID: message.MsgChoke}
+	_, err := c.Conn.Write(msg.Serialize())
+	if err != nil {
+		logrus.Errorf("Error sending choke msg: %v", err)
+		return err
 	}
+	c.Mu.Lock()
+	c.amUnchoking = false
+	c.Mu.Unlock()
+	return nil
+}
+
+// SendPiece sends a block of a piece the peer has requested
+func (c *Client) SendPiece(index, begin int, data []byte) error {
+	msg := message.FormatPiece(index, begin, data)
+	_, err := c.Conn.Write(msg.Serialize())
+	return err
+}
+
+// SendReject tells the peer its request won't be answered, only for peers
+// which support the Fast Extension
+func (c *Client) SendReject(index, begin, length int) error {
+	msg := message.FormatReject(index, begin, length)
+	_, err := c.Conn.Write(msg.Serialize())
+	return err
+}
+
+// SendAllowedFast lets the peer request the piece while we choke it
+func (c *Client) SendAllowedFast(index int) error {
+	msg := message.FormatAllowedFast(index)
+	_, err := c.Conn.Write(msg.Serialize())
 	return err
 }
 
@@ -0,0 +1,139 @@
+package client
+
+import (
+	"fmt"
+
+	"torrentClient/message"
+
+	"github.com/sirupsen/logrus"
+)
+
+// RegisterExtension plugs an extension handler into the client. Local extended
+// message IDs are assigned in registration order starting from 1
+func (c *Client) RegisterExtension(h ExtensionHandler) {
+	c.extMu.Lock()
+	defer c.extMu.Unlock()
+
+	for _, registered := range c.extensions {
+		if registered.Name() == h.Name() {
+			logrus.Warnf("Extension %v is already registered for %v", h.Name(), c.GetShortInfo())
+			return
+		}
+	}
+	c.extensions = append(c.extensions, h)
+}
+
+// SendExtendedHandshake announces registered extensions to the peer
+func (c *Client) SendExtendedHandshake() error {
+	if !c.SupportsExtensions() {
+		return fmt.Errorf("peer %v doesn't support extensions", c.GetShortInfo())
+	}
+
+	c.extMu.Lock()
+	hs := message.ExtendedHandshake{M: make(map[string]int)}
+	for i, h := range c.extensions {
+		hs.M[h.Name()] = i + 1
+		if hook, ok := h.(ExtensionHandshakeHook); ok {
+			hook.FillHandshake(&hs)
+		}
+	}
+	c.extMu.Unlock()
+
+	msg, err := message.FormatExtendedHandshake(&hs)
+	if err != nil {
+		return err
+	}
+	_, err = c.Conn.Write(msg.Serialize())
+	return err
+}
+
+// HandleExtended dispatches an EXTENDED message to the handshake
+// processing or to the registered handler it is addressed to
+func (c *Client) HandleExtended(msg *message.Message) error {
+	extID, payload, err := message.ParseExtended(msg)
+	if err != nil {
+		return err
+	}
+
+	if extID == message.ExtHandshakeID {
+		return c.handleExtendedHandshake(payload)
+	}
+
+	c.extMu.Lock()
+	if int(extID) > len(c.extensions) {
+		c.extMu.Unlock()
+		logrus.Debugf("Got extended msg with unknown id %v from %v", extID, c.GetShortInfo())
+		return nil
+	}
+	h := c.extensions[extID-1]
+	c.extMu.Unlock()
+
+	return h.HandleMessage(c, payload)
+}
+
+func (c *Client) handleExtendedHandshake(payload []byte) error {
+	hs, err := message.ParseExtendedHandshake(payload)
+	if err != nil {
+		return err
+	}
+
+	c.extMu.Lock()
+	// Every handshake replaces the previous one, zero ID disables the extension
+	if c.remoteExtIDs == nil {
+		c.remoteExtIDs = make(map[string]uint8)
+	}
+	for name, id := range hs.M {
+		if id <= 0 || id > 255 {
+			delete(c.remoteExtIDs, name)
+			continue
+		}
+		c.remoteExtIDs[name] = uint8(id)
+	}
+	c.peerExtHandshake = hs
+	handlers := append([]ExtensionHandler{}, c.extensions...)
+	c.extMu.Unlock()
+
+	if c.incoming && hs.P > 0 && hs.P <= 65535 {
+		c.Mu.Lock()
+		c.peer.Port = uint16(hs.P)
+		c.Mu.Unlock()
+	}
+
+	logrus.Debugf("Got ext handshake from %v: %v", c.GetShortInfo(), hs.M)
+
+	for _, h := range handlers {
+		if hook, ok := h.(ExtensionHandshakeHook); ok {
+			if err := hook.OnHandshake(c, hs); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// PeerSupportsExtension reports whether the peer negotiated the extension
+func (c *Client) PeerSupportsExtension(name string) bool {
+	c.extMu.Lock()
+	defer c.extMu.Unlock()
+	_, ok := c.remoteExtIDs[name]
+	return ok
+}
+
+// PeerExtendedHandshake returns the last extension handshake of the peer or nil
+func (c *Client) PeerExtendedHandshake() *message.ExtendedHandshake {
+	c.extMu.Lock()
+	defer c.extMu.Unlock()
+	return c.peerExtHandshake
+}
+
+// SendExtended sends a message of the named extension using the ID the peer negotiated
+func (c *Client) SendExtended(name string, payload []byte) error {
+	c.extMu.Lock()
+	id, ok := c.remoteExtIDs[name]
+	c.extMu.Unlock()
+	if !ok {
+		return fmt.Errorf("peer %v doesn't support %v", c.GetShortInfo(), name)
+	}
+	_, err := c.Conn.Write(message.FormatExtended(id, payload).Serialize())
+	return err
+}
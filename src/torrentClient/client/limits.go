@@ -0,0 +1,37 @@
+package client
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"torrentClient/parser/env"
+)
+
+var dialSlotsOnce sync.Once
+var dialSlots chan struct{}
+
+// openConnections counts peer connections of all torrents
+var openConnections int32
+
+// OpenConnections returns the number of peer connections of all torrents
+func OpenConnections() int {
+	return int(atomic.LoadInt32(&openConnections))
+}
+
+// acquireDial waits until fewer than MAX_HALF_OPEN connections are being dialed
+func acquireDial() {
+	dialSlotsOnce.Do(func() {
+		dialSlots = make(chan struct{}, env.GetParser().GetMaxHalfOpen())
+	})
+	dialSlots <- struct{}{}
+}
+
+func releaseDial() {
+	<-dialSlots
+}
+
+// countConnection counts the client in OpenConnections until it's closed
+func (c *Client) countConnection() {
+	c.counted = true
+	atomic.AddInt32(&openConnections, 1)
+}
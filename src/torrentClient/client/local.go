@@ -0,0 +1,74 @@
+package client
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"torrentClient/bitfield"
+	"torrentClient/message"
+)
+
+var localPiecesMu sync.Mutex
+var localPieces = make(map[[20]byte]LocalPieces)
+
+// RegisterLocalPieces makes new connections of the torrent advertise our pieces
+func RegisterLocalPieces(infoHash [20]byte, pieces LocalPieces) {
+	localPiecesMu.Lock()
+	defer localPiecesMu.Unlock()
+	localPieces[infoHash] = pieces
+}
+
+// UnregisterLocalPieces stops advertising pieces registered with RegisterLocalPieces
+func UnregisterLocalPieces(infoHash [20]byte, pieces LocalPieces) {
+	localPiecesMu.Lock()
+	defer localPiecesMu.Unlock()
+	if localPieces[infoHash] == pieces {
+		delete(localPieces, infoHash)
+	}
+}
+
+func getLocalPieces(infoHash [20]byte) (LocalPieces, bool) {
+	localPiecesMu.Lock()
+	defer localPiecesMu.Unlock()
+	pieces, ok := localPieces[infoHash]
+	return pieces, ok
+}
+
+// localSizedBitfield returns a bitfield of the torrent's size with every
+// byte set to fill, nil if the size is unknown yet
+func localSizedBitfield(infoHash [20]byte, fill byte) bitfield.Bitfield {
+	pieces, ok := getLocalPieces(infoHash)
+	if !ok {
+		return nil
+	}
+	bf := make(bitfield.Bitfield, len(pieces.Bitfield()))
+	for i := range bf {
+		bf[i] = fill
+	}
+	return bf
+}
+
+// sendLocalBitfield sends our bitfield right after the handshake, the only
+// place the protocol allows it. Without the Fast Extension nothing is sent if
+// we have no pieces, with it HAVE NONE is sent then
+func sendLocalBitfield(conn net.Conn, infoHash [20]byte, fast bool) error {
+	var bf bitfield.Bitfield
+	if pieces, ok := getLocalPieces(infoHash); ok {
+		bf = pieces.Bitfield()
+	}
+
+	msg := &message.Message{ID: message.MsgBitfield, Payload: bf}
+	if bf.Empty() {
+		if !fast {
+			return nil
+		}
+		msg = &message.Message{ID: message.MsgHaveNone}
+	}
+
+	conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+	defer conn.SetWriteDeadline(time.Time{})
+
+	_, err := conn.Write(msg.Serialize())
+	return err
+}
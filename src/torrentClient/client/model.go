@@ -4,25 +4,99 @@ import (
 	"fmt"
 	"net"
 	"sync"
+	"time"
 
 	"torrentClient/bitfield"
+	"torrentClient/handshake"
+	"torrentClient/message"
 	"torrentClient/peers"
 )
 
 type Client struct {
 	Mu sync.Mutex
+	// Conn is limited by the bandwidth limits of the torrent and the global ones
 	Conn     net.Conn
 	Choked   bool
 	Bitfield bitfield.Bitfield
 	peer     peers.Peer
+	// incoming is set for peers which connected to us, peer has their
+	// outgoing port until they tell the one they listen on
+	incoming bool
 	infoHash [20]byte
 	peerID   [20]byte
+
+	peerHandshake *handshake.Handshake
+
+	closeOnce sync.Once
+	done      chan struct{}
+	// counted is set for clients counted in OpenConnections
+	counted bool
+
+	// Reader goroutine state, Mu guards Choked, Bitfield and the fields below
+	startOnce      sync.Once
+	messages       chan *message.Message
+	readErr        error
+	peerInterested bool
+	amInterested   bool
+	// amUnchoking is false at first, connections start with both sides choked
+	amUnchoking bool
+	lastSeen    time.Time
+	// haveAll is set by HAVE ALL, the bitfield is sized when the piece count is known
+	haveAll bool
+	// allowedFast are pieces the peer lets us request while it chokes us
+	allowedFast map[int]bool
+
+	extMu            sync.Mutex
+	extensions       []ExtensionHandler
+	remoteExtIDs     map[string]uint8
+	peerExtHandshake *message.ExtendedHandshake
+}
+
+// LocalPieces tells which pieces of a torrent we have. It is registered
+// per infohash with RegisterLocalPieces, peers get it as our bitfield
+type LocalPieces interface {
+	Bitfield() bitfield.Bitfield
+}
+
+// ExtensionHandler handles messages of one extension of the extension protocol.
+// Handlers are plugged into a client with RegisterExtension
+type ExtensionHandler interface {
+	// Name is the name the extension is negotiated with, e.g. "ut_metadata"
+	Name() string
+	// HandleMessage is called for every extended message of the extension
+	HandleMessage(c *Client, payload []byte) error
+}
+
+// ExtensionHandshakeHook is implemented by handlers that take part in
+// the extension protocol handshake
+type ExtensionHandshakeHook interface {
+	// FillHandshake is called before our handshake is sent to the peer
+	FillHandshake(hs *message.ExtendedHandshake)
+	// OnHandshake is called when the peer's handshake is received
+	OnHandshake(c *Client, hs *message.ExtendedHandshake) error
+}
+
+// SupportsFast reports whether the peer announced the Fast Extension,
+// we always do
+func (c *Client) SupportsFast() bool {
+	return c.peerHandshake != nil && c.peerHandshake.SupportsFast()
+}
+
+// SupportsExtensions reports whether the peer announced the extension protocol
+func (c *Client) SupportsExtensions() bool {
+	return c.peerHandshake != nil && c.peerHandshake.SupportsExtensions()
+}
+
+func (c *Client) GetPeer() peers.Peer {
+	c.Mu.Lock()
+	defer c.Mu.Unlock()
+	return c.peer
 }
 
 func (c *Client) GetClientInfo() string {
-	return fmt.Sprintf("Peer: %v\nChoked = %v\nBitfield: %v\n", c.peer.GetAddr(), c.Choked, c.Bitfield)
+	return fmt.Sprintf("Peer: %v\nChoked = %v\nBitfield: %v\n", c.GetPeer().GetAddr(), c.IsChoked(), c.BitfieldCopy())
 }
 
 func (c *Client) GetShortInfo() string {
-	return fmt.Sprintf("Peer addr: %v, is choked = %v", c.peer.GetAddr(), c.Choked)
+	return fmt.Sprintf("Peer addr: %v, is choked = %v", c.GetPeer().GetAddr(), c.IsChoked())
 }
@@ -0,0 +1,245 @@
+package client
+
+import (
+	"fmt"
+	"time"
+
+	"torrentClient/bitfield"
+	"torrentClient/message"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// readTimeout is how long a peer may be silent, peers send keep-alives every two minutes
+	readTimeout = 3 * time.Minute
+	// keepAliveInterval is how often we tell the peer we are still here
+	keepAliveInterval = 90 * time.Second
+	// messagesBuffer is how many messages may wait for the piece engine
+	messagesBuffer = 64
+)
+
+// Start starts the reader goroutine. Peer state messages (choke, interested,
+// have, bitfield) are applied to the client and extended messages are passed
+// to extensions, then every message but keep-alives and extended ones is sent
+// to Messages. Read must not be used after Start
+func (c *Client) Start() {
+	c.startOnce.Do(func() {
+		c.Mu.Lock()
+		c.messages = make(chan *message.Message, messagesBuffer)
+		c.lastSeen = time.Now()
+		c.Mu.Unlock()
+
+		go c.readLoop()
+		go c.keepAlive()
+	})
+}
+
+// Messages returns messages for the piece engine. The channel is closed
+// when the connection is lost, Err tells why
+func (c *Client) Messages() <-chan *message.Message {
+	c.Mu.Lock()
+	defer c.Mu.Unlock()
+	return c.messages
+}
+
+// Err returns the error the reader goroutine stopped with
+func (c *Client) Err() error {
+	c.Mu.Lock()
+	defer c.Mu.Unlock()
+	return c.readErr
+}
+
+func (c *Client) readLoop() {
+	defer close(c.messages)
+	defer c.Close()
+
+	for {
+		c.Conn.SetReadDeadline(time.Now().Add(readTimeout))
+		msg, err := message.Read(c.Conn)
+		if err != nil {
+			c.Mu.Lock()
+			c.readErr = fmt.Errorf("read msg err: %v", err)
+			c.Mu.Unlock()
+			return
+		}
+
+		c.Mu.Lock()
+		c.lastSeen = time.Now()
+		c.Mu.Unlock()
+		if msg == nil { // keep-alive
+			continue
+		}
+
+		if msg.ID == message.MsgExtended {
+			if err := c.HandleExtended(msg); err != nil {
+				logrus.Warnf("Error handling extended msg from %v: %v", c.GetShortInfo(), err)
+			}
+			continue
+		}
+		if err := c.applyState(msg); err != nil {
+			logrus.Warnf("Invalid %v from %v: %v", msg, c.GetShortInfo(), err)
+			continue
+		}
+
+		select {
+		case c.messages <- msg:
+		case <-c.done:
+			return
+		}
+	}
+}
+
+// applyState updates client state from CHOKE, UNCHOKE, INTERESTED,
+// NOT INTERESTED, HAVE, BITFIELD, HAVE ALL, HAVE NONE and ALLOWED FAST messages
+func (c *Client) applyState(msg *message.Message) error {
+	c.Mu.Lock()
+	defer c.Mu.Unlock()
+
+	switch msg.ID {
+	case message.MsgChoke:
+		c.Choked = true
+	case message.MsgUnchoke:
+		c.Choked = false
+	case message.MsgInterested:
+		c.peerInterested = true
+	case message.MsgNotInterested:
+		c.peerInterested = false
+	case message.MsgHave:
+		index, err := message.ParseHave(msg)
+		if err != nil {
+			return err
+		}
+		c.sizeBitfield()
+		c.Bitfield.SetPiece(index)
+	case message.MsgBitfield:
+		if len(msg.Payload) < len(c.Bitfield) {
+			return fmt.Errorf("bitfield is too short")
+		}
+		c.Bitfield = append(bitfield.Bitfield{}, msg.Payload...)
+		c.haveAll = false
+	case message.MsgHaveAll:
+		c.haveAll = true
+		c.sizeBitfield()
+	case message.MsgHaveNone:
+		c.haveAll = false
+		c.Bitfield = make(bitfield.Bitfield, len(c.Bitfield))
+		c.sizeBitfield()
+	case message.MsgAllowedFast:
+		index, err := message.ParseIndex(msg)
+		if err != nil {
+			return err
+		}
+		if c.allowedFast == nil {
+			c.allowedFast = make(map[int]bool)
+		}
+		c.allowedFast[index] = true
+	}
+	return nil
+}
+
+// sizeBitfield grows a bitfield left short by HAVE ALL, HAVE NONE or no
+// bitfield at all once the number of pieces is known. Mu must be held
+func (c *Client) sizeBitfield() {
+	var fill byte
+	if c.haveAll {
+		fill = 0xFF
+	}
+	if bf := localSizedBitfield(c.infoHash, fill); len(bf) > len(c.Bitfield) {
+		copy(bf, c.Bitfield)
+		c.Bitfield = bf
+	}
+}
+
+func (c *Client) keepAlive() {
+	ticker := time.NewTicker(keepAliveInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-ticker.C:
+			var keepAlive *message.Message
+			if _, err := c.Conn.Write(keepAlive.Serialize()); err != nil {
+				logrus.Debugf("Error sending keep-alive to %v: %v", c.GetShortInfo(), err)
+				return
+			}
+		}
+	}
+}
+
+// IsChoked reports whether the peer chokes us
+func (c *Client) IsChoked() bool {
+	c.Mu.Lock()
+	defer c.Mu.Unlock()
+	return c.Choked
+}
+
+// HasPiece reports whether the peer has the piece
+func (c *Client) HasPiece(index int) bool {
+	c.Mu.Lock()
+	defer c.Mu.Unlock()
+	return c.haveAll || c.Bitfield.HasPiece(index)
+}
+
+// CanRequest reports whether the piece may be requested from the peer now:
+// the peer has it and either doesn't choke us or allowed it fast
+func (c *Client) CanRequest(index int) bool {
+	c.Mu.Lock()
+	defer c.Mu.Unlock()
+	if !c.haveAll && !c.Bitfield.HasPiece(index) {
+		return false
+	}
+	return !c.Choked || c.allowedFast[index]
+}
+
+// IsAllowedFast reports whether the peer lets us request the piece while it chokes us
+func (c *Client) IsAllowedFast(index int) bool {
+	c.Mu.Lock()
+	defer c.Mu.Unlock()
+	return c.allowedFast[index]
+}
+
+// HasAllowedFast reports whether the peer allowed any piece fast
+func (c *Client) HasAllowedFast() bool {
+	c.Mu.Lock()
+	defer c.Mu.Unlock()
+	return len(c.allowedFast) > 0
+}
+
+// BitfieldCopy returns a copy of the peer's bitfield safe to use while the reader runs
+func (c *Client) BitfieldCopy() bitfield.Bitfield {
+	c.Mu.Lock()
+	defer c.Mu.Unlock()
+	c.sizeBitfield()
+	return append(bitfield.Bitfield{}, c.Bitfield...)
+}
+
+// IsPeerInterested reports whether the peer wants pieces from us
+func (c *Client) IsPeerInterested() bool {
+	c.Mu.Lock()
+	defer c.Mu.Unlock()
+	return c.peerInterested
+}
+
+// IsInterested reports whether we told the peer we want its pieces
+func (c *Client) IsInterested() bool {
+	c.Mu.Lock()
+	defer c.Mu.Unlock()
+	return c.amInterested
+}
+
+// IsChoking reports whether we choke the peer
+func (c *Client) IsChoking() bool {
+	c.Mu.Lock()
+	defer c.Mu.Unlock()
+	return !c.amUnchoking
+}
+
+// LastSeen returns when the peer sent anything last time
+func (c *Client) LastSeen() time.Time {
+	c.Mu.Lock()
+	defer c.Mu.Unlock()
+	return c.lastSeen
+}
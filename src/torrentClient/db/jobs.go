@@ -0,0 +1,134 @@
+package db
+
+import (
+	"sync"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	_ "github.com/lib/pq"
+	"github.com/sirupsen/logrus"
+)
+
+// DownloadJob is a download as it is kept between restarts of the torrent client
+type DownloadJob struct {
+	FileId    string    `db:"file_id"`
+	FileName  string    `db:"file_name"`
+	State     string    `db:"state"`
+	Error     string    `db:"error"`
+	Priority  int       `db:"priority"`
+	CreatedAt time.Time `db:"created_at"`
+	UpdatedAt time.Time `db:"updated_at"`
+}
+
+type jobsDb struct {
+	conn *sqlx.DB
+}
+
+var jobsDbOnce sync.Once
+var jobsDbObj *jobsDb
+
+// GetJobsDb returns the registry of download jobs
+func GetJobsDb() *jobsDb {
+	jobsDbOnce.Do(func() {
+		jobsDbObj = &jobsDb{}
+	})
+	return jobsDbObj
+}
+
+func (d *jobsDb) InitConnection(dsn string) {
+	conn, err := sqlx.Connect("postgres", dsn)
+	if err != nil {
+		logrus.Fatalf("Error connecting to jobs db: %v", err)
+	}
+	d.conn = conn
+}
+
+func (d *jobsDb) CloseConnection() {
+	if d.conn == nil {
+		return
+	}
+	if err := d.conn.Close(); err != nil {
+		logrus.Errorf("Error closing jobs db connection: %v", err)
+	}
+}
+
+func (d *jobsDb) InitTables() {
+	_, err := d.conn.Exec(`CREATE TABLE IF NOT EXISTS download_jobs (
+		file_id    TEXT PRIMARY KEY,
+		file_name  TEXT NOT NULL DEFAULT '',
+		state      TEXT NOT NULL,
+		error      TEXT NOT NULL DEFAULT '',
+		priority   INTEGER NOT NULL DEFAULT 0,
+		created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+		updated_at TIMESTAMPTZ NOT NULL DEFAULT now()
+	)`)
+	if err != nil {
+		logrus.Fatalf("Error creating download_jobs table: %v", err)
+	}
+	_, err = d.conn.Exec(`ALTER TABLE download_jobs ADD COLUMN IF NOT EXISTS priority INTEGER NOT NULL DEFAULT 0`)
+	if err != nil {
+		logrus.Fatalf("Error adding priority to download_jobs table: %v", err)
+	}
+}
+
+// SaveJob creates the job of the file, an older job of it is replaced
+func (d *jobsDb) SaveJob(fileId, state string, priority int) {
+	_, err := d.conn.Exec(`INSERT INTO download_jobs (file_id, state, priority) VALUES ($1, $2, $3)
+		ON CONFLICT (file_id) DO UPDATE SET state = $2, priority = $3, error = '', created_at = now(), updated_at = now()`,
+		fileId, state, priority)
+	if err != nil {
+		logrus.Errorf("Error saving job of %v: %v", fileId, err)
+	}
+}
+
+// SetJobState moves the job of the file to state, errText tells why it failed
+func (d *jobsDb) SetJobState(fileId, state, errText string) {
+	_, err := d.conn.Exec(`UPDATE download_jobs SET state = $2, error = $3, updated_at = now()
+		WHERE file_id = $1`, fileId, state, errText)
+	if err != nil {
+		logrus.Errorf("Error setting job state of %v: %v", fileId, err)
+	}
+}
+
+// SetJobPriority changes the priority of the job of the file in the queue
+func (d *jobsDb) SetJobPriority(fileId string, priority int) {
+	_, err := d.conn.Exec(`UPDATE download_jobs SET priority = $2, updated_at = now() WHERE file_id = $1`, fileId, priority)
+	if err != nil {
+		logrus.Errorf("Error setting job priority of %v: %v", fileId, err)
+	}
+}
+
+// SetJobFileName saves the name of the file on disk the job writes
+func (d *jobsDb) SetJobFileName(fileId, fileName string) {
+	_, err := d.conn.Exec(`UPDATE download_jobs SET file_name = $2 WHERE file_id = $1`, fileId, fileName)
+	if err != nil {
+		logrus.Errorf("Error setting job file name of %v: %v", fileId, err)
+	}
+}
+
+// GetJobs returns every saved job, oldest first
+func (d *jobsDb) GetJobs() []DownloadJob {
+	var jobs []DownloadJob
+	err := d.conn.Select(&jobs, `SELECT file_id, file_name, state, error, priority, created_at, updated_at
+		FROM download_jobs ORDER BY created_at`)
+	if err != nil {
+		logrus.Errorf("Error getting jobs: %v", err)
+		return nil
+	}
+	return jobs
+}
+
+// ClearInProgressStatuses clears in progress flags of every file storage
+// keeps, the torrent client sets them again for files it loads
+func (d *jobsDb) ClearInProgressStatuses() {
+	if _, err := d.conn.Exec(`UPDATE hypertube.loaded_files SET in_progress = false WHERE in_progress`); err != nil {
+		logrus.Errorf("Error clearing in progress statuses: %v", err)
+	}
+}
+
+// RemoveJob forgets the job of the file
+func (d *jobsDb) RemoveJob(fileId string) {
+	if _, err := d.conn.Exec(`DELETE FROM download_jobs WHERE file_id = $1`, fileId); err != nil {
+		logrus.Errorf("Error removing job of %v: %v", fileId, err)
+	}
+}
@@ -0,0 +1,547 @@
+package dht
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"torrentClient/peers"
+
+	"github.com/sirupsen/logrus"
+)
+
+// New creates a DHT server listening on config.Addr or using config.Conn. Call Start to serve
+func New(config Config) (*Server, error) {
+	conn := config.Conn
+	if conn == nil {
+		addr, err := net.ResolveUDPAddr("udp", config.Addr)
+		if err != nil {
+			return nil, fmt.Errorf("error resolving dht addr: %v", err)
+		}
+		conn, err = net.ListenUDP("udp", addr)
+		if err != nil {
+			return nil, fmt.Errorf("error listening dht addr: %v", err)
+		}
+	}
+
+	var self NodeID
+	if _, err := rand.Read(self[:]); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	s := &Server{
+		config:      config,
+		conn:        conn,
+		self:        self,
+		table:       newRoutingTable(self),
+		pending:     make(map[string]chan *krpcMsg),
+		storedPeers: make(map[NodeID]map[string]storedPeer),
+		stop:        make(chan struct{}),
+	}
+	s.rotateSecret()
+	return s, nil
+}
+
+// ID returns the node id of the server
+func (s *Server) ID() NodeID {
+	return s.self
+}
+
+// Addr returns the local UDP address of the server
+func (s *Server) Addr() *net.UDPAddr {
+	return s.conn.LocalAddr().(*net.UDPAddr)
+}
+
+// NodesCount returns the size of the routing table
+func (s *Server) NodesCount() int {
+	return s.table.size()
+}
+
+// Start serves incoming messages and joins the DHT through saved and bootstrap nodes
+func (s *Server) Start() {
+	s.loadNodes()
+	go s.readLoop()
+	go s.maintain()
+
+	if err := s.Bootstrap(context.Background()); err != nil {
+		logrus.Errorf("DHT bootstrap error: %v", err)
+	}
+}
+
+// Stop saves the node table and closes the socket
+func (s *Server) Stop() {
+	s.stopOnce.Do(func() {
+		close(s.stop)
+		s.saveNodes()
+		s.conn.Close()
+	})
+}
+
+// Bootstrap fills the routing table by looking up our own id
+func (s *Server) Bootstrap(ctx context.Context) error {
+	wg := sync.WaitGroup{}
+	for _, hostPort := range s.config.BootstrapNodes {
+		addr, err := net.ResolveUDPAddr("udp", hostPort)
+		if err != nil {
+			logrus.Warnf("Can't resolve DHT bootstrap node %v: %v", hostPort, err)
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := s.FindNode(addr, s.self); err != nil {
+				logrus.Debugf("DHT bootstrap node %v failed: %v", addr, err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	s.lookup(ctx, s.self, "find_node")
+	if s.table.size() == 0 {
+		return fmt.Errorf("no DHT nodes reachable")
+	}
+	logrus.Infof("DHT bootstrapped with %v nodes", s.table.size())
+	return nil
+}
+
+func (s *Server) maintain() {
+	saveTicker := time.NewTicker(saveNodesInterval)
+	refreshTicker := time.NewTicker(refreshInterval)
+	defer saveTicker.Stop()
+	defer refreshTicker.Stop()
+
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-saveTicker.C:
+			s.saveNodes()
+			s.expirePeers()
+		case <-refreshTicker.C:
+			s.lookup(context.Background(), s.self, "find_node")
+		}
+	}
+}
+
+func (s *Server) readLoop() {
+	buf := make([]byte, 65536)
+	for {
+		n, from, err := s.conn.ReadFrom(buf)
+		if err != nil {
+			select {
+			case <-s.stop:
+				return
+			default:
+			}
+			logrus.Errorf("DHT read error: %v", err)
+			continue
+		}
+		addr, ok := from.(*net.UDPAddr)
+		if !ok {
+			continue
+		}
+
+		msg, err := decodeMsg(buf[:n])
+		if err != nil {
+			logrus.Debugf("DHT malformed message from %v: %v", addr, err)
+			continue
+		}
+
+		switch msg.Y {
+		case "q":
+			s.handleQuery(msg, addr)
+		case "r", "e":
+			s.mu.Lock()
+			waiter, ok := s.pending[msg.T]
+			delete(s.pending, msg.T)
+			s.mu.Unlock()
+			if ok {
+				waiter <- msg
+			}
+		}
+	}
+}
+
+func (s *Server) send(addr *net.UDPAddr, msg map[string]interface{}) error {
+	data, err := encodeMsg(msg)
+	if err != nil {
+		return err
+	}
+	_, err = s.conn.WriteTo(data, addr)
+	return err
+}
+
+// query sends a KRPC query and waits for the response values
+func (s *Server) query(addr *net.UDPAddr, method string, args map[string]interface{}) (map[string]interface{}, error) {
+	args["id"] = string(s.self[:])
+
+	s.mu.Lock()
+	s.nextTrans++
+	var trans [2]byte
+	binary.BigEndian.PutUint16(trans[:], s.nextTrans)
+	waiter := make(chan *krpcMsg, 1)
+	s.pending[string(trans[:])] = waiter
+	s.mu.Unlock()
+
+	defer func() {
+		s.mu.Lock()
+		delete(s.pending, string(trans[:]))
+		s.mu.Unlock()
+	}()
+
+	err := s.send(addr, map[string]interface{}{
+		"t": string(trans[:]),
+		"y": "q",
+		"q": method,
+		"a": args,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	timer := time.NewTimer(queryTimeout)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil, fmt.Errorf("%v to %v timed out", method, addr)
+	case <-s.stop:
+		return nil, fmt.Errorf("dht stopped")
+	case msg := <-waiter:
+		if msg.Y == "e" {
+			return nil, fmt.Errorf("%v to %v returned error: %v", method, addr, msg.E)
+		}
+		id, err := getNodeID(msg.R, "id")
+		if err != nil {
+			return nil, err
+		}
+		s.table.insert(Node{ID: id, Addr: addr, LastSeen: time.Now()})
+		return msg.R, nil
+	}
+}
+
+// queryNode is query that also keeps track of failing nodes
+func (s *Server) queryNode(node Node, method string, args map[string]interface{}) (map[string]interface{}, error) {
+	res, err := s.query(node.Addr, method, args)
+	if err != nil {
+		s.table.failed(node.ID)
+	}
+	return res, err
+}
+
+// Ping checks that a node at addr is alive and adds it to the routing table
+func (s *Server) Ping(addr *net.UDPAddr) error {
+	_, err := s.query(addr, "ping", map[string]interface{}{})
+	return err
+}
+
+// FindNode asks a node at addr for nodes close to target
+func (s *Server) FindNode(addr *net.UDPAddr, target NodeID) ([]Node, error) {
+	res, err := s.query(addr, "find_node", map[string]interface{}{"target": string(target[:])})
+	if err != nil {
+		return nil, err
+	}
+	nodes, _ := res["nodes"].(string)
+	return decodeNodes(nodes), nil
+}
+
+// GetPeers looks up peers of the torrent in the DHT
+func (s *Server) GetPeers(ctx context.Context, infoHash [20]byte) []peers.Peer {
+	found, _ := s.lookup(ctx, infoHash, "get_peers")
+	return found
+}
+
+// Announce looks up the torrent and tells the closest nodes we have it on port
+func (s *Server) Announce(ctx context.Context, infoHash [20]byte, port uint16) []peers.Peer {
+	found, closest := s.lookup(ctx, infoHash, "get_peers")
+
+	announced := 0
+	for _, candidate := range closest {
+		if candidate.token == "" {
+			continue
+		}
+		_, err := s.queryNode(candidate.node, "announce_peer", map[string]interface{}{
+			"info_hash":    string(infoHash[:]),
+			"port":         int64(port),
+			"implied_port": int64(0),
+			"token":        candidate.token,
+		})
+		if err == nil {
+			announced++
+		}
+	}
+	logrus.Debugf("DHT announced %x to %v nodes, found %v peers", infoHash, announced, len(found))
+	return found
+}
+
+// lookup runs an iterative find_node or get_peers towards target. It returns
+// found peers (get_peers only) and the closest nodes that answered
+func (s *Server) lookup(ctx context.Context, target NodeID, method string) ([]peers.Peer, []lookupNode) {
+	candidates := make(map[NodeID]*lookupNode)
+	for _, node := range s.table.closest(target, K) {
+		candidates[node.ID] = &lookupNode{node: node}
+	}
+
+	found := make(map[string]peers.Peer)
+	responded := make(map[NodeID]bool)
+	mu := sync.Mutex{}
+
+	targetKey := "target"
+	if method == "get_peers" {
+		targetKey = "info_hash"
+	}
+
+	for round := 0; round < maxLookupRounds && ctx.Err() == nil; round++ {
+		batch := closestUnqueried(candidates, target, alpha)
+		if len(batch) == 0 {
+			break
+		}
+
+		wg := sync.WaitGroup{}
+		for _, candidate := range batch {
+			candidate.queried = true
+			wg.Add(1)
+			go func(candidate *lookupNode) {
+				defer wg.Done()
+				res, err := s.queryNode(candidate.node, method, map[string]interface{}{targetKey: string(target[:])})
+				if err != nil {
+					return
+				}
+
+				mu.Lock()
+				defer mu.Unlock()
+				responded[candidate.node.ID] = true
+				candidate.token, _ = res["token"].(string)
+				if values, ok := res["values"].([]interface{}); ok {
+					for _, peer := range decodePeers(values) {
+						found[peer.GetAddr()] = peer
+					}
+				}
+				nodes, _ := res["nodes"].(string)
+				for _, node := range decodeNodes(nodes) {
+					if _, known := candidates[node.ID]; !known && node.ID != s.self {
+						candidates[node.ID] = &lookupNode{node: node}
+					}
+				}
+			}(candidate)
+		}
+		wg.Wait()
+	}
+
+	closest := make([]lookupNode, 0, K)
+	for _, candidate := range sortedCandidates(candidates, target) {
+		if responded[candidate.node.ID] {
+			closest = append(closest, *candidate)
+		}
+		if len(closest) == K {
+			break
+		}
+	}
+
+	res := make([]peers.Peer, 0, len(found))
+	for _, peer := range found {
+		res = append(res, peer)
+	}
+	return res, closest
+}
+
+func sortedCandidates(candidates map[NodeID]*lookupNode, target NodeID) []*lookupNode {
+	res := make([]*lookupNode, 0, len(candidates))
+	for _, candidate := range candidates {
+		res = append(res, candidate)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return less(distance(res[i].node.ID, target), distance(res[j].node.ID, target))
+	})
+	return res
+}
+
+// closestUnqueried returns up to n unqueried nodes among the K closest candidates
+func closestUnqueried(candidates map[NodeID]*lookupNode, target NodeID, n int) []*lookupNode {
+	sorted := sortedCandidates(candidates, target)
+	if len(sorted) > K {
+		sorted = sorted[:K]
+	}
+	res := make([]*lookupNode, 0, n)
+	for _, candidate := range sorted {
+		if !candidate.queried {
+			res = append(res, candidate)
+		}
+		if len(res) == n {
+			break
+		}
+	}
+	return res
+}
+
+func (s *Server) handleQuery(msg *krpcMsg, addr *net.UDPAddr) {
+	id, err := getNodeID(msg.A, "id")
+	if err != nil {
+		s.sendError(msg.T, addr, errorProtocol, "invalid id")
+		return
+	}
+	s.table.insert(Node{ID: id, Addr: addr, LastSeen: time.Now()})
+
+	values := map[string]interface{}{"id": string(s.self[:])}
+
+	switch msg.Q {
+	case "ping":
+	case "find_node":
+		target, err := getNodeID(msg.A, "target")
+		if err != nil {
+			s.sendError(msg.T, addr, errorProtocol, "invalid target")
+			return
+		}
+		values["nodes"] = encodeNodes(s.table.closest(target, K))
+	case "get_peers":
+		infoHash, err := getNodeID(msg.A, "info_hash")
+		if err != nil {
+			s.sendError(msg.T, addr, errorProtocol, "invalid info_hash")
+			return
+		}
+		values["token"] = s.token(addr, s.currentSecret())
+		if stored := s.peersFor(infoHash); len(stored) > 0 {
+			values["values"] = stored
+		} else {
+			values["nodes"] = encodeNodes(s.table.closest(infoHash, K))
+		}
+	case "announce_peer":
+		if err := s.handleAnnounce(msg.A, addr); err != nil {
+			s.sendError(msg.T, addr, errorProtocol, err.Error())
+			return
+		}
+	default:
+		s.sendError(msg.T, addr, errorMethod, "method unknown")
+		return
+	}
+
+	if err := s.send(addr, map[string]interface{}{"t": msg.T, "y": "r", "r": values}); err != nil {
+		logrus.Debugf("DHT error responding %v: %v", addr, err)
+	}
+}
+
+func (s *Server) handleAnnounce(args map[string]interface{}, addr *net.UDPAddr) error {
+	infoHash, err := getNodeID(args, "info_hash")
+	if err != nil {
+		return err
+	}
+	token, _ := args["token"].(string)
+	if !s.validToken(addr, token) {
+		return fmt.Errorf("bad token")
+	}
+
+	peerAddr := &net.UDPAddr{IP: addr.IP, Port: addr.Port}
+	if implied, _ := args["implied_port"].(int64); implied == 0 {
+		port, ok := args["port"].(int64)
+		if !ok || port <= 0 || port > 65535 {
+			return fmt.Errorf("invalid port")
+		}
+		peerAddr.Port = int(port)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.storedPeers[infoHash] == nil {
+		s.storedPeers[infoHash] = make(map[string]storedPeer)
+	}
+	s.storedPeers[infoHash][peerAddr.String()] = storedPeer{addr: peerAddr, expires: time.Now().Add(peerTTL)}
+	return nil
+}
+
+func (s *Server) peersFor(infoHash NodeID) []interface{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	res := make([]interface{}, 0)
+	for _, stored := range s.storedPeers[infoHash] {
+		if time.Now().After(stored.expires) {
+			continue
+		}
+		if compact := encodePeer(stored.addr); compact != "" {
+			res = append(res, compact)
+		}
+		if len(res) == maxPeersInResponse {
+			break
+		}
+	}
+	return res
+}
+
+func (s *Server) expirePeers() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for infoHash, stored := range s.storedPeers {
+		for addr, peer := range stored {
+			if time.Now().After(peer.expires) {
+				delete(stored, addr)
+			}
+		}
+		if len(stored) == 0 {
+			delete(s.storedPeers, infoHash)
+		}
+	}
+}
+
+func (s *Server) sendError(trans string, addr *net.UDPAddr, code int, text string) {
+	err := s.send(addr, map[string]interface{}{
+		"t": trans,
+		"y": "e",
+		"e": []interface{}{int64(code), text},
+	})
+	if err != nil {
+		logrus.Debugf("DHT error sending error to %v: %v", addr, err)
+	}
+}
+
+func (s *Server) rotateSecret() {
+	secret := make([]byte, 16)
+	rand.Read(secret)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.prevSecret = s.secret
+	s.secret = secret
+	s.secretIssued = time.Now()
+}
+
+func (s *Server) currentSecret() []byte {
+	s.mu.Lock()
+	expired := time.Since(s.secretIssued) > tokenRotation
+	s.mu.Unlock()
+	if expired {
+		s.rotateSecret()
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.secret
+}
+
+func (s *Server) token(addr *net.UDPAddr, secret []byte) string {
+	h := sha1.New()
+	h.Write(secret)
+	h.Write(addr.IP)
+	return string(h.Sum(nil))
+}
+
+// validToken accepts tokens issued with the current or the previous secret
+func (s *Server) validToken(addr *net.UDPAddr, token string) bool {
+	s.mu.Lock()
+	secrets := [][]byte{s.secret, s.prevSecret}
+	s.mu.Unlock()
+
+	for _, secret := range secrets {
+		if secret != nil && token == s.token(addr, secret) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,134 @@
+package dht
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+// clusterSize keeps every node in the bootstrap node's table, no bucket can overflow
+const clusterSize = K
+
+// newCluster starts clusterSize local nodes that all bootstrap from the first one
+func newCluster(t *testing.T) []*Server {
+	nodes := make([]*Server, 0, clusterSize)
+	for i := 0; i < clusterSize; i++ {
+		config := Config{Addr: "127.0.0.1:0"}
+		if i > 0 {
+			config.BootstrapNodes = []string{nodes[0].Addr().String()}
+		}
+		s, err := New(config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(s.Stop)
+		s.Start()
+		nodes = append(nodes, s)
+	}
+	return nodes
+}
+
+func TestBootstrap(t *testing.T) {
+	nodes := newCluster(t)
+
+	if got := nodes[0].NodesCount(); got != clusterSize-1 {
+		t.Errorf("bootstrap node knows %v nodes, want %v", got, clusterSize-1)
+	}
+	for i, s := range nodes[1:] {
+		if s.NodesCount() == 0 {
+			t.Errorf("node %v has an empty routing table", i+1)
+		}
+	}
+
+	last := nodes[clusterSize-1]
+	found, err := nodes[1].FindNode(last.Addr(), nodes[2].ID())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(found) == 0 {
+		t.Error("find_node returned no nodes")
+	}
+}
+
+func TestAnnounceAndGetPeers(t *testing.T) {
+	nodes := newCluster(t)
+	infoHash := [20]byte{0xab, 0xcd}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if found := nodes[3].GetPeers(ctx, infoHash); len(found) != 0 {
+		t.Fatalf("got %v peers before any announce", len(found))
+	}
+
+	nodes[3].Announce(ctx, infoHash, 7000)
+
+	found := nodes[clusterSize-1].GetPeers(ctx, infoHash)
+	if len(found) == 0 {
+		t.Fatal("get_peers found no peers after announce")
+	}
+	for _, peer := range found {
+		if !peer.IP.Equal(net.IPv4(127, 0, 0, 1)) || peer.Port != 7000 {
+			t.Errorf("got peer %v:%v, want 127.0.0.1:7000", peer.IP, peer.Port)
+		}
+	}
+}
+
+func TestAnnounceToken(t *testing.T) {
+	nodes := newCluster(t)
+	client, target := nodes[1], nodes[0]
+	infoHash := [20]byte{0x42}
+
+	announce := func(token string) error {
+		_, err := client.query(target.Addr(), "announce_peer", map[string]interface{}{
+			"info_hash":    string(infoHash[:]),
+			"port":         int64(7001),
+			"implied_port": int64(0),
+			"token":        token,
+		})
+		return err
+	}
+	getToken := func() string {
+		res, err := client.query(target.Addr(), "get_peers", map[string]interface{}{
+			"info_hash": string(infoHash[:]),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		token, _ := res["token"].(string)
+		if token == "" {
+			t.Fatal("get_peers returned no token")
+		}
+		return token
+	}
+
+	if err := announce("not a token"); err == nil {
+		t.Error("announce with a bad token was accepted")
+	}
+	if stored := target.peersFor(infoHash); len(stored) != 0 {
+		t.Fatalf("bad token stored %v peers", len(stored))
+	}
+
+	token := getToken()
+	if err := announce(token); err != nil {
+		t.Fatalf("announce with a fresh token: %v", err)
+	}
+	if stored := target.peersFor(infoHash); len(stored) != 1 {
+		t.Fatalf("got %v stored peers, want 1", len(stored))
+	}
+
+	token = getToken()
+	target.rotateSecret()
+	if err := announce(token); err != nil {
+		t.Errorf("token from the previous secret was rejected: %v", err)
+	}
+	target.rotateSecret()
+	if err := announce(token); err == nil {
+		t.Error("token from an expired secret was accepted")
+	}
+
+	other := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: client.Addr().Port}
+	if target.validToken(other, getToken()) {
+		t.Error("token was accepted from another IP")
+	}
+}
@@ -0,0 +1,137 @@
+package dht
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+
+	"torrentClient/peers"
+
+	"github.com/jackpal/bencode-go"
+)
+
+const (
+	errorGeneric  = 201
+	errorProtocol = 203
+	errorMethod   = 204
+)
+
+func encodeMsg(msg map[string]interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := bencode.Marshal(&buf, msg); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func decodeMsg(data []byte) (*krpcMsg, error) {
+	decoded, err := bencode.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	dict, ok := decoded.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("krpc message is not a dict")
+	}
+
+	msg := krpcMsg{}
+	msg.T, _ = dict["t"].(string)
+	msg.Y, _ = dict["y"].(string)
+	msg.Q, _ = dict["q"].(string)
+	msg.A, _ = dict["a"].(map[string]interface{})
+	msg.R, _ = dict["r"].(map[string]interface{})
+	msg.E, _ = dict["e"].([]interface{})
+
+	switch msg.Y {
+	case "q":
+		if msg.A == nil {
+			return nil, fmt.Errorf("query without arguments")
+		}
+	case "r":
+		if msg.R == nil {
+			return nil, fmt.Errorf("response without values")
+		}
+	case "e":
+	default:
+		return nil, fmt.Errorf("unknown message type '%v'", msg.Y)
+	}
+	return &msg, nil
+}
+
+func getNodeID(dict map[string]interface{}, key string) (NodeID, error) {
+	var id NodeID
+	raw, ok := dict[key].(string)
+	if !ok || len(raw) != len(id) {
+		return id, fmt.Errorf("invalid '%v'", key)
+	}
+	copy(id[:], raw)
+	return id, nil
+}
+
+func encodeNodes(nodes []Node) string {
+	buf := make([]byte, 0, len(nodes)*compactNodeSize)
+	for _, node := range nodes {
+		ip := node.Addr.IP.To4()
+		if ip == nil {
+			continue
+		}
+		buf = append(buf, node.ID[:]...)
+		buf = append(buf, ip...)
+		buf = append(buf, byte(node.Addr.Port>>8), byte(node.Addr.Port))
+	}
+	return string(buf)
+}
+
+func decodeNodes(raw string) []Node {
+	res := make([]Node, 0, len(raw)/compactNodeSize)
+	for offset := 0; offset+compactNodeSize <= len(raw); offset += compactNodeSize {
+		node := Node{}
+		copy(node.ID[:], raw[offset:offset+20])
+		node.Addr = &net.UDPAddr{
+			IP:   net.IP([]byte(raw[offset+20 : offset+24])),
+			Port: int(binary.BigEndian.Uint16([]byte(raw[offset+24 : offset+26]))),
+		}
+		if node.Addr.Port == 0 {
+			continue
+		}
+		res = append(res, node)
+	}
+	return res
+}
+
+func encodePeer(addr *net.UDPAddr) string {
+	ip := addr.IP.To4()
+	if ip == nil {
+		return ""
+	}
+	return string(append(append([]byte{}, ip...), byte(addr.Port>>8), byte(addr.Port)))
+}
+
+func decodePeers(values []interface{}) []peers.Peer {
+	res := make([]peers.Peer, 0, len(values))
+	for _, value := range values {
+		raw, ok := value.(string)
+		if !ok {
+			continue
+		}
+		var parsed []peers.Peer
+		var err error
+		switch len(raw) {
+		case compactPeerSize:
+			parsed, err = peers.Unmarshal([]byte(raw))
+		case compactPeer6Size:
+			parsed, err = peers.Unmarshal6([]byte(raw))
+		default:
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		for _, peer := range parsed {
+			peer.Source = peers.SourceDht
+			res = append(res, peer)
+		}
+	}
+	return res
+}
@@ -0,0 +1,99 @@
+package dht
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// K is the max number of nodes in a bucket and the size of lookup results
+	K = 8
+	// alpha is the number of parallel queries during a lookup
+	alpha = 3
+	// maxLookupRounds bounds iterative lookups
+	maxLookupRounds = 16
+
+	queryTimeout = 2 * time.Second
+	// maxNodeFailures is the number of unanswered queries after which a node is removed
+	maxNodeFailures = 3
+	// tokenRotation is how often the secret behind get_peers tokens changes
+	tokenRotation = 5 * time.Minute
+	// peerTTL is how long an announced peer is kept
+	peerTTL = 30 * time.Minute
+	// maxPeersInResponse limits "values" in get_peers responses
+	maxPeersInResponse = 50
+	// saveNodesInterval is how often the node table is written to disk
+	saveNodesInterval = 10 * time.Minute
+	// refreshInterval is how often the routing table is refreshed with a self lookup
+	refreshInterval = 15 * time.Minute
+
+	compactNodeSize = 26
+	compactPeerSize = 6
+	// compactPeer6Size is the size of IPv6 peers some nodes return (BEP 32)
+	compactPeer6Size = 18
+)
+
+// NodeID identifies nodes and infohashes in the DHT keyspace
+type NodeID [20]byte
+
+// Node is a remote DHT node
+type Node struct {
+	ID       NodeID
+	Addr     *net.UDPAddr
+	LastSeen time.Time
+	failures int
+}
+
+// Config holds DHT server settings
+type Config struct {
+	// Addr is the UDP address to listen on, e.g. ":6881"
+	Addr string
+	// Conn is a socket to use instead of listening on Addr, e.g. one shared with uTP
+	Conn net.PacketConn
+	// BootstrapNodes are "host:port" of well-known routers
+	BootstrapNodes []string
+	// NodesFile is where the node table is kept between restarts, may be empty
+	NodesFile string
+}
+
+// Server is a mainline DHT (BEP 5) node
+type Server struct {
+	config Config
+	conn   net.PacketConn
+	self   NodeID
+	table  *routingTable
+
+	mu           sync.Mutex
+	pending      map[string]chan *krpcMsg
+	nextTrans    uint16
+	storedPeers  map[NodeID]map[string]storedPeer
+	secret       []byte
+	prevSecret   []byte
+	secretIssued time.Time
+
+	stopOnce sync.Once
+	stop     chan struct{}
+}
+
+type storedPeer struct {
+	addr    *net.UDPAddr
+	expires time.Time
+}
+
+// krpcMsg is a decoded KRPC message
+type krpcMsg struct {
+	T string
+	Y string
+	Q string
+	A map[string]interface{}
+	R map[string]interface{}
+	E []interface{}
+}
+
+// lookupNode is a node met during an iterative lookup
+type lookupNode struct {
+	node    Node
+	queried bool
+	token   string
+}
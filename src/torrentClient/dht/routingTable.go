@@ -0,0 +1,135 @@
+package dht
+
+import (
+	"math/bits"
+	"sort"
+	"sync"
+	"time"
+)
+
+type routingTable struct {
+	mu      sync.Mutex
+	self    NodeID
+	buckets [160][]*Node
+}
+
+func newRoutingTable(self NodeID) *routingTable {
+	return &routingTable{self: self}
+}
+
+func distance(a, b NodeID) NodeID {
+	var res NodeID
+	for i := range a {
+		res[i] = a[i] ^ b[i]
+	}
+	return res
+}
+
+// less reports whether a is closer to the target than b, both being xor distances
+func less(a, b NodeID) bool {
+	for i := range a {
+		if a[i] != b[i] {
+			return a[i] < b[i]
+		}
+	}
+	return false
+}
+
+// bucketIndex is the length of the common prefix of id and self
+func (t *routingTable) bucketIndex(id NodeID) int {
+	d := distance(t.self, id)
+	for i, b := range d {
+		if b != 0 {
+			return i*8 + bits.LeadingZeros8(b)
+		}
+	}
+	return len(t.buckets) - 1
+}
+
+// insert adds a node which responded to us or queried us. Full buckets
+// keep their nodes unless the oldest one stopped answering
+func (t *routingTable) insert(node Node) {
+	if node.ID == t.self || node.Addr == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	idx := t.bucketIndex(node.ID)
+	bucket := t.buckets[idx]
+	for i, existing := range bucket {
+		if existing.ID == node.ID {
+			existing.Addr = node.Addr
+			existing.LastSeen = node.LastSeen
+			existing.failures = 0
+			t.buckets[idx] = append(append(bucket[:i:i], bucket[i+1:]...), existing)
+			return
+		}
+	}
+
+	newNode := node
+	if len(bucket) < K {
+		t.buckets[idx] = append(bucket, &newNode)
+		return
+	}
+	for i, existing := range bucket {
+		if existing.failures > 0 || time.Since(existing.LastSeen) > refreshInterval {
+			t.buckets[idx] = append(append(bucket[:i:i], bucket[i+1:]...), &newNode)
+			return
+		}
+	}
+}
+
+// failed counts an unanswered query, removing nodes that fail too often
+func (t *routingTable) failed(id NodeID) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	idx := t.bucketIndex(id)
+	bucket := t.buckets[idx]
+	for i, existing := range bucket {
+		if existing.ID == id {
+			existing.failures++
+			if existing.failures >= maxNodeFailures {
+				t.buckets[idx] = append(bucket[:i:i], bucket[i+1:]...)
+			}
+			return
+		}
+	}
+}
+
+// closest returns up to n known nodes closest to target
+func (t *routingTable) closest(target NodeID, n int) []Node {
+	all := t.nodes()
+	sort.Slice(all, func(i, j int) bool {
+		return less(distance(all[i].ID, target), distance(all[j].ID, target))
+	})
+	if len(all) > n {
+		all = all[:n]
+	}
+	return all
+}
+
+func (t *routingTable) nodes() []Node {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	res := make([]Node, 0)
+	for _, bucket := range t.buckets {
+		for _, node := range bucket {
+			res = append(res, *node)
+		}
+	}
+	return res
+}
+
+func (t *routingTable) size() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	res := 0
+	for _, bucket := range t.buckets {
+		res += len(bucket)
+	}
+	return res
+}
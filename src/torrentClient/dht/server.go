@@ -0,0 +1,45 @@
+package dht
+
+import (
+	"fmt"
+	"sync"
+
+	"torrentClient/parser/env"
+	"torrentClient/utp"
+
+	"github.com/sirupsen/logrus"
+)
+
+var syncOnce sync.Once
+var server *Server
+
+// GetServer returns the DHT node of the torrent client, nil if DHT is
+// disabled or failed to start
+func GetServer() *Server {
+	syncOnce.Do(func() {
+		if !env.GetParser().IsDhtEnabled() {
+			logrus.Infof("DHT is disabled")
+			return
+		}
+
+		config := Config{
+			Addr:           fmt.Sprintf(":%v", env.GetParser().GetDhtPort()),
+			BootstrapNodes: env.GetParser().GetDhtBootstrapNodes(),
+			NodesFile:      env.GetParser().GetDhtNodesFile(),
+		}
+		// uTP takes the UDP peer port, DHT messages on it are passed on
+		if env.GetParser().GetDhtPort() == env.GetParser().GetTorrentPeerPort() {
+			if socket := utp.GetSocket(); socket != nil {
+				config.Conn = socket.Fallback()
+			}
+		}
+
+		var err error
+		server, err = New(config)
+		if err != nil {
+			logrus.Errorf("Error creating DHT server: %v", err)
+			server = nil
+		}
+	})
+	return server
+}
@@ -0,0 +1,55 @@
+package dht
+
+import (
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// saveNodes writes the routing table to the nodes file in compact form
+func (s *Server) saveNodes() {
+	if s.config.NodesFile == "" {
+		return
+	}
+	data := encodeNodes(s.table.nodes())
+	if len(data) == 0 {
+		return
+	}
+
+	tmpName := s.config.NodesFile + ".tmp"
+	if err := ioutil.WriteFile(tmpName, []byte(data), 0644); err != nil {
+		logrus.Errorf("Error saving DHT nodes: %v", err)
+		return
+	}
+	if err := os.Rename(tmpName, s.config.NodesFile); err != nil {
+		logrus.Errorf("Error saving DHT nodes: %v", err)
+		return
+	}
+	logrus.Debugf("Saved %v DHT nodes", len(data)/compactNodeSize)
+}
+
+// loadNodes puts nodes saved by a previous run into the routing table.
+// They are not verified, nodes that don't answer are evicted as usual
+func (s *Server) loadNodes() {
+	if s.config.NodesFile == "" {
+		return
+	}
+	data, err := ioutil.ReadFile(s.config.NodesFile)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			logrus.Errorf("Error loading DHT nodes: %v", err)
+		}
+		return
+	}
+
+	// Pretend the nodes are stale so fresh ones may replace them
+	lastSeen := time.Now().Add(-refreshInterval)
+	nodes := decodeNodes(string(data))
+	for _, node := range nodes {
+		node.LastSeen = lastSeen
+		s.table.insert(node)
+	}
+	logrus.Infof("Loaded %v DHT nodes", len(nodes))
+}
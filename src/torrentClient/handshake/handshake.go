@@ -8,11 +8,41 @@ import (
 
 // New creates a new handshake with the standard pstr
 func New(infoHash, peerID [20]byte) *Handshake {
-	return &Handshake{
+	h := &Handshake{
 		Pstr:     "BitTorrent protocol",
 		InfoHash: infoHash,
 		PeerID:   peerID,
 	}
+	h.SetCapability(CapabilityExtensions)
+	h.SetCapability(CapabilityFast)
+	return h
+}
+
+// SetCapability sets the capability flag in the reserved bytes
+func (h *Handshake) SetCapability(c Capability) {
+	h.Reserved[c.byteIndex] |= c.mask
+}
+
+// ClearCapability clears the capability flag in the reserved bytes
+func (h *Handshake) ClearCapability(c Capability) {
+	h.Reserved[c.byteIndex] &^= c.mask
+}
+
+// HasCapability reports whether the capability flag is set
+func (h *Handshake) HasCapability(c Capability) bool {
+	return h.Reserved[c.byteIndex]&c.mask != 0
+}
+
+// SupportsExtensions reports whether the sender of the handshake
+// understands extended messages
+func (h *Handshake) SupportsExtensions() bool {
+	return h.HasCapability(CapabilityExtensions)
+}
+
+// SupportsFast reports whether the sender of the handshake
+// understands Fast Extension messages
+func (h *Handshake) SupportsFast() bool {
+	return h.HasCapability(CapabilityFast)
 }
 
 // Serialize serializes the handshake to a buffer
@@ -21,7 +51,7 @@ func (h *Handshake) Serialize() []byte {
 	buf[0] = byte(len(h.Pstr))
 	curr := 1
 	curr += copy(buf[curr:], h.Pstr)
-	curr += copy(buf[curr:], make([]byte, 8)) // 8 reserved bytes
+	curr += copy(buf[curr:], h.Reserved[:]) // 8 reserved bytes
 	curr += copy(buf[curr:], h.InfoHash[:])
 	curr += copy(buf[curr:], h.PeerID[:])
 	return buf
@@ -57,6 +87,7 @@ func Read(r io.Reader) (*Handshake, error) {
 		InfoHash: infoHash,
 		PeerID:   peerID,
 	}
+	copy(h.Reserved[:], handshakeBuf[pstrlen:pstrlen+8])
 
 	return &h, nil
 }
@@ -2,6 +2,24 @@ package handshake
 
 type Handshake struct {
 	Pstr     string
+	Reserved [8]byte
 	InfoHash [20]byte
 	PeerID   [20]byte
 }
+
+// Capability is a feature flag in the reserved bytes of a handshake
+type Capability struct {
+	byteIndex int
+	mask      byte
+}
+
+var (
+	// CapabilityExtensions marks the extension protocol (BEP 10)
+	CapabilityExtensions = Capability{byteIndex: 5, mask: 0x10}
+	// CapabilityDHT marks DHT support (BEP 5)
+	CapabilityDHT = Capability{byteIndex: 7, mask: 0x01}
+	// CapabilityFast marks the Fast Extension (BEP 6)
+	CapabilityFast = Capability{byteIndex: 7, mask: 0x04}
+	// CapabilityV2 marks BitTorrent v2 upgrade support (BEP 52)
+	CapabilityV2 = Capability{byteIndex: 7, mask: 0x10}
+)
@@ -0,0 +1,61 @@
+package jobs
+
+import (
+	"context"
+	"fmt"
+
+	"torrentClient/db"
+	"torrentClient/torrentfile"
+
+	"github.com/sirupsen/logrus"
+)
+
+// dbFiles finds torrents of files in the files database and loads them to disk
+type dbFiles struct{}
+
+func (dbFiles) Has(fileId string) bool {
+	_, _, ok := db.GetFilesManagerDb().GetTorrentOrMagnetForByFileId(fileId)
+	return ok
+}
+
+func (dbFiles) Read(fileId string) (*torrentfile.TorrentFile, error) {
+	torrentBytes, magnetLink, ok := db.GetFilesManagerDb().GetTorrentOrMagnetForByFileId(fileId)
+	if !ok {
+		return nil, ErrNotFound
+	}
+	torrent, err := torrentfile.ReadTorrentOrMagnet(torrentBytes, magnetLink)
+	if err != nil {
+		logrus.Errorf("Error reading torrent file: %v", err)
+		return nil, fmt.Errorf("Error reading torrent: %v", err)
+	}
+	torrent.SysInfo.FileId = fileId
+	return &torrent, nil
+}
+
+func (dbFiles) Prepare(fileId string, torrent *torrentfile.TorrentFile) string {
+	fileName, fLen := torrent.PrepareFile()
+	db.GetFilesManagerDb().SetFileLengthForRecord(fileId, fLen)
+	return fileName
+}
+
+func (dbFiles) Download(ctx context.Context, fileId string, torrent *torrentfile.TorrentFile) error {
+	db.GetFilesManagerDb().SetInProgressStatusForRecord(fileId, true)
+	defer db.GetFilesManagerDb().SetInProgressStatusForRecord(fileId, false)
+
+	if err := torrent.DownloadToFile(ctx); err != nil {
+		return err
+	}
+	if ctx.Err() == nil {
+		db.GetFilesManagerDb().SetLoadedStatusForRecord(fileId, true)
+	}
+	return nil
+}
+
+func (dbFiles) Remove(fileId string, torrent *torrentfile.TorrentFile) error {
+	if err := torrent.RemoveFiles(); err != nil {
+		return err
+	}
+	db.GetFilesManagerDb().RemoveFilePartsPlace(fileId)
+	db.GetFilesManagerDb().SetLoadedStatusForRecord(fileId, false)
+	return nil
+}
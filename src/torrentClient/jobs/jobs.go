@@ -0,0 +1,426 @@
+package jobs
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"torrentClient/bandwidth"
+	"torrentClient/db"
+	"torrentClient/p2p"
+	"torrentClient/parser/env"
+	"torrentClient/torrentfile"
+
+	"github.com/sirupsen/logrus"
+)
+
+var syncOnce sync.Once
+var manager *Manager
+
+func GetManager() *Manager {
+	syncOnce.Do(func() {
+		manager = &Manager{
+			jobs:      make(map[string]*Job),
+			maxActive: env.GetParser().GetMaxActiveDownloads(),
+			store:     db.GetJobsDb(),
+			files:     dbFiles{},
+		}
+	})
+	return manager
+}
+
+// Load picks up jobs saved before a restart of the torrent client. Jobs which
+// were running are queued again in the order they were created. Nothing is
+// loaded before Load, so in progress flags of every file are cleared first,
+// also of files whose jobs are gone. Pieces loaded before are taken from the
+// database and rechecked on disk by the download
+func (m *Manager) Load() {
+	m.store.ClearInProgressStatuses()
+	for _, record := range m.store.GetJobs() {
+		job := &Job{
+			fileId:    record.FileId,
+			fileName:  record.FileName,
+			state:     record.State,
+			err:       record.Error,
+			priority:  record.Priority,
+			createdAt: record.CreatedAt,
+			updatedAt: record.UpdatedAt,
+			queuedAt:  record.CreatedAt,
+		}
+		m.mu.Lock()
+		m.jobs[job.fileId] = job
+		active := job.isActive()
+		if active {
+			m.setStateLocked(job, StateQueued, "")
+		}
+		m.mu.Unlock()
+
+		if active {
+			go func(job *Job) {
+				if err := m.launch(job); err != nil {
+					logrus.Errorf("Error resuming download of %v: %v", job.fileId, err)
+					return
+				}
+				logrus.Infof("Resumed download of %v", job.fileId)
+			}(job)
+		}
+	}
+}
+
+// Start creates a job for the file and queues it with priority. If the file
+// has an active or completed job, the caller is attached to it instead: it
+// waits for the job to be resolved and gets its state, the job's priority is
+// raised to priority if it's lower. The job is saved, so a restart of the
+// torrent client picks it up with Load
+func (m *Manager) Start(fileId string, priority int) (Info, error) {
+	m.mu.Lock()
+	if job, ok := m.jobs[fileId]; ok && (job.isActive() || job.state == StateCompleted) {
+		if job.isActive() && priority > job.priority {
+			job.priority = priority
+			m.store.SetJobPriority(fileId, priority)
+			m.scheduleLocked()
+		}
+		m.mu.Unlock()
+		return m.attach(job)
+	}
+	now := time.Now()
+	job := &Job{
+		fileId:    fileId,
+		state:     StateQueued,
+		priority:  priority,
+		createdAt: now,
+		updatedAt: now,
+		queuedAt:  now,
+		// Callers coming meanwhile wait for the resolve
+		resolving: make(chan struct{}),
+	}
+	m.jobs[fileId] = job
+	m.mu.Unlock()
+
+	if !m.files.Has(fileId) {
+		m.mu.Lock()
+		if m.jobs[fileId] == job {
+			delete(m.jobs, fileId)
+		}
+		m.finishResolveLocked(job, ErrNotFound)
+		m.mu.Unlock()
+		return Info{}, ErrNotFound
+	}
+	m.store.SaveJob(fileId, StateQueued, priority)
+
+	if err := m.launch(job); err != nil {
+		return Info{}, err
+	}
+	return m.attach(job)
+}
+
+// attach waits for the job to be resolved and returns its state
+func (m *Manager) attach(job *Job) (Info, error) {
+	m.mu.Lock()
+	resolving := job.resolving
+	m.mu.Unlock()
+	if resolving != nil {
+		<-resolving
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if job.resolveErr != nil {
+		return Info{}, job.resolveErr
+	}
+	return m.infoLocked(job), nil
+}
+
+// List returns all jobs, oldest first
+func (m *Manager) List() []Info {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	res := make([]Info, 0, len(m.jobs))
+	for _, job := range m.jobs {
+		res = append(res, m.infoLocked(job))
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].CreatedAt.Before(res[j].CreatedAt)
+	})
+	return res
+}
+
+// Get returns the job of the file
+func (m *Manager) Get(fileId string) (Info, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	job, ok := m.jobs[fileId]
+	if !ok {
+		return Info{}, ErrJobNotFound
+	}
+	return m.infoLocked(job), nil
+}
+
+// Pause stops the job keeping its data. It returns once the download is over
+func (m *Manager) Pause(fileId string) error {
+	m.mu.Lock()
+	job, ok := m.jobs[fileId]
+	if !ok {
+		m.mu.Unlock()
+		return ErrJobNotFound
+	}
+	if !job.isActive() {
+		m.mu.Unlock()
+		return ErrInvalidState
+	}
+	done := m.stopLocked(job)
+	m.setStateLocked(job, StatePaused, "")
+	m.scheduleLocked()
+	m.mu.Unlock()
+
+	if done != nil {
+		<-done
+	}
+	logrus.Infof("Paused download of %v", fileId)
+	return nil
+}
+
+// Resume queues a paused or failed job again, it goes after the jobs queued before
+func (m *Manager) Resume(fileId string) error {
+	m.mu.Lock()
+	job, ok := m.jobs[fileId]
+	if !ok {
+		m.mu.Unlock()
+		return ErrJobNotFound
+	}
+	if job.state != StatePaused && job.state != StateFailed {
+		m.mu.Unlock()
+		return ErrInvalidState
+	}
+	job.queuedAt = time.Now()
+	m.setStateLocked(job, StateQueued, "")
+	m.mu.Unlock()
+
+	return m.launch(job)
+}
+
+// Cancel stops the job and forgets it, the loaded data is kept
+func (m *Manager) Cancel(fileId string) error {
+	_, err := m.remove(fileId)
+	return err
+}
+
+// Delete stops the job, forgets it and removes the loaded data
+func (m *Manager) Delete(fileId string) error {
+	job, err := m.remove(fileId)
+	if err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	torrent := job.torrent
+	m.mu.Unlock()
+	if torrent == nil {
+		if torrent, err = m.files.Read(fileId); err != nil {
+			return err
+		}
+	}
+	if err := m.files.Remove(fileId, torrent); err != nil {
+		return err
+	}
+	logrus.Infof("Deleted data of %v", fileId)
+	return nil
+}
+
+// Limits returns the bandwidth limits of the job
+func (m *Manager) Limits(fileId string) (bandwidth.Limits, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	job, ok := m.jobs[fileId]
+	if !ok {
+		return bandwidth.Limits{}, ErrJobNotFound
+	}
+	if job.torrent != nil {
+		return bandwidth.GetLimiter().Torrent(job.torrent.InfoHash), nil
+	}
+	if job.limits != nil {
+		return *job.limits, nil
+	}
+	return bandwidth.GetLimiter().TorrentDefault(), nil
+}
+
+// SetLimits changes the bandwidth limits of the job, open connections
+// included. Limits of a job being resolved are applied once it's resolved
+func (m *Manager) SetLimits(fileId string, limits bandwidth.Limits) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	job, ok := m.jobs[fileId]
+	if !ok {
+		return ErrJobNotFound
+	}
+	job.limits = &limits
+	if job.torrent != nil {
+		bandwidth.GetLimiter().SetTorrent(job.torrent.SwarmInfoHashes(), limits)
+	}
+	logrus.Infof("Set bandwidth limits of %v to %+v", fileId, limits)
+	return nil
+}
+
+// remove stops the job and forgets it. It returns once the download is over
+func (m *Manager) remove(fileId string) (*Job, error) {
+	m.mu.Lock()
+	job, ok := m.jobs[fileId]
+	if !ok {
+		m.mu.Unlock()
+		return nil, ErrJobNotFound
+	}
+	done := m.stopLocked(job)
+	delete(m.jobs, fileId)
+	m.store.RemoveJob(fileId)
+	if job.torrent != nil {
+		bandwidth.GetLimiter().RemoveTorrent(job.torrent.SwarmInfoHashes())
+	}
+	m.scheduleLocked()
+	m.mu.Unlock()
+
+	if done != nil {
+		<-done
+	}
+	logrus.Infof("Cancelled download of %v", fileId)
+	return job, nil
+}
+
+// launch resolves a queued job if it isn't yet and hands it to the scheduler
+func (m *Manager) launch(job *Job) error {
+	m.mu.Lock()
+	resolved := job.torrent != nil
+	m.mu.Unlock()
+	if !resolved {
+		if err := m.resolve(job); err != nil {
+			m.mu.Lock()
+			if m.jobs[job.fileId] == job {
+				m.setStateLocked(job, StateFailed, err.Error())
+			}
+			m.mu.Unlock()
+			return err
+		}
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	// The job may have been paused or cancelled meanwhile
+	if m.jobs[job.fileId] != job || (job.state != StateQueued && job.state != StateResolving) {
+		return nil
+	}
+	m.enqueueLocked(job)
+	return nil
+}
+
+// resolve reads the job's torrent or resolves its magnet link and prepares the file
+func (m *Manager) resolve(job *Job) error {
+	m.mu.Lock()
+	if job.resolving == nil {
+		job.resolving = make(chan struct{})
+	}
+	if job.state == StateQueued {
+		m.setStateLocked(job, StateResolving, "")
+	}
+	m.mu.Unlock()
+
+	torrent, err := m.files.Read(job.fileId)
+	if err == nil && !torrent.HasTrackers() && !torrent.CanUseDht() {
+		err = ErrNoAnnounce
+	}
+	if err != nil {
+		m.mu.Lock()
+		m.finishResolveLocked(job, err)
+		m.mu.Unlock()
+		return err
+	}
+
+	fileName := m.files.Prepare(job.fileId, torrent)
+	m.store.SetJobFileName(job.fileId, fileName)
+
+	m.mu.Lock()
+	job.torrent = torrent
+	job.fileName = fileName
+	if job.limits != nil {
+		bandwidth.GetLimiter().SetTorrent(torrent.SwarmInfoHashes(), *job.limits)
+	} else {
+		bandwidth.GetLimiter().AddTorrent(torrent.SwarmInfoHashes())
+	}
+	m.finishResolveLocked(job, nil)
+	m.mu.Unlock()
+	return nil
+}
+
+// finishResolveLocked lets callers attached to the job go
+func (m *Manager) finishResolveLocked(job *Job, err error) {
+	job.resolveErr = err
+	if job.resolving != nil {
+		close(job.resolving)
+		job.resolving = nil
+	}
+}
+
+// download loads the job's torrent once prev, the job's previous download, is over
+func (m *Manager) download(ctx context.Context, job *Job, torrent *torrentfile.TorrentFile, prev, done chan struct{}) {
+	defer close(done)
+	if prev != nil {
+		<-prev
+	}
+	err := m.files.Download(ctx, job.fileId, torrent)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if ctx.Err() != nil {
+		// Stopped by Pause, Cancel or the scheduler, they have set the state
+		return
+	}
+	job.cancel()
+	job.cancel = nil
+	defer m.scheduleLocked()
+	if err != nil {
+		logrus.Errorf("Error downloading to file: %v", err)
+		m.setStateLocked(job, StateFailed, err.Error())
+		return
+	}
+	m.setStateLocked(job, StateCompleted, "")
+}
+
+// stopLocked cancels the job's download and returns the channel closed when
+// it's over, nil if the job never downloaded
+func (m *Manager) stopLocked(job *Job) chan struct{} {
+	if job.cancel != nil {
+		job.cancel()
+		job.cancel = nil
+	}
+	return job.done
+}
+
+func (m *Manager) setStateLocked(job *Job, state, errText string) {
+	job.state = state
+	job.err = errText
+	job.updatedAt = time.Now()
+	m.store.SetJobState(job.fileId, state, errText)
+}
+
+func (m *Manager) infoLocked(job *Job) Info {
+	info := Info{
+		FileId:        job.fileId,
+		FileName:      job.fileName,
+		State:         job.state,
+		Error:         job.err,
+		Priority:      job.priority,
+		QueuePosition: m.queuePositionLocked(job),
+		CreatedAt:     job.createdAt,
+		UpdatedAt:     job.updatedAt,
+	}
+	if t, ok := p2p.GetActiveDownload(job.fileId); ok && job.state == StateDownloading && t.Stats != nil {
+		info.Downloaded = t.Stats.Downloaded()
+		info.Uploaded = t.Stats.Uploaded()
+		info.Left = t.Stats.Left()
+		info.Peers = t.ConnectedPeers()
+	}
+	return info
+}
+
+func (j *Job) isActive() bool {
+	return j.state == StateQueued || j.state == StateResolving || j.state == StateDownloading
+}
@@ -0,0 +1,164 @@
+package jobs
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"torrentClient/db"
+	"torrentClient/torrentfile"
+)
+
+const parallelCallers = 20
+
+// fakeStore keeps nothing
+type fakeStore struct {
+	saved int32
+}
+
+func (s *fakeStore) GetJobs() []db.DownloadJob          { return nil }
+func (s *fakeStore) ClearInProgressStatuses()           {}
+func (s *fakeStore) SaveJob(string, string, int)        { atomic.AddInt32(&s.saved, 1) }
+func (s *fakeStore) SetJobState(string, string, string) {}
+func (s *fakeStore) SetJobPriority(string, int)         {}
+func (s *fakeStore) SetJobFileName(string, string)      {}
+func (s *fakeStore) RemoveJob(string)                   {}
+
+// fakeFiles counts reads and downloads. Read waits for every caller to
+// start, so they all come while the first job is being resolved
+type fakeFiles struct {
+	callers sync.WaitGroup
+	readErr error
+
+	reads       int32
+	downloads   int32
+	downloading chan struct{}
+}
+
+func newFakeFiles(readErr error) *fakeFiles {
+	f := &fakeFiles{readErr: readErr, downloading: make(chan struct{}, parallelCallers)}
+	f.callers.Add(parallelCallers)
+	return f
+}
+
+func (f *fakeFiles) Has(string) bool {
+	return true
+}
+
+func (f *fakeFiles) Read(fileId string) (*torrentfile.TorrentFile, error) {
+	atomic.AddInt32(&f.reads, 1)
+	f.callers.Wait()
+	if f.readErr != nil {
+		return nil, f.readErr
+	}
+	torrent := &torrentfile.TorrentFile{
+		AnnounceTiers: [][]string{{"http://tracker.example.org/announce"}},
+		InfoHash:      [20]byte{1},
+	}
+	torrent.SysInfo.FileId = fileId
+	return torrent, nil
+}
+
+func (f *fakeFiles) Prepare(fileId string, _ *torrentfile.TorrentFile) string {
+	return fileId + ".mkv"
+}
+
+func (f *fakeFiles) Download(ctx context.Context, _ string, _ *torrentfile.TorrentFile) error {
+	atomic.AddInt32(&f.downloads, 1)
+	f.downloading <- struct{}{}
+	<-ctx.Done()
+	return nil
+}
+
+func (f *fakeFiles) Remove(string, *torrentfile.TorrentFile) error {
+	return nil
+}
+
+func newTestManager(files *fakeFiles) (*Manager, *fakeStore) {
+	store := &fakeStore{}
+	return &Manager{jobs: make(map[string]*Job), maxActive: 1, store: store, files: files}, store
+}
+
+type startResult struct {
+	info Info
+	err  error
+}
+
+// startParallel calls Start for fileId from parallelCallers goroutines at once
+func startParallel(m *Manager, files *fakeFiles, fileId string) []startResult {
+	results := make(chan startResult, parallelCallers)
+	start := make(chan struct{})
+	for i := 0; i < parallelCallers; i++ {
+		go func() {
+			<-start
+			files.callers.Done()
+			info, err := m.Start(fileId, PriorityWatching)
+			results <- startResult{info, err}
+		}()
+	}
+	close(start)
+
+	res := make([]startResult, 0, parallelCallers)
+	for i := 0; i < parallelCallers; i++ {
+		res = append(res, <-results)
+	}
+	return res
+}
+
+func TestParallelStartResolvesOnce(t *testing.T) {
+	files := newFakeFiles(nil)
+	m, store := newTestManager(files)
+
+	results := startParallel(m, files, "movie")
+	for _, res := range results {
+		if res.err != nil {
+			t.Fatal(res.err)
+		}
+		if res.info.FileId != "movie" || res.info.FileName != "movie.mkv" {
+			t.Errorf("caller got %+v", res.info)
+		}
+		if !res.info.CreatedAt.Equal(results[0].info.CreatedAt) {
+			t.Error("callers got different jobs")
+		}
+	}
+	<-files.downloading
+	defer m.Cancel("movie")
+
+	if reads := atomic.LoadInt32(&files.reads); reads != 1 {
+		t.Errorf("torrent was read %v times, want once", reads)
+	}
+	if saved := atomic.LoadInt32(&store.saved); saved != 1 {
+		t.Errorf("job was saved %v times, want once", saved)
+	}
+	if list := m.List(); len(list) != 1 || list[0].State != StateDownloading {
+		t.Errorf("got jobs %+v, want one downloading", list)
+	}
+
+	// The download is started once, later callers attach to it
+	if info, err := m.Start("movie", PriorityWatching); err != nil || info.State != StateDownloading {
+		t.Errorf("caller got %+v, %v", info, err)
+	}
+	if downloads := atomic.LoadInt32(&files.downloads); downloads != 1 {
+		t.Errorf("got %v downloads, want 1", downloads)
+	}
+}
+
+func TestParallelStartGetsResolveError(t *testing.T) {
+	resolveErr := errors.New("bad torrent")
+	files := newFakeFiles(resolveErr)
+	m, _ := newTestManager(files)
+
+	for _, res := range startParallel(m, files, "broken") {
+		if res.err != resolveErr {
+			t.Errorf("caller got error %v, want %v", res.err, resolveErr)
+		}
+	}
+	if downloads := atomic.LoadInt32(&files.downloads); downloads != 0 {
+		t.Errorf("got %v downloads of a broken torrent", downloads)
+	}
+	if list := m.List(); len(list) != 1 || list[0].State != StateFailed {
+		t.Errorf("got jobs %+v, want one failed", list)
+	}
+}
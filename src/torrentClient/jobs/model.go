@@ -0,0 +1,121 @@
+package jobs
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"torrentClient/bandwidth"
+	"torrentClient/db"
+	"torrentClient/torrentfile"
+)
+
+const (
+	// StateQueued is a job waiting to start
+	StateQueued = "queued"
+	// StateResolving is a job reading its torrent or resolving its magnet link
+	StateResolving   = "resolving_metadata"
+	StateDownloading = "downloading"
+	// StatePaused is a job stopped by request, it keeps its data and may be resumed
+	StatePaused    = "paused"
+	StateCompleted = "completed"
+	StateFailed    = "failed"
+)
+
+const (
+	// PriorityPrefetch is given to files nobody watches yet
+	PriorityPrefetch = 0
+	// PriorityWatching is given to files somebody watches, they go before prefetches
+	PriorityWatching = 1
+)
+
+var (
+	// ErrNotFound is returned for files without a record or a torrent to download
+	ErrNotFound = errors.New("file not found or not downloadable")
+	// ErrNoAnnounce is returned for torrents without trackers which can't use DHT
+	ErrNoAnnounce = errors.New("announce is empty")
+	// ErrJobNotFound is returned for files without a job
+	ErrJobNotFound = errors.New("no job for file")
+	// ErrInvalidState is returned for actions the job's state doesn't allow
+	ErrInvalidState = errors.New("action is not allowed in the job's state")
+)
+
+// Job is a download of a file. Manager's mu guards its fields
+type Job struct {
+	fileId    string
+	fileName  string
+	state     string
+	err       string
+	priority  int
+	createdAt time.Time
+	updatedAt time.Time
+	// queuedAt orders jobs of the same priority in the queue
+	queuedAt time.Time
+	// startedAt is when the job started downloading last time
+	startedAt time.Time
+	// limits are set through the API, nil leaves the torrent the default ones
+	limits *bandwidth.Limits
+
+	// torrent is set once the job is resolved
+	torrent *torrentfile.TorrentFile
+	// resolving is closed when the running resolve is over, resolveErr tells how it went
+	resolving  chan struct{}
+	resolveErr error
+	// cancel stops the running download, done is closed when it returns.
+	// done is kept after the download is over, the next one waits for it
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// Info is a snapshot of a job as the API shows it. QueuePosition is the
+// 1-based place of a queued job in the queue, 0 for other jobs
+type Info struct {
+	FileId        string    `json:"fileId"`
+	FileName      string    `json:"fileName"`
+	State         string    `json:"state"`
+	Error         string    `json:"error,omitempty"`
+	Priority      int       `json:"priority"`
+	QueuePosition int       `json:"queuePosition"`
+	Downloaded    int64     `json:"downloaded"`
+	Uploaded      int64     `json:"uploaded"`
+	Left          int64     `json:"left"`
+	Peers         int       `json:"peers"`
+	CreatedAt     time.Time `json:"createdAt"`
+	UpdatedAt     time.Time `json:"updatedAt"`
+}
+
+// Manager keeps download jobs by file id and schedules them: at most
+// maxActive jobs download at once, the rest wait in the queue
+type Manager struct {
+	mu        sync.Mutex
+	jobs      map[string]*Job
+	maxActive int
+	store     jobsStore
+	files     torrentFiles
+}
+
+// jobsStore keeps jobs between restarts of the torrent client
+type jobsStore interface {
+	GetJobs() []db.DownloadJob
+	ClearInProgressStatuses()
+	SaveJob(fileId, state string, priority int)
+	SetJobState(fileId, state, errText string)
+	SetJobPriority(fileId string, priority int)
+	SetJobFileName(fileId, fileName string)
+	RemoveJob(fileId string)
+}
+
+// torrentFiles reads torrents of files and loads them to disk
+type torrentFiles interface {
+	// Has reports whether the file has a torrent or a magnet link to download
+	Has(fileId string) bool
+	// Read reads the file's torrent or resolves its magnet link
+	Read(fileId string) (*torrentfile.TorrentFile, error)
+	// Prepare creates the file the torrent is loaded to and returns its name
+	Prepare(fileId string, torrent *torrentfile.TorrentFile) string
+	// Download loads the torrent until it's complete or ctx is done
+	Download(ctx context.Context, fileId string, torrent *torrentfile.TorrentFile) error
+	// Remove deletes the data loaded for the file
+	Remove(fileId string, torrent *torrentfile.TorrentFile) error
+}
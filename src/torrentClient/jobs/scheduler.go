@@ -0,0 +1,121 @@
+package jobs
+
+import (
+	"context"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// ParsePriority reads a priority as the API takes it, files are watched unless told otherwise
+func ParsePriority(s string) int {
+	if s == "prefetch" {
+		return PriorityPrefetch
+	}
+	return PriorityWatching
+}
+
+// enqueueLocked puts a resolved job in the queue and starts what may be started
+func (m *Manager) enqueueLocked(job *Job) {
+	m.setStateLocked(job, StateQueued, "")
+	m.scheduleLocked()
+}
+
+// scheduleLocked starts queued jobs while there are free slots. Once there are
+// none, a queued job takes the slot of a downloading job of lower priority,
+// which goes back to the queue keeping its place
+func (m *Manager) scheduleLocked() {
+	for {
+		next := m.nextQueuedLocked()
+		if next == nil {
+			return
+		}
+		if m.maxActive > 0 && m.downloadingLocked() >= m.maxActive {
+			victim := m.preemptibleLocked(next.priority)
+			if victim == nil {
+				return
+			}
+			logrus.Infof("Download of %v is queued for %v", victim.fileId, next.fileId)
+			m.stopLocked(victim)
+			m.setStateLocked(victim, StateQueued, "")
+		}
+		m.startLocked(next)
+	}
+}
+
+// startLocked starts the job's download. The previous download of the job,
+// if any, is let to finish first
+func (m *Manager) startLocked(job *Job) {
+	prev := job.done
+	ctx, cancel := context.WithCancel(context.Background())
+	job.cancel = cancel
+	job.done = make(chan struct{})
+	job.startedAt = time.Now()
+	m.setStateLocked(job, StateDownloading, "")
+	go m.download(ctx, job, job.torrent, prev, job.done)
+}
+
+// nextQueuedLocked returns the resolved queued job which goes first
+func (m *Manager) nextQueuedLocked() *Job {
+	var next *Job
+	for _, job := range m.jobs {
+		if job.state != StateQueued || job.torrent == nil || job.resolving != nil {
+			continue
+		}
+		if next == nil || job.before(next) {
+			next = job
+		}
+	}
+	return next
+}
+
+// preemptibleLocked returns the downloading job of priority lower than
+// priority which started last, nil if there is none
+func (m *Manager) preemptibleLocked(priority int) *Job {
+	var victim *Job
+	for _, job := range m.jobs {
+		if job.state != StateDownloading || job.priority >= priority {
+			continue
+		}
+		if victim == nil || job.priority < victim.priority ||
+			(job.priority == victim.priority && job.startedAt.After(victim.startedAt)) {
+			victim = job
+		}
+	}
+	return victim
+}
+
+func (m *Manager) downloadingLocked() int {
+	n := 0
+	for _, job := range m.jobs {
+		if job.state == StateDownloading {
+			n++
+		}
+	}
+	return n
+}
+
+// queuePositionLocked returns the 1-based place of a queued job in the queue, 0 for other jobs
+func (m *Manager) queuePositionLocked(job *Job) int {
+	if job.state != StateQueued {
+		return 0
+	}
+	pos := 1
+	for _, other := range m.jobs {
+		if other != job && other.state == StateQueued && other.before(job) {
+			pos++
+		}
+	}
+	return pos
+}
+
+// before tells if the job goes before other in the queue
+func (j *Job) before(other *Job) bool {
+	if j.priority != other.priority {
+		return j.priority > other.priority
+	}
+	if !j.queuedAt.Equal(other.queuedAt) {
+		return j.queuedAt.Before(other.queuedAt)
+	}
+	return j.fileId < other.fileId
+}
@@ -0,0 +1,151 @@
+package magnet
+
+import (
+	"encoding/base32"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"torrentClient/peers"
+)
+
+const (
+	btihPrefix = "urn:btih:"
+	btmhPrefix = "urn:btmh:"
+	// sha256MultihashPrefix is the multihash header of a 32-byte SHA-256 digest
+	sha256MultihashPrefix = "1220"
+)
+
+// Parse parses a magnet URI
+func Parse(link string) (*Magnet, error) {
+	u, err := url.Parse(link)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing magnet: %v", err)
+	}
+	if u.Scheme != "magnet" {
+		return nil, fmt.Errorf("unsupported scheme: %v", u.Scheme)
+	}
+	query, err := url.ParseQuery(u.RawQuery)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing magnet query: %v", err)
+	}
+
+	m := Magnet{
+		Name:     query.Get("dn"),
+		Trackers: make([]string, 0),
+		Peers:    make([]peers.Peer, 0),
+	}
+
+	for _, xt := range query["xt"] {
+		if err := m.parseExactTopic(xt); err != nil {
+			return nil, err
+		}
+	}
+	if !m.HasInfoHash && !m.HasInfoHashV2 {
+		return nil, fmt.Errorf("magnet has no supported xt")
+	}
+
+	for _, tr := range query["tr"] {
+		if tr != "" && !stringArrayContain(m.Trackers, tr) {
+			m.Trackers = append(m.Trackers, tr)
+		}
+	}
+
+	for _, pe := range query["x.pe"] {
+		peer, err := parsePeerAddr(pe)
+		if err != nil {
+			return nil, err
+		}
+		m.Peers = append(m.Peers, peer)
+	}
+
+	if xl := query.Get("xl"); xl != "" {
+		length, err := strconv.Atoi(xl)
+		if err != nil || length < 0 {
+			return nil, fmt.Errorf("invalid xl: %v", xl)
+		}
+		m.Length = length
+	}
+
+	return &m, nil
+}
+
+func (m *Magnet) parseExactTopic(xt string) error {
+	switch {
+	case strings.HasPrefix(xt, btihPrefix):
+		hash, err := decodeBtih(strings.TrimPrefix(xt, btihPrefix))
+		if err != nil {
+			return err
+		}
+		m.InfoHash = hash
+		m.HasInfoHash = true
+	case strings.HasPrefix(xt, btmhPrefix):
+		multihash := strings.TrimPrefix(xt, btmhPrefix)
+		if !strings.HasPrefix(multihash, sha256MultihashPrefix) {
+			return fmt.Errorf("unsupported multihash: %v", multihash)
+		}
+		hash, err := hex.DecodeString(strings.TrimPrefix(multihash, sha256MultihashPrefix))
+		if err != nil || len(hash) != 32 {
+			return fmt.Errorf("invalid btmh: %v", multihash)
+		}
+		copy(m.InfoHashV2[:], hash)
+		m.HasInfoHashV2 = true
+	}
+	return nil
+}
+
+// decodeBtih decodes both hex (40 chars) and base32 (32 chars) infohashes
+func decodeBtih(src string) ([20]byte, error) {
+	var res [20]byte
+	var decoded []byte
+	var err error
+
+	switch len(src) {
+	case 40:
+		decoded, err = hex.DecodeString(src)
+	case 32:
+		decoded, err = base32.StdEncoding.DecodeString(strings.ToUpper(src))
+	default:
+		return res, fmt.Errorf("invalid btih length: %v", len(src))
+	}
+	if err != nil {
+		return res, fmt.Errorf("invalid btih '%v': %v", src, err)
+	}
+	copy(res[:], decoded)
+	return res, nil
+}
+
+func parsePeerAddr(addr string) (peers.Peer, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return peers.Peer{}, fmt.Errorf("invalid x.pe '%v': %v", addr, err)
+	}
+	portNum, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return peers.Peer{}, fmt.Errorf("invalid x.pe port '%v': %v", addr, err)
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		ips, err := net.LookupIP(host)
+		if err != nil || len(ips) == 0 {
+			return peers.Peer{}, fmt.Errorf("can't resolve x.pe host '%v': %v", host, err)
+		}
+		ip = ips[0]
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	return peers.Peer{IP: ip, Port: uint16(portNum)}, nil
+}
+
+func stringArrayContain(arr []string, val string) bool {
+	for _, item := range arr {
+		if item == val {
+			return true
+		}
+	}
+	return false
+}
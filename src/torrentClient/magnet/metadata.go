@@ -0,0 +1,176 @@
+package magnet
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"crypto/sha256"
+	"fmt"
+	"time"
+
+	"torrentClient/bencodeRaw"
+	"torrentClient/client"
+	"torrentClient/message"
+
+	"github.com/jackpal/bencode-go"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// metadataPieceSize is the size of every metadata piece except the last one
+	metadataPieceSize = 16384
+	// maxMetadataSize guards against peers announcing absurd sizes
+	maxMetadataSize = 64 * 1024 * 1024
+
+	// UtMetadataName is the extension name of the metadata exchange (BEP 9)
+	UtMetadataName = "ut_metadata"
+
+	metadataRequest = 0
+	metadataData    = 1
+	metadataReject  = 2
+)
+
+type metadataMsg struct {
+	MsgType   int `bencode:"msg_type"`
+	Piece     int `bencode:"piece"`
+	TotalSize int `bencode:"total_size,omitempty"`
+}
+
+// metadataFetcher is a ut_metadata extension handler which downloads
+// the info dict piece by piece
+type metadataFetcher struct {
+	magnet   *Magnet
+	metadata []byte
+	received []bool
+	done     bool
+}
+
+func (f *metadataFetcher) Name() string {
+	return UtMetadataName
+}
+
+func (f *metadataFetcher) FillHandshake(hs *message.ExtendedHandshake) {
+}
+
+func (f *metadataFetcher) OnHandshake(c *client.Client, hs *message.ExtendedHandshake) error {
+	if !c.PeerSupportsExtension(UtMetadataName) {
+		return fmt.Errorf("peer %v doesn't support %v", c.GetShortInfo(), UtMetadataName)
+	}
+	if hs.MetadataSize <= 0 || hs.MetadataSize > maxMetadataSize {
+		return fmt.Errorf("peer %v announced invalid metadata size %v", c.GetShortInfo(), hs.MetadataSize)
+	}
+	if f.metadata != nil {
+		return nil
+	}
+
+	f.metadata = make([]byte, hs.MetadataSize)
+	f.received = make([]bool, (hs.MetadataSize+metadataPieceSize-1)/metadataPieceSize)
+	for piece := range f.received {
+		var buf bytes.Buffer
+		if err := bencode.Marshal(&buf, metadataMsg{MsgType: metadataRequest, Piece: piece}); err != nil {
+			return err
+		}
+		if err := c.SendExtended(UtMetadataName, buf.Bytes()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (f *metadataFetcher) HandleMessage(c *client.Client, payload []byte) error {
+	if f.metadata == nil {
+		return fmt.Errorf("got metadata before ext handshake")
+	}
+	done, err := f.savePiece(payload)
+	if err != nil {
+		return err
+	}
+	if done {
+		if !f.magnet.checkMetadata(f.metadata) {
+			return fmt.Errorf("metadata from %v doesn't match infohash", c.GetShortInfo())
+		}
+		f.done = true
+	}
+	return nil
+}
+
+// savePiece copies a metadata piece into metadata, reports whether all pieces are received
+func (f *metadataFetcher) savePiece(payload []byte) (bool, error) {
+	dictEnd, err := bencodeRaw.SkipValue(payload, 0)
+	if err != nil {
+		return false, fmt.Errorf("malformed metadata msg: %v", err)
+	}
+	msg := metadataMsg{}
+	if err := bencode.Unmarshal(bytes.NewReader(payload[:dictEnd]), &msg); err != nil {
+		return false, fmt.Errorf("error unmarshal metadata msg: %v", err)
+	}
+
+	switch msg.MsgType {
+	case metadataReject:
+		return false, fmt.Errorf("peer rejected metadata piece %v", msg.Piece)
+	case metadataData:
+	default:
+		return false, nil
+	}
+
+	if msg.Piece < 0 || msg.Piece >= len(f.received) {
+		return false, fmt.Errorf("metadata piece %v out of range", msg.Piece)
+	}
+	begin := msg.Piece * metadataPieceSize
+	end := begin + metadataPieceSize
+	if end > len(f.metadata) {
+		end = len(f.metadata)
+	}
+	data := payload[dictEnd:]
+	if len(data) != end-begin {
+		return false, fmt.Errorf("metadata piece %v has length %v, expected %v", msg.Piece, len(data), end-begin)
+	}
+	copy(f.metadata[begin:end], data)
+	f.received[msg.Piece] = true
+
+	for _, ok := range f.received {
+		if !ok {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// FetchMetadata downloads the info dict of the torrent from a connected peer
+// using ut_metadata and checks it against the infohash of the magnet
+func (m *Magnet) FetchMetadata(c *client.Client) ([]byte, error) {
+	if !c.SupportsExtensions() {
+		return nil, fmt.Errorf("peer %v doesn't support extensions", c.GetShortInfo())
+	}
+
+	defer c.Conn.SetDeadline(time.Time{}) // Disable the deadline
+	c.Conn.SetDeadline(time.Now().Add(30 * time.Second))
+
+	fetcher := &metadataFetcher{magnet: m}
+	c.RegisterExtension(fetcher)
+	if err := c.SendExtendedHandshake(); err != nil {
+		return nil, err
+	}
+
+	for !fetcher.done {
+		msg, err := c.Read()
+		if err != nil {
+			return nil, fmt.Errorf("read msg err: %v", err)
+		}
+		if msg == nil || msg.ID != message.MsgExtended {
+			continue
+		}
+		if err := c.HandleExtended(msg); err != nil {
+			return nil, err
+		}
+	}
+
+	logrus.Infof("Got metadata (%v bytes) from %v", len(fetcher.metadata), c.GetShortInfo())
+	return fetcher.metadata, nil
+}
+
+func (m *Magnet) checkMetadata(metadata []byte) bool {
+	if m.HasInfoHash {
+		return sha1.Sum(metadata) == m.InfoHash
+	}
+	return sha256.Sum256(metadata) == m.InfoHashV2
+}
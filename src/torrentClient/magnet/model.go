@@ -0,0 +1,30 @@
+package magnet
+
+import (
+	"torrentClient/peers"
+)
+
+// Magnet holds everything a magnet URI tells about a torrent
+type Magnet struct {
+	// InfoHash is the v1 infohash (urn:btih)
+	InfoHash    [20]byte
+	HasInfoHash bool
+	// InfoHashV2 is the v2 infohash (urn:btmh), SHA-256 multihash
+	InfoHashV2    [32]byte
+	HasInfoHashV2 bool
+
+	Name     string
+	Trackers []string
+	Peers    []peers.Peer
+	Length   int
+}
+
+// SwarmInfoHash returns the 20-byte infohash used to join the swarm
+func (m *Magnet) SwarmInfoHash() [20]byte {
+	if m.HasInfoHash {
+		return m.InfoHash
+	}
+	var truncated [20]byte
+	copy(truncated[:], m.InfoHashV2[:20])
+	return truncated
+}
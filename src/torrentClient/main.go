@@ -2,8 +2,11 @@ package main
 
 import (
 	"torrentClient/db"
+	"torrentClient/dht"
 	"torrentClient/fsWriter"
+	"torrentClient/jobs"
 	"torrentClient/parser/env"
+	"torrentClient/peerServer"
 	"torrentClient/server"
 )
 
@@ -13,13 +16,25 @@ func main() {
 	db.GetFilesManagerDb().InitConnection(env.GetParser().GetPostgresDbDsn())
 	db.GetFilesManagerDb().InitTables()
 
+	db.GetJobsDb().InitConnection(env.GetParser().GetPostgresDbDsn())
+	db.GetJobsDb().InitTables()
+
 	db.GetLoadedStateDb().InitConnection()
 
 	defer func() {
 		db.GetFilesManagerDb().CloseConnection()
+		db.GetJobsDb().CloseConnection()
 		db.GetLoadedStateDb().CloseConnection()
 	}()
 
+	if dhtServer := dht.GetServer(); dhtServer != nil {
+		go dhtServer.Start()
+		defer dhtServer.Stop()
+	}
+
 	go fsWriter.GetWriter().StartWaitingForData()
+	go peerServer.GetServer().Start()
+	defer peerServer.GetServer().Stop()
+	jobs.GetManager().Load()
 	server.Start()
 }
@@ -0,0 +1,87 @@
+package merkle
+
+import (
+	"crypto/sha256"
+	"fmt"
+)
+
+// NextPowerOfTwo returns the smallest power of two that is >= n
+func NextPowerOfTwo(n int) int {
+	res := 1
+	for res < n {
+		res <<= 1
+	}
+	return res
+}
+
+// Log2 returns log2 of a power of two
+func Log2(n int) int {
+	res := 0
+	for n > 1 {
+		n >>= 1
+		res++
+	}
+	return res
+}
+
+// PadHash returns the root of a subtree of the given height
+// built only from zero leaves
+func PadHash(height int) Hash {
+	var h Hash
+	for i := 0; i < height; i++ {
+		h = hashPair(h, h)
+	}
+	return h
+}
+
+// BlockHashes splits data into 16KiB blocks and hashes each of them.
+// The last block may be shorter
+func BlockHashes(data []byte) []Hash {
+	res := make([]Hash, 0, (len(data)+BlockSize-1)/BlockSize)
+	for start := 0; start < len(data); start += BlockSize {
+		end := start + BlockSize
+		if end > len(data) {
+			end = len(data)
+		}
+		res = append(res, sha256.Sum256(data[start:end]))
+	}
+	return res
+}
+
+// Root computes the root of a tree with leafCount leaves, where leaves
+// missing at the end are replaced with pad. leafCount must be a power of two
+func Root(leaves []Hash, leafCount int, pad Hash) (Hash, error) {
+	if leafCount <= 0 || leafCount&(leafCount-1) != 0 {
+		return Hash{}, fmt.Errorf("leaf count %v is not a power of two", leafCount)
+	}
+	if len(leaves) > leafCount {
+		return Hash{}, fmt.Errorf("too many leaves: %v > %v", len(leaves), leafCount)
+	}
+
+	layer := make([]Hash, leafCount)
+	copy(layer, leaves)
+	for i := len(leaves); i < leafCount; i++ {
+		layer[i] = pad
+	}
+
+	for len(layer) > 1 {
+		next := make([]Hash, len(layer)/2)
+		for i := range next {
+			next[i] = hashPair(layer[2*i], layer[2*i+1])
+		}
+		layer = next
+	}
+	return layer[0], nil
+}
+
+// PieceRoot computes the merkle root of piece data over leafCount 16KiB leaves
+func PieceRoot(data []byte, leafCount int) (Hash, error) {
+	return Root(BlockHashes(data), leafCount, Hash{})
+}
+
+func hashPair(left, right Hash) Hash {
+	buf := make([]byte, 0, 2*HashSize)
+	buf = append(buf, left[:]...)
+	buf = append(buf, right[:]...)
+	return sha256.Sum256(buf)
+}
@@ -0,0 +1,9 @@
+package merkle
+
+// BlockSize is the size of a leaf block in BitTorrent v2 merkle trees
+const BlockSize = 16384
+
+// HashSize is the length of a SHA-256 hash
+const HashSize = 32
+
+type Hash [HashSize]byte
@@ -1,10 +1,14 @@
 package message
 
 import (
+	"bytes"
+	"crypto/sha1"
 	"encoding/binary"
 	"fmt"
 	"io"
+	"net"
 
+	"github.com/jackpal/bencode-go"
 	"github.com/sirupsen/logrus"
 )
 
@@ -17,6 +21,29 @@ func FormatRequest(index, begin, length int) *Message {
 	return &Message{ID: MsgRequest, Payload: payload}
 }
 
+// FormatCancel creates a CANCEL message
+func FormatCancel(index, begin, length int) *Message {
+	msg := FormatRequest(index, begin, length)
+	msg.ID = MsgCancel
+	return msg
+}
+
+// FormatPiece creates a PIECE message carrying a block of a piece
+func FormatPiece(index, begin int, data []byte) *Message {
+	payload := make([]byte, 8+len(data))
+	binary.BigEndian.PutUint32(payload[0:4], uint32(index))
+	binary.BigEndian.PutUint32(payload[4:8], uint32(begin))
+	copy(payload[8:], data)
+	return &Message{ID: MsgPiece, Payload: payload}
+}
+
+// FormatReject creates a REJECT message refusing a request
+func FormatReject(index, begin, length int) *Message {
+	msg := FormatRequest(index, begin, length)
+	msg.ID = MsgReject
+	return msg
+}
+
 // FormatHave creates a HAVE message
 func FormatHave(index int) *Message {
 	payload := make([]byte, 4)
@@ -24,6 +51,46 @@ func FormatHave(index int) *Message {
 	return &Message{ID: MsgHave, Payload: payload}
 }
 
+// FormatExtended creates an EXTENDED message with the given extended message ID
+func FormatExtended(extID uint8, payload []byte) *Message {
+	buf := make([]byte, 1+len(payload))
+	buf[0] = extID
+	copy(buf[1:], payload)
+	return &Message{ID: MsgExtended, Payload: buf}
+}
+
+// ParseExtended parses an EXTENDED message into extended message ID and payload
+func ParseExtended(msg *Message) (uint8, []byte, error) {
+	if msg.ID != MsgExtended {
+		return 0, nil, fmt.Errorf("Expected EXTENDED (ID %d), got ID %d", MsgExtended, msg.ID)
+	}
+	if len(msg.Payload) < 1 {
+		return 0, nil, fmt.Errorf("Payload too short. %d < 1", len(msg.Payload))
+	}
+	return msg.Payload[0], msg.Payload[1:], nil
+}
+
+// FormatExtendedHandshake creates an EXTENDED message carrying the extension protocol handshake
+func FormatExtendedHandshake(hs *ExtendedHandshake) (*Message, error) {
+	var buf bytes.Buffer
+	if err := bencode.Marshal(&buf, *hs); err != nil {
+		return nil, fmt.Errorf("error marshal ext handshake: %v", err)
+	}
+	return FormatExtended(ExtHandshakeID, buf.Bytes()), nil
+}
+
+// ParseExtendedHandshake parses the payload of the extension protocol handshake
+func ParseExtendedHandshake(payload []byte) (*ExtendedHandshake, error) {
+	hs := ExtendedHandshake{}
+	if err := bencode.Unmarshal(bytes.NewReader(payload), &hs); err != nil {
+		return nil, fmt.Errorf("error unmarshal ext handshake: %v", err)
+	}
+	if hs.M == nil {
+		hs.M = make(map[string]int)
+	}
+	return &hs, nil
+}
+
 // ParsePiece parses a PIECE message and copies its payload into a buffer
 func ParsePiece(index int, buf []byte, msg *Message) (int, error) {
 	if msg.ID != MsgPiece {
@@ -48,6 +115,33 @@ func ParsePiece(index int, buf []byte, msg *Message) (int, error) {
 	return len(data), nil
 }
 
+// ParseBlock parses a PIECE message without copying its data
+func ParseBlock(msg *Message) (index, begin int, data []byte, err error) {
+	if msg.ID != MsgPiece {
+		return 0, 0, nil, fmt.Errorf("Expected PIECE (ID %d), got ID %d", MsgPiece, msg.ID)
+	}
+	if len(msg.Payload) < 8 {
+		return 0, 0, nil, fmt.Errorf("Payload too short. %d < 8", len(msg.Payload))
+	}
+	index = int(binary.BigEndian.Uint32(msg.Payload[0:4]))
+	begin = int(binary.BigEndian.Uint32(msg.Payload[4:8]))
+	return index, begin, msg.Payload[8:], nil
+}
+
+// ParseRequest parses a REQUEST, CANCEL or REJECT message
+func ParseRequest(msg *Message) (index, begin, length int, err error) {
+	if msg.ID != MsgRequest && msg.ID != MsgCancel && msg.ID != MsgReject {
+		return 0, 0, 0, fmt.Errorf("Expected REQUEST (ID %d), CANCEL (ID %d) or REJECT (ID %d), got ID %d", MsgRequest, MsgCancel, MsgReject, msg.ID)
+	}
+	if len(msg.Payload) != 12 {
+		return 0, 0, 0, fmt.Errorf("Expected payload length 12, got length %d", len(msg.Payload))
+	}
+	index = int(binary.BigEndian.Uint32(msg.Payload[0:4]))
+	begin = int(binary.BigEndian.Uint32(msg.Payload[4:8]))
+	length = int(binary.BigEndian.Uint32(msg.Payload[8:12]))
+	return index, begin, length, nil
+}
+
 // ParseHave parses a HAVE message
 func ParseHave(msg *Message) (int, error) {
 	if msg.ID != MsgHave {
@@ -60,6 +154,150 @@ func ParseHave(msg *Message) (int, error) {
 	return index, nil
 }
 
+// FormatSuggest creates a SUGGEST PIECE message
+func FormatSuggest(index int) *Message {
+	msg := FormatHave(index)
+	msg.ID = MsgSuggest
+	return msg
+}
+
+// FormatAllowedFast creates an ALLOWED FAST message
+func FormatAllowedFast(index int) *Message {
+	msg := FormatHave(index)
+	msg.ID = MsgAllowedFast
+	return msg
+}
+
+// ParseIndex parses a HAVE, SUGGEST PIECE or ALLOWED FAST message, which carry a piece index only
+func ParseIndex(msg *Message) (int, error) {
+	if msg.ID != MsgHave && msg.ID != MsgSuggest && msg.ID != MsgAllowedFast {
+		return 0, fmt.Errorf("Expected HAVE (ID %d), SUGGEST (ID %d) or ALLOWED FAST (ID %d), got ID %d", MsgHave, MsgSuggest, MsgAllowedFast, msg.ID)
+	}
+	if len(msg.Payload) != 4 {
+		return 0, fmt.Errorf("Expected payload length 4, got length %d", len(msg.Payload))
+	}
+	return int(binary.BigEndian.Uint32(msg.Payload)), nil
+}
+
+// AllowedFastSet generates k pieces a peer at ip may request while choked
+// as BEP 6 describes. IPv4 addresses are masked to /24 so peers behind one
+// network get the same set
+func AllowedFastSet(k, numPieces int, infoHash [20]byte, ip net.IP) []int {
+	ip4 := ip.To4()
+	if ip4 == nil || numPieces <= 0 {
+		return nil
+	}
+	if k > numPieces {
+		k = numPieces
+	}
+
+	x := make([]byte, 0, 24)
+	x = append(x, ip4[0], ip4[1], ip4[2], 0)
+	x = append(x, infoHash[:]...)
+	res := make([]int, 0, k)
+	for len(res) < k {
+		sum := sha1.Sum(x)
+		x = sum[:]
+		for i := 0; i < 5 && len(res) < k; i++ {
+			index := int(binary.BigEndian.Uint32(x[i*4:]) % uint32(numPieces))
+			if !containsIndex(res, index) {
+				res = append(res, index)
+			}
+		}
+	}
+	return res
+}
+
+func containsIndex(list []int, index int) bool {
+	for _, existing := range list {
+		if existing == index {
+			return true
+		}
+	}
+	return false
+}
+
+// hashRequestLength is the size of the HashRequest header in the payload
+const hashRequestLength = 48
+
+func (r *HashRequest) serialize() []byte {
+	payload := make([]byte, hashRequestLength)
+	copy(payload[0:32], r.PiecesRoot[:])
+	binary.BigEndian.PutUint32(payload[32:36], uint32(r.BaseLayer))
+	binary.BigEndian.PutUint32(payload[36:40], uint32(r.Index))
+	binary.BigEndian.PutUint32(payload[40:44], uint32(r.Length))
+	binary.BigEndian.PutUint32(payload[44:48], uint32(r.ProofLayers))
+	return payload
+}
+
+func parseHashRequestHeader(payload []byte) (HashRequest, error) {
+	if len(payload) < hashRequestLength {
+		return HashRequest{}, fmt.Errorf("Payload too short. %d < %d", len(payload), hashRequestLength)
+	}
+	req := HashRequest{
+		BaseLayer:   int(binary.BigEndian.Uint32(payload[32:36])),
+		Index:       int(binary.BigEndian.Uint32(payload[36:40])),
+		Length:      int(binary.BigEndian.Uint32(payload[40:44])),
+		ProofLayers: int(binary.BigEndian.Uint32(payload[44:48])),
+	}
+	copy(req.PiecesRoot[:], payload[0:32])
+	return req, nil
+}
+
+// FormatHashRequest creates a HASH REQUEST message
+func FormatHashRequest(req HashRequest) *Message {
+	return &Message{ID: MsgHashRequest, Payload: req.serialize()}
+}
+
+// FormatHashes creates a HASHES message
+func FormatHashes(req HashRequest, hashes [][32]byte) *Message {
+	payload := req.serialize()
+	for _, hash := range hashes {
+		payload = append(payload, hash[:]...)
+	}
+	return &Message{ID: MsgHashes, Payload: payload}
+}
+
+// FormatHashReject creates a HASH REJECT message
+func FormatHashReject(req HashRequest) *Message {
+	return &Message{ID: MsgHashReject, Payload: req.serialize()}
+}
+
+// ParseHashRequest parses a HASH REQUEST or a HASH REJECT message
+func ParseHashRequest(msg *Message) (HashRequest, error) {
+	if msg.ID != MsgHashRequest && msg.ID != MsgHashReject {
+		return HashRequest{}, fmt.Errorf("Expected HASH REQUEST or HASH REJECT, got ID %d", msg.ID)
+	}
+	if len(msg.Payload) != hashRequestLength {
+		return HashRequest{}, fmt.Errorf("Expected payload length %d, got length %d", hashRequestLength, len(msg.Payload))
+	}
+	return parseHashRequestHeader(msg.Payload)
+}
+
+// ParseHashes parses a HASHES message. Returned hashes contain the requested
+// base layer hashes followed by the proof hashes
+func ParseHashes(msg *Message) (HashRequest, [][32]byte, error) {
+	if msg.ID != MsgHashes {
+		return HashRequest{}, nil, fmt.Errorf("Expected HASHES (ID %d), got ID %d", MsgHashes, msg.ID)
+	}
+	req, err := parseHashRequestHeader(msg.Payload)
+	if err != nil {
+		return HashRequest{}, nil, err
+	}
+	body := msg.Payload[hashRequestLength:]
+	if len(body)%32 != 0 {
+		return HashRequest{}, nil, fmt.Errorf("Malformed hashes of length %d", len(body))
+	}
+	hashes := make([][32]byte, len(body)/32)
+	for i := range hashes {
+		copy(hashes[i][:], body[i*32:(i+1)*32])
+	}
+	if len(hashes) < req.Length {
+		return HashRequest{}, nil, fmt.Errorf("Expected at least %d hashes, got %d", req.Length, len(hashes))
+	}
+	return req, hashes, nil
+}
+
 // Serialize serializes a message into a buffer of the form
 // <length prefix><message ID><payload>
 // Interprets `nil` as a keep-alive message
@@ -88,6 +326,10 @@ func Read(r io.Reader) (*Message, error) {
 	if length == 0 {
 		return nil, nil
 	}
+	// The length comes from the peer, don't let it make us allocate gigabytes
+	if length > MaxLength {
+		return nil, fmt.Errorf("message length %v exceeds %v", length, MaxLength)
+	}
 
 	messageBuf := make([]byte, length)
 	_, err = io.ReadFull(r, messageBuf)
@@ -129,6 +371,24 @@ func (m *Message) name() string {
 		return "Piece"
 	case MsgCancel:
 		return "Cancel"
+	case MsgSuggest:
+		return "Suggest"
+	case MsgHaveAll:
+		return "HaveAll"
+	case MsgHaveNone:
+		return "HaveNone"
+	case MsgReject:
+		return "Reject"
+	case MsgAllowedFast:
+		return "AllowedFast"
+	case MsgExtended:
+		return "Extended"
+	case MsgHashRequest:
+		return "HashRequest"
+	case MsgHashes:
+		return "Hashes"
+	case MsgHashReject:
+		return "HashReject"
 	default:
 		return fmt.Sprintf("Unknown#%d", m.ID)
 	}
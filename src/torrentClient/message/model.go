@@ -22,11 +22,60 @@ const (
 	MsgPiece messageID = 7
 	// MsgCancel cancels a request
 	MsgCancel messageID = 8
+	// MsgSuggest advises the receiver to download a piece (BEP 6)
+	MsgSuggest messageID = 13
+	// MsgHaveAll tells that the sender has every piece, in place of a bitfield (BEP 6)
+	MsgHaveAll messageID = 14
+	// MsgHaveNone tells that the sender has no pieces, in place of a bitfield (BEP 6)
+	MsgHaveNone messageID = 15
+	// MsgReject tells that a request won't be answered (BEP 6)
+	MsgReject messageID = 16
+	// MsgAllowedFast tells that a piece may be requested while choked (BEP 6)
+	MsgAllowedFast messageID = 17
+	// MsgExtended carries a message of the extension protocol
+	MsgExtended messageID = 20
+	// MsgHashRequest requests merkle tree hashes of a v2 file
+	MsgHashRequest messageID = 21
+	// MsgHashes delivers merkle tree hashes to fulfill a hash request
+	MsgHashes messageID = 22
+	// MsgHashReject rejects a hash request
+	MsgHashReject messageID = 23
 )
 
+const (
+	// MaxHashes is the most hashes we ask for in one hash request
+	MaxHashes = 1 << 16
+	// MaxLength is the longest message accepted from peers. Blocks are 16 KiB,
+	// the longest messages are v2 hashes of a whole piece layer
+	MaxLength = 1 + hashRequestLength + MaxHashes*32
+)
+
+// ExtHandshakeID is the extended message ID of the extension protocol handshake
+const ExtHandshakeID uint8 = 0
+
+// ExtendedHandshake is the bencoded payload of the extension protocol handshake.
+// M maps extension names to the IDs the sender wants to receive them with
+type ExtendedHandshake struct {
+	M            map[string]int `bencode:"m"`
+	V            string         `bencode:"v,omitempty"`
+	P            int            `bencode:"p,omitempty"`
+	YourIP       string         `bencode:"yourip,omitempty"`
+	Reqq         int            `bencode:"reqq,omitempty"`
+	MetadataSize int            `bencode:"metadata_size,omitempty"`
+}
+
 // Message stores ID and payload of a message
 type Message struct {
 	ID      messageID
 	Payload []byte
 }
 
+// HashRequest describes a range of hashes in a layer of a v2 file merkle tree.
+// It is the common header of HASH REQUEST, HASHES and HASH REJECT messages
+type HashRequest struct {
+	PiecesRoot  [32]byte
+	BaseLayer   int
+	Index       int
+	Length      int
+	ProofLayers int
+}
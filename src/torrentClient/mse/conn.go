@@ -0,0 +1,60 @@
+package mse
+
+import (
+	"crypto/rc4"
+	"io"
+	"net"
+)
+
+func newConn(conn net.Conn, r io.Reader, selected uint32, encrypt, decrypt *rc4.Cipher, initial []byte) *Conn {
+	c := &Conn{Conn: conn, Selected: selected, reader: r, pending: initial}
+	if selected == CryptoRC4 {
+		c.encrypt = encrypt
+		c.decrypt = decrypt
+	}
+	return c
+}
+
+func (c *Conn) Read(b []byte) (int, error) {
+	c.readMu.Lock()
+	defer c.readMu.Unlock()
+
+	if len(c.pending) > 0 {
+		n := copy(b, c.pending)
+		c.pending = c.pending[n:]
+		return n, nil
+	}
+	n, err := c.reader.Read(b)
+	if c.decrypt != nil && n > 0 {
+		c.decrypt.XORKeyStream(b[:n], b[:n])
+	}
+	return n, err
+}
+
+// Write encrypts and writes the whole buffer at once, the keystream
+// must not get ahead of the data the peer receives
+func (c *Conn) Write(b []byte) (int, error) {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	if c.encrypt == nil {
+		return c.Conn.Write(b)
+	}
+	buf := make([]byte, len(b))
+	c.encrypt.XORKeyStream(buf, b)
+	return c.Conn.Write(buf)
+}
+
+// IsEncrypted reports whether RC4 was selected
+func (c *Conn) IsEncrypted() bool {
+	return c.Selected == CryptoRC4
+}
+
+func (c *prefixConn) Read(b []byte) (int, error) {
+	if len(c.prefix) > 0 {
+		n := copy(b, c.prefix)
+		c.prefix = c.prefix[n:]
+		return n, nil
+	}
+	return c.Conn.Read(b)
+}
@@ -0,0 +1,49 @@
+package mse
+
+import (
+	"crypto/rc4"
+	"io"
+	"net"
+	"sync"
+)
+
+// Policy tells whether peer connections are encrypted
+type Policy string
+
+const (
+	// PolicyPrefer encrypts if the peer supports it and falls back to plaintext
+	PolicyPrefer Policy = "prefer"
+	// PolicyRequire drops peers which don't encrypt
+	PolicyRequire Policy = "require"
+	// PolicyDisable only talks plaintext
+	PolicyDisable Policy = "disable"
+)
+
+// Crypto methods negotiated in crypto_provide and crypto_select
+const (
+	CryptoPlaintext uint32 = 0x01
+	CryptoRC4       uint32 = 0x02
+)
+
+// Conn is a peer connection after the MSE handshake. Data is RC4 encrypted
+// if it was selected and passed as is otherwise
+type Conn struct {
+	net.Conn
+	// Selected is the crypto method the peers agreed on
+	Selected uint32
+
+	readMu  sync.Mutex
+	reader  io.Reader
+	decrypt *rc4.Cipher
+	// pending is the decrypted initial payload of the peer, read before the stream
+	pending []byte
+
+	writeMu sync.Mutex
+	encrypt *rc4.Cipher
+}
+
+// prefixConn gives back bytes read while looking at the start of the stream
+type prefixConn struct {
+	net.Conn
+	prefix []byte
+}
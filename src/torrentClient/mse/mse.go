@@ -0,0 +1,320 @@
+package mse
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"crypto/rc4"
+	"crypto/sha1"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"time"
+)
+
+const (
+	// keyLength is the length of DH public keys and the shared secret
+	keyLength = 96
+	// maxPadLength is the longest random padding after a public key
+	maxPadLength = 512
+	// rc4Discard is the number of keystream bytes thrown away to hide the key
+	rc4Discard = 1024
+	// handshakeTimeout is how long the whole key exchange may take
+	handshakeTimeout = 10 * time.Second
+)
+
+var dhPrime, _ = new(big.Int).SetString("FFFFFFFFFFFFFFFFC90FDAA22168C234C4C6628B80DC1CD1"+
+	"29024E088A67CC74020BBEA63B139B22514A08798E3404DD"+
+	"EF9519B3CD3A431B302B0A6DF25F14374FE1356D6D51C245"+
+	"E485B576625E7EC6F44C42E9A63A36210000000000090563", 16)
+var dhGenerator = big.NewInt(2)
+
+// verificationConstant is 8 zero bytes both sides encrypt to find the start of the stream
+var verificationConstant = make([]byte, 8)
+
+// ParsePolicy returns the policy of the name, prefer if it's unknown
+func ParsePolicy(name string) Policy {
+	switch policy := Policy(name); policy {
+	case PolicyRequire, PolicyDisable:
+		return policy
+	default:
+		return PolicyPrefer
+	}
+}
+
+// Provide returns crypto methods we offer to peers under the policy
+func (p Policy) Provide() uint32 {
+	switch p {
+	case PolicyRequire:
+		return CryptoRC4
+	case PolicyDisable:
+		return CryptoPlaintext
+	default:
+		return CryptoRC4 | CryptoPlaintext
+	}
+}
+
+// selectCrypto picks RC4 if both sides allow it, plaintext otherwise
+func selectCrypto(provided, allowed uint32) uint32 {
+	if provided&allowed&CryptoRC4 != 0 {
+		return CryptoRC4
+	}
+	if provided&allowed&CryptoPlaintext != 0 {
+		return CryptoPlaintext
+	}
+	return 0
+}
+
+// Initiate does the MSE handshake of an outgoing connection to a peer of the
+// torrent. provide is the set of crypto methods we accept
+func Initiate(conn net.Conn, infoHash [20]byte, provide uint32) (*Conn, error) {
+	conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	defer conn.SetDeadline(time.Time{})
+
+	private, public, err := newKeys()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := conn.Write(append(public, randomPad()...)); err != nil {
+		return nil, fmt.Errorf("public key write error: %v", err)
+	}
+
+	r := bufio.NewReader(conn)
+	secret, err := readSecret(r, private)
+	if err != nil {
+		return nil, err
+	}
+
+	encrypt := newCipher("keyA", secret, infoHash[:])
+	decrypt := newCipher("keyB", secret, infoHash[:])
+
+	req := hash("req1", secret)
+	req2 := hash("req2", infoHash[:])
+	req3 := hash("req3", secret)
+	for i := range req2 {
+		req2[i] ^= req3[i]
+	}
+	req = append(req, req2...)
+
+	// VC, crypto_provide, len(PadC) = 0, len(IA) = 0
+	payload := make([]byte, 8+4+2+2)
+	binary.BigEndian.PutUint32(payload[8:12], provide)
+	encrypt.XORKeyStream(payload, payload)
+	if _, err := conn.Write(append(req, payload...)); err != nil {
+		return nil, fmt.Errorf("crypto provide write error: %v", err)
+	}
+
+	// The peer's answer starts with the encrypted VC somewhere after its padding
+	vc := make([]byte, len(verificationConstant))
+	decrypt.XORKeyStream(vc, verificationConstant)
+	if err := synchronize(r, vc, maxPadLength+len(vc)); err != nil {
+		return nil, fmt.Errorf("no verification constant in answer: %v", err)
+	}
+
+	header := make([]byte, 4+2)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, fmt.Errorf("crypto select read error: %v", err)
+	}
+	decrypt.XORKeyStream(header, header)
+	selected := binary.BigEndian.Uint32(header[0:4])
+	if selected != CryptoRC4 && selected != CryptoPlaintext || selected&provide == 0 {
+		return nil, fmt.Errorf("peer selected crypto %#x out of provided %#x", selected, provide)
+	}
+	if err := skipEncrypted(r, decrypt, int(binary.BigEndian.Uint16(header[4:6]))); err != nil {
+		return nil, fmt.Errorf("padding read error: %v", err)
+	}
+
+	return newConn(conn, r, selected, encrypt, decrypt, nil), nil
+}
+
+// Receive does the MSE handshake of an incoming connection. infoHashes are
+// torrents we serve, the one the peer wants is returned. allowed is the set
+// of crypto methods we accept
+func Receive(conn net.Conn, infoHashes [][20]byte, allowed uint32) (*Conn, [20]byte, error) {
+	conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	defer conn.SetDeadline(time.Time{})
+
+	private, public, err := newKeys()
+	if err != nil {
+		return nil, [20]byte{}, err
+	}
+
+	r := bufio.NewReader(conn)
+	secret, err := readSecret(r, private)
+	if err != nil {
+		return nil, [20]byte{}, err
+	}
+	if _, err := conn.Write(append(public, randomPad()...)); err != nil {
+		return nil, [20]byte{}, fmt.Errorf("public key write error: %v", err)
+	}
+
+	if err := synchronize(r, hash("req1", secret), maxPadLength+sha1.Size); err != nil {
+		return nil, [20]byte{}, fmt.Errorf("no req1 hash: %v", err)
+	}
+	skeyHash := make([]byte, sha1.Size)
+	if _, err := io.ReadFull(r, skeyHash); err != nil {
+		return nil, [20]byte{}, fmt.Errorf("req2 hash read error: %v", err)
+	}
+	req3 := hash("req3", secret)
+	for i := range skeyHash {
+		skeyHash[i] ^= req3[i]
+	}
+	infoHash, found := findInfoHash(skeyHash, infoHashes)
+	if !found {
+		return nil, [20]byte{}, fmt.Errorf("unknown torrent")
+	}
+
+	encrypt := newCipher("keyB", secret, infoHash[:])
+	decrypt := newCipher("keyA", secret, infoHash[:])
+
+	header := make([]byte, 8+4+2)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, [20]byte{}, fmt.Errorf("crypto provide read error: %v", err)
+	}
+	decrypt.XORKeyStream(header, header)
+	if !bytes.Equal(header[:8], verificationConstant) {
+		return nil, [20]byte{}, fmt.Errorf("invalid verification constant")
+	}
+	selected := selectCrypto(binary.BigEndian.Uint32(header[8:12]), allowed)
+	if selected == 0 {
+		return nil, [20]byte{}, fmt.Errorf("no allowed crypto in provided %#x", binary.BigEndian.Uint32(header[8:12]))
+	}
+	if err := skipEncrypted(r, decrypt, int(binary.BigEndian.Uint16(header[12:14]))); err != nil {
+		return nil, [20]byte{}, fmt.Errorf("padding read error: %v", err)
+	}
+
+	iaLength := make([]byte, 2)
+	if _, err := io.ReadFull(r, iaLength); err != nil {
+		return nil, [20]byte{}, fmt.Errorf("initial payload length read error: %v", err)
+	}
+	decrypt.XORKeyStream(iaLength, iaLength)
+	initial := make([]byte, binary.BigEndian.Uint16(iaLength))
+	if _, err := io.ReadFull(r, initial); err != nil {
+		return nil, [20]byte{}, fmt.Errorf("initial payload read error: %v", err)
+	}
+	decrypt.XORKeyStream(initial, initial)
+
+	// VC, crypto_select, len(PadD) = 0
+	answer := make([]byte, 8+4+2)
+	binary.BigEndian.PutUint32(answer[8:12], selected)
+	encrypt.XORKeyStream(answer, answer)
+	if _, err := conn.Write(answer); err != nil {
+		return nil, [20]byte{}, fmt.Errorf("crypto select write error: %v", err)
+	}
+
+	return newConn(conn, r, selected, encrypt, decrypt, initial), infoHash, nil
+}
+
+// IsPlaintext looks at the start of an incoming connection and tells whether
+// it is a plain BitTorrent handshake. The returned conn gives the bytes back
+func IsPlaintext(conn net.Conn) (net.Conn, bool, error) {
+	const pstr = "\x13BitTorrent protocol"
+	conn.SetReadDeadline(time.Now().Add(handshakeTimeout))
+	defer conn.SetReadDeadline(time.Time{})
+
+	prefix := make([]byte, len(pstr))
+	if _, err := io.ReadFull(conn, prefix); err != nil {
+		return nil, false, fmt.Errorf("read error: %v", err)
+	}
+	return &prefixConn{Conn: conn, prefix: prefix}, string(prefix) == pstr, nil
+}
+
+func newKeys() (*big.Int, []byte, error) {
+	buf := make([]byte, 20)
+	if _, err := rand.Read(buf); err != nil {
+		return nil, nil, fmt.Errorf("rand error: %v", err)
+	}
+	private := new(big.Int).SetBytes(buf)
+	public := new(big.Int).Exp(dhGenerator, private, dhPrime)
+	return private, padKey(public), nil
+}
+
+// readSecret reads the peer's public key and computes the shared secret
+func readSecret(r io.Reader, private *big.Int) ([]byte, error) {
+	buf := make([]byte, keyLength)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, fmt.Errorf("public key read error: %v", err)
+	}
+	public := new(big.Int).SetBytes(buf)
+	max := new(big.Int).Sub(dhPrime, big.NewInt(1))
+	if public.Cmp(big.NewInt(1)) <= 0 || public.Cmp(max) >= 0 {
+		return nil, fmt.Errorf("invalid public key")
+	}
+	return padKey(new(big.Int).Exp(public, private, dhPrime)), nil
+}
+
+func padKey(key *big.Int) []byte {
+	buf := make([]byte, keyLength)
+	key.FillBytes(buf)
+	return buf
+}
+
+func randomPad() []byte {
+	var n [2]byte
+	rand.Read(n[:])
+	pad := make([]byte, int(binary.BigEndian.Uint16(n[:]))%(maxPadLength+1))
+	rand.Read(pad)
+	return pad
+}
+
+func hash(parts ...interface{}) []byte {
+	h := sha1.New()
+	for _, part := range parts {
+		switch v := part.(type) {
+		case string:
+			h.Write([]byte(v))
+		case []byte:
+			h.Write(v)
+		}
+	}
+	return h.Sum(nil)
+}
+
+func newCipher(name string, secret, skey []byte) *rc4.Cipher {
+	cipher, _ := rc4.NewCipher(hash(name, secret, skey))
+	discard := make([]byte, rc4Discard)
+	cipher.XORKeyStream(discard, discard)
+	return cipher
+}
+
+// synchronize reads the stream up to the end of marker, which has to appear in max bytes
+func synchronize(r io.ByteReader, marker []byte, max int) error {
+	window := make([]byte, 0, len(marker))
+	for read := 0; read < max; read++ {
+		b, err := r.ReadByte()
+		if err != nil {
+			return err
+		}
+		if len(window) == len(marker) {
+			window = append(window[:0], window[1:]...)
+		}
+		window = append(window, b)
+		if bytes.Equal(window, marker) {
+			return nil
+		}
+	}
+	return fmt.Errorf("not found in %v bytes", max)
+}
+
+func skipEncrypted(r io.Reader, cipher *rc4.Cipher, n int) error {
+	if n > maxPadLength {
+		return fmt.Errorf("padding is too long: %v", n)
+	}
+	buf := make([]byte, n)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return err
+	}
+	cipher.XORKeyStream(buf, buf)
+	return nil
+}
+
+func findInfoHash(skeyHash []byte, infoHashes [][20]byte) ([20]byte, bool) {
+	for _, infoHash := range infoHashes {
+		if bytes.Equal(hash("req2", infoHash[:]), skeyHash) {
+			return infoHash, true
+		}
+	}
+	return [20]byte{}, false
+}
@@ -0,0 +1,196 @@
+package mse
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"sync"
+	"testing"
+)
+
+var testInfoHash = [20]byte{7}
+
+// recordingConn keeps what is written to the wire after reset
+type recordingConn struct {
+	net.Conn
+	mu      sync.Mutex
+	written bytes.Buffer
+}
+
+func (c *recordingConn) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	c.written.Write(b)
+	c.mu.Unlock()
+	return c.Conn.Write(b)
+}
+
+func (c *recordingConn) reset() {
+	c.mu.Lock()
+	c.written.Reset()
+	c.mu.Unlock()
+}
+
+func (c *recordingConn) bytes() []byte {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]byte{}, c.written.Bytes()...)
+}
+
+type handshakeResult struct {
+	conn     *Conn
+	infoHash [20]byte
+	err      error
+}
+
+// handshake runs Initiate and Receive on the two ends of a net.Pipe
+func handshake(t *testing.T, provide, allowed uint32) (*Conn, *recordingConn, handshakeResult, error) {
+	local, remote := net.Pipe()
+	t.Cleanup(func() {
+		local.Close()
+		remote.Close()
+	})
+	wire := &recordingConn{Conn: local}
+
+	received := make(chan handshakeResult, 1)
+	go func() {
+		prefixed, plaintext, err := IsPlaintext(remote)
+		if err == nil && plaintext {
+			t.Error("MSE handshake is taken for a plaintext one")
+		}
+		if err != nil {
+			received <- handshakeResult{err: err}
+			return
+		}
+		c, infoHash, err := Receive(prefixed, [][20]byte{{1}, testInfoHash}, allowed)
+		if err != nil {
+			remote.Close()
+		}
+		received <- handshakeResult{conn: c, infoHash: infoHash, err: err}
+	}()
+
+	c, err := Initiate(wire, testInfoHash, provide)
+	if err != nil {
+		local.Close()
+	}
+	return c, wire, <-received, err
+}
+
+// exchange sends data both ways and checks what went over the wire
+func exchange(t *testing.T, initiator *Conn, wire *recordingConn, receiver *Conn, encrypted bool) {
+	msg := make([]byte, 100000)
+	for i := range msg {
+		msg[i] = byte(i)
+	}
+	wire.reset()
+	go initiator.Write(msg)
+	got := make([]byte, len(msg))
+	if _, err := io.ReadFull(receiver, got); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, msg) {
+		t.Fatal("receiver got other data than sent")
+	}
+	if onWire := wire.bytes(); bytes.Equal(onWire, msg) == encrypted {
+		t.Errorf("data on the wire is encrypted: %v, want %v", !bytes.Equal(onWire, msg), encrypted)
+	}
+
+	go receiver.Write([]byte("hello"))
+	got = make([]byte, 5)
+	if _, err := io.ReadFull(initiator, got); err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "hello" {
+		t.Fatalf("initiator got %q, want hello", got)
+	}
+}
+
+func TestRC4(t *testing.T) {
+	c, wire, received, err := handshake(t, PolicyPrefer.Provide(), PolicyPrefer.Provide())
+	if err != nil || received.err != nil {
+		t.Fatalf("handshake errors: %v; %v", err, received.err)
+	}
+	if received.infoHash != testInfoHash {
+		t.Errorf("receiver found infohash %x, want %x", received.infoHash, testInfoHash)
+	}
+	if c.Selected != CryptoRC4 || received.conn.Selected != CryptoRC4 || !c.IsEncrypted() {
+		t.Fatalf("selected %#x and %#x, want RC4", c.Selected, received.conn.Selected)
+	}
+	exchange(t, c, wire, received.conn, true)
+}
+
+func TestPlaintextSelected(t *testing.T) {
+	c, wire, received, err := handshake(t, PolicyPrefer.Provide(), PolicyDisable.Provide())
+	if err != nil || received.err != nil {
+		t.Fatalf("handshake errors: %v; %v", err, received.err)
+	}
+	if c.Selected != CryptoPlaintext || received.conn.Selected != CryptoPlaintext || c.IsEncrypted() {
+		t.Fatalf("selected %#x and %#x, want plaintext", c.Selected, received.conn.Selected)
+	}
+	exchange(t, c, wire, received.conn, false)
+}
+
+func TestRequireRejectsPlaintext(t *testing.T) {
+	_, _, received, err := handshake(t, PolicyRequire.Provide(), PolicyDisable.Provide())
+	if received.err == nil {
+		t.Error("receiver accepted a peer which only encrypts")
+	}
+	if err == nil {
+		t.Error("initiator finished the handshake the receiver refused")
+	}
+}
+
+func TestUnknownInfoHash(t *testing.T) {
+	local, remote := net.Pipe()
+	defer local.Close()
+	defer remote.Close()
+
+	received := make(chan error, 1)
+	go func() {
+		_, _, err := Receive(remote, [][20]byte{{1}}, PolicyPrefer.Provide())
+		remote.Close()
+		received <- err
+	}()
+	if _, err := Initiate(local, testInfoHash, PolicyPrefer.Provide()); err == nil {
+		t.Error("handshake for a torrent the receiver doesn't serve succeeded")
+	}
+	if err := <-received; err == nil {
+		t.Error("receiver accepted an unknown infohash")
+	}
+}
+
+// TestPlaintextFallback checks both sides of talking to a peer without MSE:
+// the receiver hands plaintext handshakes over intact and the initiator
+// fails fast so the caller can dial again in plaintext
+func TestPlaintextFallback(t *testing.T) {
+	local, remote := net.Pipe()
+	defer local.Close()
+	defer remote.Close()
+
+	handshake := append([]byte("\x13BitTorrent protocol"), make([]byte, 48)...)
+	go local.Write(handshake)
+	prefixed, plaintext, err := IsPlaintext(remote)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !plaintext {
+		t.Fatal("plaintext handshake is taken for MSE")
+	}
+	got := make([]byte, len(handshake))
+	if _, err := io.ReadFull(prefixed, got); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, handshake) {
+		t.Error("plaintext handshake isn't given back intact")
+	}
+
+	// A peer without MSE reads our public key as a broken handshake and hangs up
+	plainPeer, plainRemote := net.Pipe()
+	defer plainPeer.Close()
+	go func() {
+		plainRemote.Read(make([]byte, 68))
+		plainRemote.Close()
+	}()
+	if _, err := Initiate(plainPeer, testInfoHash, PolicyPrefer.Provide()); err == nil {
+		t.Error("handshake with a plaintext peer succeeded")
+	}
+}
@@ -0,0 +1,169 @@
+package p2p
+
+import (
+	"torrentClient/client"
+)
+
+// maxEndgameRequesters is how many peers a block may be requested from in endgame
+const maxEndgameRequesters = 2
+
+func newBlockScheduler() *blockScheduler {
+	return &blockScheduler{active: make(map[int]*activePiece)}
+}
+
+func blocksCount(length int) int {
+	return (length + MaxBlockSize - 1) / MaxBlockSize
+}
+
+func blockLength(pieceLength, block int) int {
+	if begin := block * MaxBlockSize; pieceLength-begin < MaxBlockSize {
+		return pieceLength - begin
+	}
+	return MaxBlockSize
+}
+
+// activate starts downloading a piece taken from the picker
+func (s *blockScheduler) activate(pw *pieceWork) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	count := blocksCount(pw.length)
+	s.active[pw.index] = &activePiece{
+		pw:        pw,
+		buf:       make([]byte, pw.length),
+		requested: make([][]*client.Client, count),
+		received:  make([]bool, count),
+		left:      count,
+	}
+	s.order = append(s.order, pw.index)
+}
+
+// next returns a block of an active piece nobody is asked for yet which c
+// may be asked for. In endgame blocks already requested from other peers are given too
+func (s *blockScheduler) next(c *client.Client, endgame bool) (blockRequest, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, index := range s.order {
+		piece := s.active[index]
+		if !c.CanRequest(index) {
+			continue
+		}
+		for block, requesters := range piece.requested {
+			if piece.received[block] || len(requesters) > 0 {
+				continue
+			}
+			return s.assign(c, piece, block), true
+		}
+	}
+	if !endgame {
+		return blockRequest{}, false
+	}
+
+	for _, index := range s.order {
+		piece := s.active[index]
+		if !c.CanRequest(index) {
+			continue
+		}
+		for block, requesters := range piece.requested {
+			if piece.received[block] || len(requesters) >= maxEndgameRequesters || containsClient(requesters, c) {
+				continue
+			}
+			return s.assign(c, piece, block), true
+		}
+	}
+	return blockRequest{}, false
+}
+
+func (s *blockScheduler) assign(c *client.Client, piece *activePiece, block int) blockRequest {
+	piece.requested[block] = append(piece.requested[block], c)
+	return blockRequest{
+		index:  piece.pw.index,
+		begin:  block * MaxBlockSize,
+		length: blockLength(piece.pw.length, block),
+	}
+}
+
+// receive saves a block got from c. It returns other peers the block was
+// requested from, so they can be sent a cancel, and the piece if it's complete
+func (s *blockScheduler) receive(c *client.Client, index, begin int, data []byte) (cancel []*client.Client, completed *activePiece, ok bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	piece, found := s.active[index]
+	if !found || begin%MaxBlockSize != 0 {
+		return nil, nil, false
+	}
+	block := begin / MaxBlockSize
+	if block >= len(piece.received) || piece.received[block] || len(data) != blockLength(piece.pw.length, block) {
+		return nil, nil, false
+	}
+
+	copy(piece.buf[begin:], data)
+	piece.received[block] = true
+	piece.left--
+	for _, requester := range piece.requested[block] {
+		if requester != c {
+			cancel = append(cancel, requester)
+		}
+	}
+	piece.requested[block] = nil
+
+	if piece.left == 0 {
+		s.remove(index)
+		return cancel, piece, true
+	}
+	return cancel, nil, true
+}
+
+// isWanted reports whether the block is still missing
+func (s *blockScheduler) isWanted(req blockRequest) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	piece, found := s.active[req.index]
+	return found && !piece.received[req.begin/MaxBlockSize]
+}
+
+// unassign forgets that blocks were requested from c, so other peers may take them
+func (s *blockScheduler) unassign(c *client.Client, reqs []blockRequest) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, req := range reqs {
+		piece, found := s.active[req.index]
+		if !found {
+			continue
+		}
+		block := req.begin / MaxBlockSize
+		piece.requested[block] = removeClient(piece.requested[block], c)
+	}
+}
+
+func (s *blockScheduler) remove(index int) {
+	delete(s.active, index)
+	for i, active := range s.order {
+		if active == index {
+			s.order = append(s.order[:i], s.order[i+1:]...)
+			break
+		}
+	}
+}
+
+func containsClient(list []*client.Client, c *client.Client) bool {
+	for _, existing := range list {
+		if existing == c {
+			return true
+		}
+	}
+	return false
+}
+
+func removeClient(list []*client.Client, c *client.Client) []*client.Client {
+	for i, existing := range list {
+		if existing == c {
+			return append(list[:i], list[i+1:]...)
+		}
+	}
+	return list
+}
@@ -0,0 +1,150 @@
+package p2p
+
+import (
+	"context"
+	"math/rand"
+	"sort"
+	"time"
+
+	"torrentClient/client"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// chokeInterval is how often peers we upload to are chosen again
+	chokeInterval = 10 * time.Second
+	// optimisticRounds is how many choke rounds an optimistic unchoke lasts
+	optimisticRounds = 3
+	// regularUnchokes is how many peers are unchoked for their rate
+	regularUnchokes = 3
+)
+
+func newChoker() *choker {
+	return &choker{
+		workers: make(map[*client.Client]*peerWorker),
+		wake:    make(chan struct{}, 1),
+	}
+}
+
+func (ch *choker) add(w *peerWorker) {
+	ch.mu.Lock()
+	ch.workers[w.c] = w
+	ch.mu.Unlock()
+}
+
+func (ch *choker) remove(w *peerWorker) {
+	ch.mu.Lock()
+	delete(ch.workers, w.c)
+	if ch.optimistic == w.c {
+		ch.optimistic = nil
+	}
+	ch.mu.Unlock()
+	ch.nudge()
+}
+
+// nudge makes the choker look at peers before the next round,
+// e.g. an interested peer may take a free upload slot right away
+func (ch *choker) nudge() {
+	select {
+	case ch.wake <- struct{}{}:
+	default:
+	}
+}
+
+// broadcastHave tells every peer about a piece we have verified and saved
+func (ch *choker) broadcastHave(index int) {
+	ch.mu.Lock()
+	clients := make([]*client.Client, 0, len(ch.workers))
+	for c := range ch.workers {
+		clients = append(clients, c)
+	}
+	ch.mu.Unlock()
+
+	for _, c := range clients {
+		c.SendHave(index)
+	}
+}
+
+// runChoker chooses peers to upload to every chokeInterval, tit-for-tat:
+// the peers we download from the fastest are unchoked, plus an optimistic
+// one giving new peers a chance to show their rate. We only upload while
+// downloading: the choker and the workers stop once every piece is loaded
+func (t *TorrentMeta) runChoker(ctx context.Context) {
+	ticker := time.NewTicker(chokeInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			t.choker.rechoke(true)
+		case <-t.choker.wake:
+			t.choker.rechoke(false)
+		}
+	}
+}
+
+func (ch *choker) rechoke(newRound bool) {
+	ch.mu.Lock()
+	if newRound {
+		ch.round++
+	}
+
+	workers := make([]*peerWorker, 0, len(ch.workers))
+	var interested []*peerWorker
+	for _, w := range ch.workers {
+		workers = append(workers, w)
+		if w.c.IsPeerInterested() {
+			interested = append(interested, w)
+		}
+	}
+	sort.Slice(interested, func(i, j int) bool {
+		a, b := interested[i].downloadRate(), interested[j].downloadRate()
+		if a != b {
+			return a > b
+		}
+		// Keep unchoked peers on a tie, every switch costs a round trip
+		return !interested[i].c.IsChoking() && interested[j].c.IsChoking()
+	})
+
+	unchoke := make(map[*client.Client]bool)
+	for i := 0; i < len(interested) && i < regularUnchokes; i++ {
+		unchoke[interested[i].c] = true
+	}
+
+	current, found := ch.workers[ch.optimistic]
+	if newRound && ch.round%optimisticRounds == 0 || !found || !current.c.IsPeerInterested() || unchoke[ch.optimistic] {
+		ch.optimistic = pickOptimistic(interested[len(unchoke):])
+	}
+	if ch.optimistic != nil {
+		unchoke[ch.optimistic] = true
+	}
+	ch.mu.Unlock()
+
+	for _, w := range workers {
+		if unchoke[w.c] {
+			if w.c.IsChoking() {
+				logrus.Debugf("Unchoking %v", w.c.GetShortInfo())
+				w.c.SendUnchoke()
+			}
+		} else if !w.c.IsChoking() {
+			logrus.Debugf("Choking %v", w.c.GetShortInfo())
+			w.chokePeer()
+		}
+	}
+}
+
+func pickOptimistic(candidates []*peerWorker) *client.Client {
+	if len(candidates) == 0 {
+		return nil
+	}
+	return candidates[rand.Intn(len(candidates))].c
+}
+
+func (w *peerWorker) downloadRate() float64 {
+	w.rateMu.Lock()
+	defer w.rateMu.Unlock()
+	return w.rate
+}
@@ -1,26 +1,146 @@
 package p2p
 
 import (
+	"io"
+	"sync"
+	"time"
+
+	"torrentClient/bitfield"
 	"torrentClient/client"
 )
 
 // MaxBlockSize is the largest number of bytes a request can ask for
 const MaxBlockSize = 16384
 
-// MaxBacklog is the number of unfulfilled requests a client can have in its pipeline
+// MaxBacklog is the number of unfulfilled requests a client starts its pipeline with,
+// the pipeline then grows with the measured throughput of the peer
 const MaxBacklog = 5
 
+// MaxQueue is the largest number of unfulfilled requests to one peer
+const MaxQueue = 250
+
 // TorrentMeta holds data required to download a torrent from a list of peers
 type TorrentMeta struct {
 	ActiveClientsChan	<- chan *client.Client
 	PeerID      [20]byte
 	InfoHash    [20]byte
+	// SwarmInfoHashes are the infohashes peers connect with, InfoHash only if empty
+	SwarmInfoHashes [][20]byte
 	PieceHashes [][20]byte
+	PieceHashesV2 []PieceHashV2
 	PieceLength int
 	Length      int
 	Name        string
 	FileId		string
+	// FileOffset and FileLength locate the file storage serves in the torrent,
+	// progress is reported for it. The whole torrent is reported if FileLength is 0
+	FileOffset  int
+	FileLength  int
 	ResultsChan chan LoadedPiece
+	Stats       *TransferStats
+	// Strategy orders pieces for download, sequential with readahead if not set
+	Strategy    Strategy
+	Picker      *Picker
+	// Storage reads verified pieces back to upload them, nothing is uploaded if not set
+	Storage     io.ReaderAt
+	// AfterRecheck is called once pieces loaded before are checked on disk
+	AfterRecheck func()
+
+	choker *choker
+	// peers is the number of running peer workers
+	peers  int32
+	v2Mu   sync.Mutex
+	rates  rateMeter
+}
+
+// Progress is a snapshot of a download as the frontend shows it. Lengths and
+// ranges are of the file storage serves, offsets are from the file's start
+type Progress struct {
+	FileId  string  `json:"fileId"`
+	Length  int64   `json:"length"`
+	Loaded  int64   `json:"loaded"`
+	Percent float64 `json:"percent"`
+	// DownloadRate and UploadRate are in bytes per second
+	DownloadRate int64 `json:"downloadRate"`
+	UploadRate   int64 `json:"uploadRate"`
+	Peers        int   `json:"peers"`
+	// Ranges are the loaded bytes of the file in order
+	Ranges []ByteRange `json:"ranges"`
+	// Done is set once the whole file is loaded
+	Done bool `json:"done"`
+}
+
+// ByteRange is bytes Start..End of a file, End is exclusive
+type ByteRange struct {
+	Start int64 `json:"start"`
+	End   int64 `json:"end"`
+}
+
+// rateMeter smooths download and upload rates of a torrent over TransferStats
+type rateMeter struct {
+	mu         sync.Mutex
+	last       time.Time
+	downloaded int64
+	uploaded   int64
+	download   float64
+	upload     float64
+}
+
+// TransferStats counts bytes exchanged with peers, trackers report them in announces
+type TransferStats struct {
+	downloaded int64
+	uploaded   int64
+	left       int64
+}
+
+// PieceHashV2 describes how a piece of a v2 torrent is verified
+type PieceHashV2 struct {
+	// Root is the expected merkle root of the piece, valid if Known is set
+	Root  [32]byte
+	Known bool
+	// Leaves is the number of 16KiB leaves Root is computed over
+	Leaves int
+	// DataLength is the number of file bytes in the piece, the rest is padding
+	DataLength int
+
+	PiecesRoot [32]byte
+	FirstPiece int
+	FilePieces int
+}
+
+// Strategy orders pieces which are wanted with the same priority
+type Strategy interface {
+	Name() string
+	// Better reports whether piece a should be downloaded before piece b
+	Better(state *PickState, a, b int) bool
+}
+
+// PickState is what strategies know about pieces when comparing them
+type PickState struct {
+	NumPieces    int
+	Availability []int
+	Deadlines    []time.Time
+	// Playback is the piece the viewer is at
+	Playback int
+}
+
+// Picker hands pieces out to download workers. Pieces with a higher priority
+// go first, the rest is ordered by the strategy
+type Picker struct {
+	mu       sync.Mutex
+	strategy Strategy
+	state    PickState
+
+	priorities []int
+	done       []bool
+	inProgress []bool
+	left       int
+
+	readahead    int
+	readaheadEnd int
+
+	// changed is closed and replaced on every change workers may wait for
+	changed chan struct{}
 }
 
 type LoadedPiece struct {
@@ -32,6 +152,7 @@ type LoadedPiece struct {
 type pieceWork struct {
 	index  int
 	hash   [20]byte
+	hashV2 *PieceHashV2
 	length int
 }
 
@@ -40,11 +161,73 @@ type pieceResult struct {
 	buf   []byte
 }
 
-type pieceProgress struct {
-	index      int
-	client     *client.Client
-	buf        []byte
-	downloaded int
-	requested  int
-	backlog    int
+// blockRequest is a block of a piece requested from a peer
+type blockRequest struct {
+	index  int
+	begin  int
+	length int
+}
+
+// activePiece is a piece being downloaded, its blocks may come from different peers
+type activePiece struct {
+	pw        *pieceWork
+	buf       []byte
+	requested [][]*client.Client
+	received  []bool
+	left      int
+}
+
+// blockScheduler hands out blocks of active pieces to peers
+type blockScheduler struct {
+	mu     sync.Mutex
+	active map[int]*activePiece
+	// order keeps active pieces in the order they were started
+	order []int
+}
+
+// peerWorker downloads blocks from one peer keeping its request queue full
+type peerWorker struct {
+	t       *TorrentMeta
+	c       *client.Client
+	sched   *blockScheduler
+	results chan *pieceResult
+	// bitfield is the peer's bitfield as counted in the picker's availability
+	bitfield bitfield.Bitfield
+
+	outstanding map[blockRequest]time.Time
+	queueSize   int
+
+	windowStart time.Time
+	windowBytes int
+
+	// rateMu guards rate which the choker reads
+	rateMu sync.Mutex
+	// rate is the smoothed throughput of the peer in bytes per second
+	rate float64
+
+	uploads *uploader
+	// allowedFast are pieces the peer may request while we choke it,
+	// set before uploads are served
+	allowedFast map[int]bool
+}
+
+// uploader serves blocks the peer requests from us
+type uploader struct {
+	mu      sync.Mutex
+	pending []blockRequest
+	wake    chan struct{}
+
+	// The last piece read from storage, peers mostly request blocks in order
+	cachedIndex int
+	cachedBuf   []byte
+}
+
+// choker picks peers we upload to: the ones we download from the fastest
+// and an optimistic one rotated through the rest
+type choker struct {
+	mu         sync.Mutex
+	workers    map[*client.Client]*peerWorker
+	optimistic *client.Client
+	round      int
+	wake       chan struct{}
 }
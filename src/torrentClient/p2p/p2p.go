@@ -5,133 +5,94 @@ import (
 	"context"
 	"crypto/sha1"
 	"fmt"
+	"sync/atomic"
 	"time"
 
 	"torrentClient/client"
 	"torrentClient/db"
-	"torrentClient/message"
 
 	"github.com/sirupsen/logrus"
 )
 
 
-func (state *pieceProgress) readMessage() error {
-	msg, err := state.client.Read() // this call blocks
-	if err != nil {
-		return err
-	}
-
-	if msg == nil { // keep-alive
-		return nil
-	}
-
-	switch msg.ID {
-	case message.MsgUnchoke:
-		state.client.Choked = false
-		logrus.Infof("Got UNCHOKE from %v", state.client.GetShortInfo())
-	case message.MsgChoke:
-		state.client.Choked = true
-	case message.MsgHave:
-		index, err := message.ParseHave(msg)
-		if err != nil {
-			return err
+func (t *TorrentMeta) checkIntegrity(pw *pieceWork, buf []byte) error {
+	if len(t.PieceHashes) > 0 {
+		hash := sha1.Sum(buf)
+		if !bytes.Equal(hash[:], pw.hash[:]) {
+			return fmt.Errorf("index %d failed integrity check", pw.index)
 		}
-		state.client.Bitfield.SetPiece(index)
-	case message.MsgPiece:
-		n, err := message.ParsePiece(state.index, state.buf, msg)
-		if err != nil {
-			return err
-		}
-		state.downloaded += n
-		state.backlog--
+	}
+	// v2 hashes of hybrid torrents are checked only if the torrent had them
+	if pw.hashV2 != nil && (len(t.PieceHashes) == 0 || t.isHashV2Known(pw)) {
+		return t.checkIntegrityV2(pw, buf)
 	}
 	return nil
 }
 
-func attemptDownloadPiece(c *client.Client, pw *pieceWork) ([]byte, error) {
-	logrus.Debugf("Attempting to download piece (len=%v, idx=%v)", pw.length, pw.index)
-
-	if pw.length < 0 {
-		logrus.Errorf("Attempting to download incorrect pw: %v", *pw)
-		return nil, fmt.Errorf("incorrect pw")
+// recheckPiece verifies a piece the database lists as loaded against its
+// hash on disk. Pieces which can't be checked, without storage or with an
+// unknown v2 hash, are trusted
+func (t *TorrentMeta) recheckPiece(index int) error {
+	if t.Storage == nil {
+		return nil
 	}
-
-	state := pieceProgress{
-		index:  pw.index,
-		client: c,
-		buf:    make([]byte, pw.length),
+	pw := t.newPieceWork(index)
+	if !t.isPieceHashKnown(pw) {
+		return nil
 	}
-
-	//Setting a deadline helps get unresponsive peers unstuck.
-	//30 seconds is more than enough time to download a 262 KB piece
-	defer c.Conn.SetDeadline(time.Time{}) // Disable the deadline
-
-	for state.downloaded < pw.length {
-		c.Conn.SetDeadline(time.Now().Add(30 * time.Second))
-		// If unchoked, send requests until we have enough unfulfilled requests
-		if !state.client.Choked {
-			logrus.Debugf("Downloading from %v. State: idx=%v, downloaded=%v (%v%%)", c.GetShortInfo(), state.index, state.downloaded, (state.downloaded * 100) / pw.length)
-			for state.backlog < MaxBacklog && state.requested < pw.length {
-				blockSize := MaxBlockSize
-				// Last block might be shorter than the typical block
-				if pw.length - state.requested < blockSize {
-					blockSize = pw.length - state.requested
-				}
-
-				err := c.SendRequest(pw.index, state.requested, blockSize)
-				if err != nil {
-					return nil, err
-				}
-				state.backlog++
-				state.requested += blockSize
-			}
-		} else {
-			logrus.Warnf("CHOKED by %v for idx=%v, waiting for unchoke", state.client.GetShortInfo(), pw.index)
-		}
-
-		err := state.readMessage()
-		if err != nil {
-			return nil, fmt.Errorf("read msg err: %v", err)
-		}
+	buf := make([]byte, pw.length)
+	begin, _ := t.calculateBoundsForPiece(index)
+	if _, err := t.Storage.ReadAt(buf, int64(begin)); err != nil {
+		return fmt.Errorf("read error: %v", err)
 	}
-
-	return state.buf, nil
+	return t.checkIntegrity(pw, buf)
 }
 
-func checkIntegrity(pw *pieceWork, buf []byte) error {
-	hash := sha1.Sum(buf)
-	if !bytes.Equal(hash[:], pw.hash[:]) {
-		return fmt.Errorf("index %d failed integrity check", pw.index)
-	}
-	return nil
+// ConnectedPeers returns the number of peers the download works with
+func (t *TorrentMeta) ConnectedPeers() int {
+	return int(atomic.LoadInt32(&t.peers))
 }
 
-func (t *TorrentMeta) startDownloadWorker(c *client.Client, workQueue chan *pieceWork, results chan *pieceResult) {
-	defer c.Conn.Close()
-
-	for pw := range workQueue {
-		if !c.Bitfield.HasPiece(pw.index) {
-			workQueue <- pw // Put piece back on the queue
-			continue
-		}
+func (t *TorrentMeta) startDownloadWorker(ctx context.Context, c *client.Client, sched *blockScheduler, results chan *pieceResult) {
+	defer c.Close()
+	atomic.AddInt32(&t.peers, 1)
+	defer atomic.AddInt32(&t.peers, -1)
+
+	c.Start()
+
+	w := &peerWorker{
+		t:           t,
+		c:           c,
+		sched:       sched,
+		results:     results,
+		bitfield:    c.BitfieldCopy(),
+		outstanding: make(map[blockRequest]time.Time),
+		queueSize:   MaxBacklog,
+		windowStart: time.Now(),
+		uploads:     newUploader(),
+	}
+	if err := w.sendAllowedFast(); err != nil {
+		logrus.Errorf("Error sending allowed fast pieces to %v: %v", c.GetShortInfo(), err)
+		return
+	}
+	t.choker.add(w)
+	defer t.choker.remove(w)
+	go w.serveUploads(ctx)
+	// The worker counts pieces of its own bitfield copy, so it removes exactly what it added
+	t.Picker.AddPeer(w.bitfield)
+	defer func() {
+		t.Picker.RemovePeer(w.bitfield)
+	}()
+	defer w.dropOutstanding()
 
-		// Download the piece
-		buf, err := attemptDownloadPiece(c, pw)
-		if err != nil {
-			logrus.Errorf("Exiting piece download worker due to error: %v", err)
-			workQueue <- pw // Put piece back on the queue
+	if !c.IsInterested() {
+		if err := c.SendInterested(); err != nil {
 			return
 		}
+	}
 
-		err = checkIntegrity(pw, buf)
-		if err != nil {
-			logrus.Errorf("Check err: %v", err)
-			workQueue <- pw // Put piece back on the queue
-			continue
-		}
-
-		c.SendHave(pw.index)
-		results <- &pieceResult{pw.index, buf}
+	if err := w.run(ctx); err != nil {
+		logrus.Errorf("Exiting piece download worker of %v due to error: %v", c.GetShortInfo(), err)
 	}
 }
 
@@ -145,36 +106,101 @@ func (t *TorrentMeta) calculateBoundsForPiece(index int) (begin int, end int) {
 }
 
 func (t *TorrentMeta) calculatePieceSize(index int) int {
+	// v2 pieces never span files, padding up to the piece end isn't transferred
+	if len(t.PieceHashes) == 0 && index < len(t.PieceHashesV2) {
+		return t.PieceHashesV2[index].DataLength
+	}
 	begin, end := t.calculateBoundsForPiece(index)
 	return end - begin
 }
 
+// DataLength is the number of bytes peers send for the whole torrent. Pure v2
+// torrents send less than Length, padding between their files isn't transferred
+func (t *TorrentMeta) DataLength() int {
+	res := 0
+	for index := 0; index < t.piecesCount(); index++ {
+		res += t.calculatePieceSize(index)
+	}
+	return res
+}
+
+func (t *TorrentMeta) swarmInfoHashes() [][20]byte {
+	if len(t.SwarmInfoHashes) == 0 {
+		return [][20]byte{t.InfoHash}
+	}
+	return t.SwarmInfoHashes
+}
+
+func (t *TorrentMeta) piecesCount() int {
+	if len(t.PieceHashes) > 0 {
+		return len(t.PieceHashes)
+	}
+	return len(t.PieceHashesV2)
+}
+
+func (t *TorrentMeta) newPieceWork(index int) *pieceWork {
+	pw := &pieceWork{index: index, length: t.calculatePieceSize(index)}
+	if index < len(t.PieceHashes) {
+		pw.hash = t.PieceHashes[index]
+	}
+	if index < len(t.PieceHashesV2) && t.PieceHashesV2[index].DataLength > 0 {
+		pw.hashV2 = &t.PieceHashesV2[index]
+	}
+	return pw
+}
+
 // Download downloads the torrent. This stores the entire file in memory.
 func (t *TorrentMeta) Download(ctx context.Context) error {
+	numPieces := t.piecesCount()
 	logrus.Infof("starting download %v parts, file.len=%v, p.length=%v for %v",
-		len(t.PieceHashes), t.Length, t.PieceLength, t.Name)
+		numPieces, t.Length, t.PieceLength, t.Name)
 
-	// Init queues for workers to retrieve work and send results
-	workQueue := make(chan *pieceWork, len(t.PieceHashes))
 	results := make(chan *pieceResult)
-
-	defer close(workQueue)
-	defer close(results)
+	sched := newBlockScheduler()
 
 	loadedIdxs := db.GetFilesManagerDb().GetLoadedIndexesForFile(t.FileId)
 	logrus.Debugf("Got loaded idxs: %v", loadedIdxs)
 
-	go func() {
-		for index, hash := range t.PieceHashes {
-			if IntArrayContain(loadedIdxs, index) {
-				continue
-			}
-			length := t.calculatePieceSize(index)
-
-			//logrus.Debugf("Prepared piece idx=%v, len=%v", index, length)
-			workQueue <- &pieceWork{index, hash, length}
+	if t.Stats == nil {
+		t.Stats = NewTransferStats(t.DataLength())
+	}
+	readahead := (readaheadBytes + t.PieceLength - 1) / t.PieceLength
+	t.Picker = NewPicker(numPieces, t.Strategy, readahead)
+	rechecked := 0
+	for _, index := range loadedIdxs {
+		if index < 0 || index >= numPieces || t.Picker.IsDone(index) {
+			continue
 		}
-	}()
+		if err := t.recheckPiece(index); err != nil {
+			logrus.Warnf("Piece %v of %v is loaded but not on disk, downloading it again: %v", index, t.FileId, err)
+			continue
+		}
+		t.Picker.MarkDone(index)
+		t.Stats.Loaded(t.calculatePieceSize(index))
+		rechecked++
+	}
+	if len(loadedIdxs) > 0 {
+		logrus.Infof("Rechecked %v of %v loaded pieces of %v", rechecked, len(loadedIdxs), t.FileId)
+	}
+	if t.AfterRecheck != nil {
+		t.AfterRecheck()
+	}
+	logrus.Infof("Picking pieces with %v strategy, %v of %v left", t.Picker.strategy.Name(), t.Picker.Left(), numPieces)
+
+	registerDownload(t)
+	defer unregisterDownload(t)
+	for _, infoHash := range t.swarmInfoHashes() {
+		client.RegisterLocalPieces(infoHash, t.Picker)
+		defer client.UnregisterLocalPieces(infoHash, t.Picker)
+	}
+
+	t.choker = newChoker()
+	go t.runChoker(ctx)
+
+	progressCtx, stopProgress := context.WithCancel(ctx)
+	defer stopProgress()
+	go t.reportProgress(progressCtx)
+	publishProgress(t.Progress())
 
 	// Start workers as they arrive from Pool
 	go func() {
@@ -188,13 +214,12 @@ func (t *TorrentMeta) Download(ctx context.Context) error {
 					continue
 				}
 				logrus.Infof("Got activated client: %v", activeClient.GetShortInfo())
-				go t.startDownloadWorker(activeClient, workQueue, results)
+				go t.startDownloadWorker(ctx, activeClient, sched, results)
 			}
 		}
 	}()
 
-	donePieces := 0
-	for donePieces < len(t.PieceHashes) {
+	for t.Picker.Left() > 0 {
 		select {
 		case <- ctx.Done():
 			logrus.Debugf("Got DONE in Download, exiting")
@@ -205,16 +230,26 @@ func (t *TorrentMeta) Download(ctx context.Context) error {
 				continue
 			}
 
-			begin, end := t.calculateBoundsForPiece(res.index)
-			t.ResultsChan <- LoadedPiece{Data: res.buf, Len: int64(end-begin), StartByte: int64(begin)}
+			begin, _ := t.calculateBoundsForPiece(res.index)
+			end := begin + len(res.buf)
+			select {
+			case t.ResultsChan <- LoadedPiece{Data: res.buf, Len: int64(end-begin), StartByte: int64(begin)}:
+			case <- ctx.Done():
+				logrus.Debugf("Got DONE in Download, exiting")
+				return nil
+			}
 			db.GetFilesManagerDb().SaveFilePart(t.FileId, res.buf, int64(begin), int64(end-begin), int64(res.index))
 			//db.GetLoadedStateDb().AnnounceLoadedPart(t.FileId, fmt.Sprint(res.index), int64(begin), int64(end-begin))
 			//db.GetLoadedStateDb().SaveLoadedPartInfo(t.FileId, fmt.Sprint(res.index), int64(begin), int64(end-begin))
-			donePieces++
+			t.Stats.Loaded(len(res.buf))
+			t.Picker.MarkDone(res.index)
+			t.choker.broadcastHave(res.index)
 
-			percent := float64(donePieces) / float64(len(t.PieceHashes)) * 100
-			logrus.Infof("(%0.2f%%) Downloaded piece idx=%d from %v peers\n", percent, res.index, "n=unknown")
+			percent := float64(numPieces - t.Picker.Left()) / float64(numPieces) * 100
+			logrus.Infof("(%0.2f%%) Downloaded piece idx=%d from %v peers\n", percent, res.index, t.ConnectedPeers())
+			publishProgress(t.Progress())
 		}
 	}
+	publishProgress(t.Progress())
 	return nil
 }
\ No newline at end of file
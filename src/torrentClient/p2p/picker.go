@@ -0,0 +1,279 @@
+package p2p
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"torrentClient/bitfield"
+)
+
+const (
+	PriorityNormal = 0
+	// PriorityReadahead is given to pieces right after the playback position
+	PriorityReadahead = 1
+	// PriorityHigh is given to pieces somebody is waiting for right now
+	PriorityHigh = 2
+
+	// readaheadBytes is how much data after the playback position is prioritized
+	readaheadBytes = 16 * 1024 * 1024
+)
+
+var activeDownloadsMu sync.Mutex
+var activeDownloads = make(map[string]*TorrentMeta)
+
+// GetActiveDownload returns the download of the file if it is running
+func GetActiveDownload(fileId string) (*TorrentMeta, bool) {
+	activeDownloadsMu.Lock()
+	defer activeDownloadsMu.Unlock()
+	t, ok := activeDownloads[fileId]
+	return t, ok
+}
+
+func registerDownload(t *TorrentMeta) {
+	activeDownloadsMu.Lock()
+	defer activeDownloadsMu.Unlock()
+	activeDownloads[t.FileId] = t
+}
+
+func unregisterDownload(t *TorrentMeta) {
+	activeDownloadsMu.Lock()
+	defer activeDownloadsMu.Unlock()
+	if activeDownloads[t.FileId] == t {
+		delete(activeDownloads, t.FileId)
+	}
+}
+
+// NewPicker creates a picker of numPieces pieces, readahead is the number
+// of pieces after the playback position which go before the rest
+func NewPicker(numPieces int, strategy Strategy, readahead int) *Picker {
+	if strategy == nil {
+		strategy = SequentialStrategy{}
+	}
+	if readahead < 1 {
+		readahead = 1
+	}
+	p := &Picker{
+		strategy: strategy,
+		state: PickState{
+			NumPieces:    numPieces,
+			Availability: make([]int, numPieces),
+			Deadlines:    make([]time.Time, numPieces),
+		},
+		priorities: make([]int, numPieces),
+		done:       make([]bool, numPieces),
+		inProgress: make([]bool, numPieces),
+		left:       numPieces,
+		readahead:  readahead,
+		changed:    make(chan struct{}),
+	}
+	p.setReadahead(0)
+	return p
+}
+
+// TryNext returns a piece the peer has and marks it as in progress. ok is false
+// if there is none or every piece is loaded
+func (p *Picker) TryNext(has func(index int) bool) (index int, ok bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.left == 0 {
+		return -1, false
+	}
+	index = p.pick(has)
+	return index, index >= 0
+}
+
+// Changed returns a channel which is closed on the next change of the picker
+func (p *Picker) Changed() <-chan struct{} {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.changed
+}
+
+// Unstarted returns the number of pieces nobody downloads yet
+func (p *Picker) Unstarted() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	res := 0
+	for i := 0; i < p.state.NumPieces; i++ {
+		if !p.done[i] && !p.inProgress[i] {
+			res++
+		}
+	}
+	return res
+}
+
+func (p *Picker) pick(has func(index int) bool) int {
+	best := -1
+	for i := 0; i < p.state.NumPieces; i++ {
+		if p.done[i] || p.inProgress[i] || !has(i) {
+			continue
+		}
+		if best < 0 || p.better(i, best) {
+			best = i
+		}
+	}
+	if best >= 0 {
+		p.inProgress[best] = true
+	}
+	return best
+}
+
+func (p *Picker) better(a, b int) bool {
+	if p.priorities[a] != p.priorities[b] {
+		return p.priorities[a] > p.priorities[b]
+	}
+	return p.strategy.Better(&p.state, a, b)
+}
+
+// Release puts a piece which failed to download back
+func (p *Picker) Release(index int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.valid(index) {
+		p.inProgress[index] = false
+		p.notify()
+	}
+}
+
+// MarkDone marks a piece as verified and saved
+func (p *Picker) MarkDone(index int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !p.valid(index) || p.done[index] {
+		return
+	}
+	p.done[index] = true
+	p.inProgress[index] = false
+	p.left--
+	p.notify()
+}
+
+func (p *Picker) IsDone(index int) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.valid(index) && p.done[index]
+}
+
+// Bitfield returns verified pieces in the form they are advertised to peers
+func (p *Picker) Bitfield() bitfield.Bitfield {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	bf := bitfield.New(p.state.NumPieces)
+	for i, done := range p.done {
+		if done {
+			bf.SetPiece(i)
+		}
+	}
+	return bf
+}
+
+// Left returns the number of pieces not loaded yet
+func (p *Picker) Left() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.left
+}
+
+// AddPeer counts pieces of a connected peer in their availability
+func (p *Picker) AddPeer(bf bitfield.Bitfield) {
+	p.updateAvailability(bf, 1)
+}
+
+// RemovePeer forgets pieces of a disconnected peer
+func (p *Picker) RemovePeer(bf bitfield.Bitfield) {
+	p.updateAvailability(bf, -1)
+}
+
+func (p *Picker) updateAvailability(bf bitfield.Bitfield, delta int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for i := 0; i < p.state.NumPieces; i++ {
+		if bf.HasPiece(i) {
+			p.state.Availability[i] += delta
+		}
+	}
+	p.notify()
+}
+
+// PeerHave counts a piece a connected peer has just got
+func (p *Picker) PeerHave(index int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.valid(index) {
+		p.state.Availability[index]++
+		p.notify()
+	}
+}
+
+// SetPlayback moves the playback position to the piece. Priorities and
+// deadlines given before are dropped, the viewer isn't there anymore
+func (p *Picker) SetPlayback(index int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !p.valid(index) {
+		return
+	}
+	for i := range p.priorities {
+		p.priorities[i] = PriorityNormal
+		p.state.Deadlines[i] = time.Time{}
+	}
+	p.setReadahead(index)
+	p.notify()
+}
+
+func (p *Picker) setReadahead(index int) {
+	p.state.Playback = index
+	p.readaheadEnd = index + p.readahead
+	if p.readaheadEnd > p.state.NumPieces {
+		p.readaheadEnd = p.state.NumPieces
+	}
+	for i := index; i < p.readaheadEnd; i++ {
+		if p.priorities[i] < PriorityReadahead {
+			p.priorities[i] = PriorityReadahead
+		}
+	}
+}
+
+// Prioritize raises pieces first..last (inclusive) above everything else.
+// A non-zero deadline tells deadline aware strategies when they are needed
+func (p *Picker) Prioritize(first, last int, deadline time.Time) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !p.valid(first) || !p.valid(last) || first > last {
+		return fmt.Errorf("invalid pieces range %v-%v of %v", first, last, p.state.NumPieces)
+	}
+	for i := first; i <= last; i++ {
+		p.priorities[i] = PriorityHigh
+		current := p.state.Deadlines[i]
+		if !deadline.IsZero() && (current.IsZero() || deadline.Before(current)) {
+			p.state.Deadlines[i] = deadline
+		}
+	}
+	p.notify()
+	return nil
+}
+
+func (p *Picker) valid(index int) bool {
+	return index >= 0 && index < p.state.NumPieces
+}
+
+func (p *Picker) notify() {
+	close(p.changed)
+	p.changed = make(chan struct{})
+}
+
+// PrioritizeBytes moves the playback position to start and raises pieces
+// holding bytes start..end (inclusive, offsets in the whole torrent)
+func (t *TorrentMeta) PrioritizeBytes(start, end int64, deadline time.Time) error {
+	if t.Picker == nil {
+		return fmt.Errorf("download of %v isn't started", t.FileId)
+	}
+	if start < 0 || end < start || end >= int64(t.Length) {
+		return fmt.Errorf("invalid bytes range %v-%v of %v", start, end, t.Length)
+	}
+	first := int(start / int64(t.PieceLength))
+	last := int(end / int64(t.PieceLength))
+	t.Picker.SetPlayback(first)
+	return t.Picker.Prioritize(first, last, deadline)
+}
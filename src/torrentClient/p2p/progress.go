@@ -0,0 +1,147 @@
+package p2p
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// progressInterval is how often progress is published between loaded pieces
+const progressInterval = time.Second
+
+var progressMu sync.Mutex
+var progressSubscribers = make(map[string]map[chan Progress]struct{})
+
+// SubscribeProgress returns progress events of the file's downloads, the
+// subscription outlives pauses and restarts of the download. A slow reader
+// only gets the latest event. cancel ends the subscription
+func SubscribeProgress(fileId string) (events <-chan Progress, cancel func()) {
+	ch := make(chan Progress, 1)
+
+	progressMu.Lock()
+	defer progressMu.Unlock()
+	if progressSubscribers[fileId] == nil {
+		progressSubscribers[fileId] = make(map[chan Progress]struct{})
+	}
+	progressSubscribers[fileId][ch] = struct{}{}
+
+	return ch, func() {
+		progressMu.Lock()
+		defer progressMu.Unlock()
+		delete(progressSubscribers[fileId], ch)
+		if len(progressSubscribers[fileId]) == 0 {
+			delete(progressSubscribers, fileId)
+		}
+	}
+}
+
+func publishProgress(p Progress) {
+	progressMu.Lock()
+	defer progressMu.Unlock()
+	for ch := range progressSubscribers[p.FileId] {
+		// Drop the event the subscriber hasn't read yet, it's stale
+		select {
+		case <-ch:
+		default:
+		}
+		ch <- p
+	}
+}
+
+// Progress returns a snapshot of the download of the served file
+func (t *TorrentMeta) Progress() Progress {
+	offset, length := t.servedFile()
+	p := Progress{
+		FileId: t.FileId,
+		Length: int64(length),
+		Peers:  t.ConnectedPeers(),
+	}
+	if t.Picker != nil {
+		p.Ranges = t.loadedRanges(offset, length)
+		for _, r := range p.Ranges {
+			p.Loaded += r.End - r.Start
+		}
+		p.Done = p.Loaded == p.Length
+	}
+	if p.Length > 0 {
+		p.Percent = float64(p.Loaded) / float64(p.Length) * 100
+	}
+
+	t.rates.mu.Lock()
+	p.DownloadRate = int64(t.rates.download)
+	p.UploadRate = int64(t.rates.upload)
+	t.rates.mu.Unlock()
+	return p
+}
+
+// servedFile returns where the file storage serves lies in the torrent
+func (t *TorrentMeta) servedFile() (offset, length int) {
+	if t.FileLength == 0 {
+		return 0, t.Length
+	}
+	return t.FileOffset, t.FileLength
+}
+
+// loadedRanges merges runs of loaded pieces into byte ranges of the file
+// at offset in the torrent, ranges start from the file's start
+func (t *TorrentMeta) loadedRanges(offset, length int) []ByteRange {
+	bf := t.Picker.Bitfield()
+	ranges := []ByteRange{}
+	if length <= 0 {
+		return ranges
+	}
+	first, last := offset/t.PieceLength, (offset+length-1)/t.PieceLength
+	for index := first; index <= last && index < t.piecesCount(); index++ {
+		if !bf.HasPiece(index) {
+			continue
+		}
+		begin, end := t.calculateBoundsForPiece(index)
+		if begin < offset {
+			begin = offset
+		}
+		if end > offset+length {
+			end = offset + length
+		}
+		start, stop := int64(begin-offset), int64(end-offset)
+		if n := len(ranges) - 1; n >= 0 && ranges[n].End == start {
+			ranges[n].End = stop
+			continue
+		}
+		ranges = append(ranges, ByteRange{Start: start, End: stop})
+	}
+	return ranges
+}
+
+// reportProgress measures the rates and publishes progress every
+// progressInterval until ctx is done
+func (t *TorrentMeta) reportProgress(ctx context.Context) {
+	ticker := time.NewTicker(progressInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			t.measureRates()
+			publishProgress(t.Progress())
+		}
+	}
+}
+
+func (t *TorrentMeta) measureRates() {
+	m := &t.rates
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	downloaded, uploaded := t.Stats.Downloaded(), t.Stats.Uploaded()
+	if !m.last.IsZero() {
+		elapsed := now.Sub(m.last).Seconds()
+		download := float64(downloaded-m.downloaded) / elapsed
+		upload := float64(uploaded-m.uploaded) / elapsed
+		m.download = m.download*0.7 + download*0.3
+		m.upload = m.upload*0.7 + upload*0.3
+	}
+	m.last = now
+	m.downloaded, m.uploaded = downloaded, uploaded
+}
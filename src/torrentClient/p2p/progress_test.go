@@ -0,0 +1,41 @@
+package p2p
+
+import (
+	"reflect"
+	"testing"
+)
+
+// TestProgressOfServedFile reports progress of the second of two files,
+// pieces are 10 bytes and the file takes bytes 15..50 of the torrent
+func TestProgressOfServedFile(t *testing.T) {
+	tm := &TorrentMeta{
+		FileId:      "two-files",
+		PieceHashes: make([][20]byte, 5),
+		PieceLength: 10,
+		Length:      50,
+		FileOffset:  15,
+		FileLength:  35,
+	}
+	tm.Picker = NewPicker(5, nil, 1)
+	for _, index := range []int{0, 1, 3} {
+		tm.Picker.MarkDone(index)
+	}
+
+	p := tm.Progress()
+	want := []ByteRange{{Start: 0, End: 5}, {Start: 15, End: 25}}
+	if !reflect.DeepEqual(p.Ranges, want) {
+		t.Errorf("got ranges %+v, want %+v", p.Ranges, want)
+	}
+	if p.Length != 35 || p.Loaded != 15 || p.Done {
+		t.Errorf("got length %v, loaded %v and done %v, want 35, 15 and false", p.Length, p.Loaded, p.Done)
+	}
+
+	// The first file's piece doesn't count
+	tm.Picker.MarkDone(2)
+	tm.Picker.MarkDone(4)
+	p = tm.Progress()
+	want = []ByteRange{{Start: 0, End: 35}}
+	if !reflect.DeepEqual(p.Ranges, want) || p.Loaded != 35 || p.Percent != 100 || !p.Done {
+		t.Errorf("got %+v, want the whole file loaded", p)
+	}
+}
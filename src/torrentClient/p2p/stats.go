@@ -0,0 +1,36 @@
+package p2p
+
+import "sync/atomic"
+
+// NewTransferStats creates stats of a download with left bytes to load
+func NewTransferStats(left int) *TransferStats {
+	return &TransferStats{left: int64(left)}
+}
+
+func (s *TransferStats) AddDownloaded(n int) {
+	atomic.AddInt64(&s.downloaded, int64(n))
+}
+
+func (s *TransferStats) AddUploaded(n int) {
+	atomic.AddInt64(&s.uploaded, int64(n))
+}
+
+// Loaded marks n bytes as verified and saved, they are no more left
+func (s *TransferStats) Loaded(n int) {
+	atomic.AddInt64(&s.left, -int64(n))
+}
+
+func (s *TransferStats) Downloaded() int64 {
+	return atomic.LoadInt64(&s.downloaded)
+}
+
+func (s *TransferStats) Uploaded() int64 {
+	return atomic.LoadInt64(&s.uploaded)
+}
+
+func (s *TransferStats) Left() int64 {
+	if left := atomic.LoadInt64(&s.left); left > 0 {
+		return left
+	}
+	return 0
+}
@@ -0,0 +1,71 @@
+package p2p
+
+// SequentialStrategy downloads pieces in order starting from the playback
+// position, pieces before it go last
+type SequentialStrategy struct{}
+
+// RarestFirstStrategy downloads pieces fewer connected peers have first,
+// keeping the swarm healthy. Equally rare pieces go in order
+type RarestFirstStrategy struct{}
+
+// DeadlineStrategy downloads pieces with the earliest deadline first,
+// pieces without deadlines go in order after them
+type DeadlineStrategy struct{}
+
+// NewStrategy returns a strategy by its name: sequential, rarest or deadline.
+// Unknown names give the sequential one, it suits streaming best
+func NewStrategy(name string) Strategy {
+	switch name {
+	case RarestFirstStrategy{}.Name():
+		return RarestFirstStrategy{}
+	case DeadlineStrategy{}.Name():
+		return DeadlineStrategy{}
+	default:
+		return SequentialStrategy{}
+	}
+}
+
+func (SequentialStrategy) Name() string {
+	return "sequential"
+}
+
+func (SequentialStrategy) Better(state *PickState, a, b int) bool {
+	return playbackDistance(state, a) < playbackDistance(state, b)
+}
+
+func (RarestFirstStrategy) Name() string {
+	return "rarest"
+}
+
+func (RarestFirstStrategy) Better(state *PickState, a, b int) bool {
+	if state.Availability[a] != state.Availability[b] {
+		return state.Availability[a] < state.Availability[b]
+	}
+	return playbackDistance(state, a) < playbackDistance(state, b)
+}
+
+func (DeadlineStrategy) Name() string {
+	return "deadline"
+}
+
+func (DeadlineStrategy) Better(state *PickState, a, b int) bool {
+	deadlineA, deadlineB := state.Deadlines[a], state.Deadlines[b]
+	switch {
+	case !deadlineA.IsZero() && !deadlineB.IsZero() && !deadlineA.Equal(deadlineB):
+		return deadlineA.Before(deadlineB)
+	case !deadlineA.IsZero() && deadlineB.IsZero():
+		return true
+	case deadlineA.IsZero() && !deadlineB.IsZero():
+		return false
+	}
+	return playbackDistance(state, a) < playbackDistance(state, b)
+}
+
+// playbackDistance is how far the piece is ahead of the playback position,
+// pieces behind it are counted as if they follow the last piece
+func playbackDistance(state *PickState, index int) int {
+	if index >= state.Playback {
+		return index - state.Playback
+	}
+	return index - state.Playback + state.NumPieces
+}
@@ -0,0 +1,210 @@
+package p2p
+
+import (
+	"context"
+	"fmt"
+
+	"torrentClient/message"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// maxRequestLength is the largest block a peer may request, bigger requests are ignored
+	maxRequestLength = 128 * 1024
+	// allowedFastCount is how many pieces a peer may request while we choke it (BEP 6)
+	allowedFastCount = 10
+)
+
+func newUploader() *uploader {
+	return &uploader{
+		wake:        make(chan struct{}, 1),
+		cachedIndex: -1,
+	}
+}
+
+func (u *uploader) push(req blockRequest) {
+	u.mu.Lock()
+	if len(u.pending) < MaxQueue {
+		u.pending = append(u.pending, req)
+	}
+	u.mu.Unlock()
+
+	select {
+	case u.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (u *uploader) pop() (blockRequest, bool) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if len(u.pending) == 0 {
+		return blockRequest{}, false
+	}
+	req := u.pending[0]
+	u.pending = u.pending[1:]
+	return req, true
+}
+
+func (u *uploader) cancel(req blockRequest) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	for i, pending := range u.pending {
+		if pending == req {
+			u.pending = append(u.pending[:i], u.pending[i+1:]...)
+			return
+		}
+	}
+}
+
+// clear drops pending requests but the ones keep accepts and returns the
+// dropped ones, a choked peer has to request them again
+func (u *uploader) clear(keep func(req blockRequest) bool) []blockRequest {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	var kept, dropped []blockRequest
+	for _, req := range u.pending {
+		if keep(req) {
+			kept = append(kept, req)
+		} else {
+			dropped = append(dropped, req)
+		}
+	}
+	u.pending = kept
+	return dropped
+}
+
+// sendAllowedFast lets a peer which supports the Fast Extension request
+// some pieces while we choke it
+func (w *peerWorker) sendAllowedFast() error {
+	if !w.c.SupportsFast() {
+		return nil
+	}
+	set := message.AllowedFastSet(allowedFastCount, w.t.piecesCount(), w.t.InfoHash, w.c.GetPeer().IP)
+	w.allowedFast = make(map[int]bool, len(set))
+	for _, index := range set {
+		if err := w.c.SendAllowedFast(index); err != nil {
+			return err
+		}
+		w.allowedFast[index] = true
+	}
+	return nil
+}
+
+// mayUpload reports whether the peer may get blocks of the piece now
+func (w *peerWorker) mayUpload(index int) bool {
+	return !w.c.IsChoking() || w.allowedFast[index]
+}
+
+// reject tells a peer which supports the Fast Extension its request won't be
+// answered, other peers just don't get an answer
+func (w *peerWorker) reject(req blockRequest) {
+	if !w.c.SupportsFast() {
+		return
+	}
+	if err := w.c.SendReject(req.index, req.begin, req.length); err != nil {
+		logrus.Debugf("Error sending reject to %v: %v", w.c.GetShortInfo(), err)
+	}
+}
+
+// queueUpload queues a block the peer requests. Requests of pieces we don't
+// have or sent while the peer is choked are rejected
+func (w *peerWorker) queueUpload(msg *message.Message) error {
+	index, begin, length, err := message.ParseRequest(msg)
+	if err != nil {
+		return err
+	}
+	req := blockRequest{index: index, begin: begin, length: length}
+	if w.t.Storage == nil || !w.mayUpload(index) {
+		w.reject(req)
+		return nil
+	}
+	if length <= 0 || length > maxRequestLength || begin < 0 || !w.t.Picker.IsDone(index) ||
+		begin+length > w.t.calculatePieceSize(index) {
+		logrus.Debugf("Ignoring request %v:%v+%v from %v", index, begin, length, w.c.GetShortInfo())
+		w.reject(req)
+		return nil
+	}
+	w.uploads.push(req)
+	return nil
+}
+
+func (w *peerWorker) cancelUpload(msg *message.Message) error {
+	index, begin, length, err := message.ParseRequest(msg)
+	if err != nil {
+		return err
+	}
+	w.uploads.cancel(blockRequest{index: index, begin: begin, length: length})
+	return nil
+}
+
+// chokePeer stops uploading to the peer but allowed fast pieces
+func (w *peerWorker) chokePeer() {
+	if err := w.c.SendChoke(); err != nil {
+		return
+	}
+	dropped := w.uploads.clear(func(req blockRequest) bool {
+		return w.allowedFast[req.index]
+	})
+	for _, req := range dropped {
+		w.reject(req)
+	}
+}
+
+// serveUploads sends requested blocks until the connection is closed
+func (w *peerWorker) serveUploads(ctx context.Context) {
+	for {
+		req, ok := w.uploads.pop()
+		if !ok {
+			select {
+			case <-ctx.Done():
+				return
+			case <-w.c.Done():
+				return
+			case <-w.uploads.wake:
+			}
+			continue
+		}
+		if !w.mayUpload(req.index) {
+			w.reject(req)
+			continue
+		}
+
+		data, err := w.readBlock(req)
+		if err != nil {
+			logrus.Debugf("Can't upload %v:%v to %v: %v", req.index, req.begin, w.c.GetShortInfo(), err)
+			w.reject(req)
+			continue
+		}
+		if err := w.c.SendPiece(req.index, req.begin, data); err != nil {
+			logrus.Debugf("Error sending piece to %v: %v", w.c.GetShortInfo(), err)
+			return
+		}
+		w.t.Stats.AddUploaded(len(data))
+	}
+}
+
+// readBlock reads the block from storage. The whole piece is read and checked
+// first: the writer saves pieces asynchronously, so a piece may be verified
+// before it is on disk. Only serveUploads uses the cached piece
+func (w *peerWorker) readBlock(req blockRequest) ([]byte, error) {
+	u := w.uploads
+	if u.cachedIndex != req.index {
+		pw := w.t.newPieceWork(req.index)
+		buf := make([]byte, pw.length)
+		begin, _ := w.t.calculateBoundsForPiece(req.index)
+		if _, err := w.t.Storage.ReadAt(buf, int64(begin)); err != nil {
+			return nil, fmt.Errorf("read error: %v", err)
+		}
+		if err := w.t.checkIntegrity(pw, buf); err != nil {
+			return nil, fmt.Errorf("piece isn't on disk yet: %v", err)
+		}
+		u.cachedIndex = req.index
+		u.cachedBuf = buf
+	}
+	if req.begin+req.length > len(u.cachedBuf) {
+		return nil, fmt.Errorf("block is out of piece bounds")
+	}
+	return u.cachedBuf[req.begin : req.begin+req.length], nil
+}
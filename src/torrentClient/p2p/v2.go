@@ -0,0 +1,154 @@
+package p2p
+
+import (
+	"fmt"
+	"time"
+
+	"torrentClient/client"
+	"torrentClient/merkle"
+	"torrentClient/message"
+
+	"github.com/sirupsen/logrus"
+)
+
+func (t *TorrentMeta) checkIntegrityV2(pw *pieceWork, buf []byte) error {
+	t.v2Mu.Lock()
+	expected := *pw.hashV2
+	t.v2Mu.Unlock()
+
+	if !expected.Known {
+		return fmt.Errorf("index %d has no v2 hash to check against", pw.index)
+	}
+	if len(buf) < expected.DataLength {
+		return fmt.Errorf("index %d is shorter than its data length", pw.index)
+	}
+	root, err := merkle.PieceRoot(buf[:expected.DataLength], expected.Leaves)
+	if err != nil {
+		return err
+	}
+	if root != expected.Root {
+		return fmt.Errorf("index %d failed v2 integrity check", pw.index)
+	}
+	return nil
+}
+
+// isPieceHashKnown reports whether the piece can be verified without asking peers for hashes.
+// SHA-1 hashes of hybrid torrents are enough, v1 peers can't send piece layers
+func (t *TorrentMeta) isPieceHashKnown(pw *pieceWork) bool {
+	if pw.hashV2 == nil || len(t.PieceHashes) > 0 {
+		return true
+	}
+	return t.isHashV2Known(pw)
+}
+
+func (t *TorrentMeta) isHashV2Known(pw *pieceWork) bool {
+	t.v2Mu.Lock()
+	defer t.v2Mu.Unlock()
+	return pw.hashV2.Known
+}
+
+// hashesTimeout is how long a peer may take to answer a hash request
+const hashesTimeout = 30 * time.Second
+
+// ensurePieceHashV2 requests the piece layer of the piece's file from the peer
+// if the torrent came without it (e.g. was resolved from a magnet link).
+// Other messages received meanwhile are passed to handle
+func (t *TorrentMeta) ensurePieceHashV2(c *client.Client, pw *pieceWork, handle func(msg *message.Message) error) error {
+	if pw.hashV2 == nil {
+		return nil
+	}
+	t.v2Mu.Lock()
+	piece := *pw.hashV2
+	t.v2Mu.Unlock()
+	if piece.Known {
+		return nil
+	}
+
+	length := merkle.NextPowerOfTwo(piece.FilePieces)
+	if length > message.MaxHashes {
+		return fmt.Errorf("piece layer of %v pieces is too long to request", piece.FilePieces)
+	}
+	req := message.HashRequest{
+		PiecesRoot:  piece.PiecesRoot,
+		BaseLayer:   merkle.Log2(t.PieceLength / merkle.BlockSize),
+		Index:       0,
+		Length:      length,
+		ProofLayers: 0,
+	}
+	if _, err := c.Conn.Write(message.FormatHashRequest(req).Serialize()); err != nil {
+		return err
+	}
+
+	timer := time.NewTimer(hashesTimeout)
+	defer timer.Stop()
+	messages := c.Messages()
+	for {
+		var msg *message.Message
+		select {
+		case <-timer.C:
+			return fmt.Errorf("peer %v didn't send hashes in %v", c.GetShortInfo(), hashesTimeout)
+		case received, ok := <-messages:
+			if !ok {
+				return c.Err()
+			}
+			msg = received
+		}
+
+		switch msg.ID {
+		case message.MsgHashes:
+			resp, hashes, err := message.ParseHashes(msg)
+			if err != nil {
+				return err
+			}
+			if resp.PiecesRoot != req.PiecesRoot || resp.BaseLayer != req.BaseLayer || resp.Index != req.Index {
+				continue
+			}
+			if resp.Length != req.Length {
+				return fmt.Errorf("peer %v sent %d hashes of the piece layer, %d were requested",
+					c.GetShortInfo(), resp.Length, req.Length)
+			}
+			return t.savePieceLayer(piece, hashes[:resp.Length])
+		case message.MsgHashReject:
+			resp, err := message.ParseHashRequest(msg)
+			if err != nil {
+				return err
+			}
+			if resp.PiecesRoot == req.PiecesRoot {
+				return fmt.Errorf("peer %v rejected hash request", c.GetShortInfo())
+			}
+		default:
+			if err := handle(msg); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// savePieceLayer checks the layer against the pieces root and saves the
+// hashes of the file's pieces. The layer must cover every piece of the file
+func (t *TorrentMeta) savePieceLayer(piece PieceHashV2, layer [][32]byte) error {
+	if len(layer) < piece.FilePieces {
+		return fmt.Errorf("piece layer has %d hashes, the file has %d pieces", len(layer), piece.FilePieces)
+	}
+	hashes := make([]merkle.Hash, len(layer))
+	for i := range layer {
+		hashes[i] = layer[i]
+	}
+	pad := merkle.PadHash(merkle.Log2(t.PieceLength / merkle.BlockSize))
+	root, err := merkle.Root(hashes, len(hashes), pad)
+	if err != nil {
+		return err
+	}
+	if root != piece.PiecesRoot {
+		return fmt.Errorf("received piece layer doesn't match pieces root")
+	}
+
+	t.v2Mu.Lock()
+	defer t.v2Mu.Unlock()
+	for k := 0; k < piece.FilePieces; k++ {
+		t.PieceHashesV2[piece.FirstPiece+k].Root = hashes[k]
+		t.PieceHashesV2[piece.FirstPiece+k].Known = true
+	}
+	logrus.Infof("Got piece layer for %x (%v pieces)", piece.PiecesRoot, piece.FilePieces)
+	return nil
+}
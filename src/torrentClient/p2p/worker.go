@@ -0,0 +1,261 @@
+package p2p
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"torrentClient/message"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// queueLatency is how much time of the peer's throughput its request queue covers
+	queueLatency = 2 * time.Second
+	// rateWindow is how often the peer's throughput is measured
+	rateWindow = time.Second
+	// requestTimeout is how long a request may stay unanswered before the peer is dropped
+	requestTimeout = 30 * time.Second
+	// checkInterval is how often request timeouts are checked
+	checkInterval = time.Second
+)
+
+// run keeps requests to the peer going. Messages come from the client's
+// reader goroutine, so the worker just waits while the peer has nothing useful
+func (w *peerWorker) run(ctx context.Context) error {
+	ticker := time.NewTicker(checkInterval)
+	defer ticker.Stop()
+	messages := w.c.Messages()
+
+	for w.t.Picker.Left() > 0 {
+		if !w.c.IsChoked() || w.c.HasAllowedFast() {
+			if err := w.fillQueue(ctx); err != nil {
+				return err
+			}
+		}
+
+		// Picker changes may give the peer something to do only if its queue has room
+		var changed <-chan struct{}
+		if len(w.outstanding) < w.queueSize {
+			changed = w.t.Picker.Changed()
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case msg, ok := <-messages:
+			if !ok {
+				return w.c.Err()
+			}
+			if err := w.handle(ctx, msg); err != nil {
+				return err
+			}
+		case <-changed:
+		case <-ticker.C:
+		}
+	}
+	return nil
+}
+
+// fillQueue sends requests until the peer's queue is full or there is nothing to ask it for
+func (w *peerWorker) fillQueue(ctx context.Context) error {
+	if err := w.pruneOutstanding(); err != nil {
+		return err
+	}
+	for len(w.outstanding) < w.queueSize {
+		req, ok, err := w.nextRequest(ctx)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return nil
+		}
+		if err := w.c.SendRequest(req.index, req.begin, req.length); err != nil {
+			w.sched.unassign(w.c, []blockRequest{req})
+			return err
+		}
+		w.outstanding[req] = time.Now()
+	}
+	return nil
+}
+
+// nextRequest takes a block of a piece in progress, starts a new piece if there
+// is none and duplicates blocks requested from other peers in endgame
+func (w *peerWorker) nextRequest(ctx context.Context) (blockRequest, bool, error) {
+	if req, ok := w.sched.next(w.c, false); ok {
+		return req, true, nil
+	}
+
+	index, ok := w.t.Picker.TryNext(w.c.CanRequest)
+	if !ok {
+		// Every piece is taken, help with the last blocks
+		req, ok := w.sched.next(w.c, w.t.Picker.Unstarted() == 0)
+		return req, ok, nil
+	}
+
+	pw := w.t.newPieceWork(index)
+	if !w.t.isPieceHashKnown(pw) {
+		handle := func(msg *message.Message) error {
+			return w.handle(ctx, msg)
+		}
+		if err := w.t.ensurePieceHashV2(w.c, pw, handle); err != nil {
+			w.t.Picker.Release(index)
+			return blockRequest{}, false, fmt.Errorf("hashes error: %v", err)
+		}
+	}
+	w.sched.activate(pw)
+	req, ok := w.sched.next(w.c, false)
+	return req, ok, nil
+}
+
+// pruneOutstanding forgets requests of blocks other peers have delivered
+func (w *peerWorker) pruneOutstanding() error {
+	for req, sent := range w.outstanding {
+		if !w.sched.isWanted(req) {
+			delete(w.outstanding, req)
+			continue
+		}
+		if time.Since(sent) > requestTimeout {
+			return fmt.Errorf("peer didn't answer request %v:%v for %v", req.index, req.begin, requestTimeout)
+		}
+	}
+	return nil
+}
+
+// dropOutstanding gives blocks requested from the peer to other peers
+func (w *peerWorker) dropOutstanding() {
+	w.dropOutstandingIf(func(blockRequest) bool { return true })
+}
+
+// dropOutstandingIf gives requested blocks matching drop to other peers
+func (w *peerWorker) dropOutstandingIf(drop func(req blockRequest) bool) {
+	var reqs []blockRequest
+	for req := range w.outstanding {
+		if drop(req) {
+			reqs = append(reqs, req)
+			delete(w.outstanding, req)
+		}
+	}
+	w.sched.unassign(w.c, reqs)
+}
+
+// handle reacts to a message the reader goroutine has already applied to the client state
+func (w *peerWorker) handle(ctx context.Context, msg *message.Message) error {
+	switch msg.ID {
+	case message.MsgChoke:
+		// Choking peers discard requests they haven't answered. With the Fast
+		// Extension they reject them instead and keep allowed fast ones
+		if w.c.SupportsFast() {
+			w.dropOutstandingIf(func(req blockRequest) bool {
+				return !w.c.IsAllowedFast(req.index)
+			})
+		} else {
+			w.dropOutstanding()
+		}
+	case message.MsgUnchoke:
+		logrus.Infof("Got UNCHOKE from %v", w.c.GetShortInfo())
+	case message.MsgHave:
+		index, err := message.ParseHave(msg)
+		if err != nil {
+			return err
+		}
+		if !w.bitfield.HasPiece(index) {
+			w.bitfield.SetPiece(index)
+			if w.bitfield.HasPiece(index) {
+				w.t.Picker.PeerHave(index)
+			}
+		}
+	case message.MsgBitfield, message.MsgHaveAll, message.MsgHaveNone:
+		w.t.Picker.RemovePeer(w.bitfield)
+		w.bitfield = w.c.BitfieldCopy()
+		w.t.Picker.AddPeer(w.bitfield)
+	case message.MsgPiece:
+		return w.receiveBlock(ctx, msg)
+	case message.MsgInterested, message.MsgNotInterested:
+		w.t.choker.nudge()
+	case message.MsgRequest:
+		return w.queueUpload(msg)
+	case message.MsgCancel:
+		return w.cancelUpload(msg)
+	case message.MsgReject:
+		index, begin, length, err := message.ParseRequest(msg)
+		if err != nil {
+			return err
+		}
+		req := blockRequest{index: index, begin: begin, length: length}
+		w.dropOutstandingIf(func(outstanding blockRequest) bool { return outstanding == req })
+	case message.MsgSuggest:
+		// Suggestions are only hints, the picker's order is kept
+		logrus.Debugf("Got %v from %v", msg, w.c.GetShortInfo())
+	}
+	return nil
+}
+
+func (w *peerWorker) receiveBlock(ctx context.Context, msg *message.Message) error {
+	index, begin, data, err := message.ParseBlock(msg)
+	if err != nil {
+		return err
+	}
+	delete(w.outstanding, blockRequest{index: index, begin: begin, length: len(data)})
+	w.t.Stats.AddDownloaded(len(data))
+	w.updateRate(len(data))
+
+	cancel, completed, ok := w.sched.receive(w.c, index, begin, data)
+	if !ok {
+		return nil
+	}
+	for _, other := range cancel {
+		if err := other.SendCancel(index, begin, len(data)); err != nil {
+			logrus.Debugf("Error sending cancel to %v: %v", other.GetShortInfo(), err)
+		}
+	}
+	if completed == nil {
+		return nil
+	}
+
+	if err := w.t.checkIntegrity(completed.pw, completed.buf); err != nil {
+		logrus.Errorf("Check err: %v", err)
+		w.t.Picker.Release(index) // Put piece back
+		return nil
+	}
+	select {
+	case w.results <- &pieceResult{index, completed.buf}:
+	case <-ctx.Done():
+	}
+	return nil
+}
+
+// updateRate measures the peer's throughput and sizes its request queue
+// to cover queueLatency of it
+func (w *peerWorker) updateRate(n int) {
+	w.windowBytes += n
+	elapsed := time.Since(w.windowStart)
+	if elapsed < rateWindow {
+		return
+	}
+
+	current := float64(w.windowBytes) / elapsed.Seconds()
+	w.rateMu.Lock()
+	if w.rate == 0 {
+		w.rate = current
+	} else {
+		w.rate = w.rate*0.7 + current*0.3
+	}
+	rate := w.rate
+	w.rateMu.Unlock()
+	w.windowBytes = 0
+	w.windowStart = time.Now()
+
+	limit := MaxQueue
+	if hs := w.c.PeerExtendedHandshake(); hs != nil && hs.Reqq > 0 && hs.Reqq < limit {
+		limit = hs.Reqq
+	}
+	w.queueSize = int(rate*queueLatency.Seconds()) / MaxBlockSize
+	if w.queueSize < MaxBacklog {
+		w.queueSize = MaxBacklog
+	}
+	if w.queueSize > limit {
+		w.queueSize = limit
+	}
+}
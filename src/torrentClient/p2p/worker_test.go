@@ -0,0 +1,248 @@
+package p2p
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/binary"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"torrentClient/bitfield"
+	"torrentClient/client"
+	"torrentClient/message"
+)
+
+// fakeSeeder is the remote end of a net.Pipe having every piece. It answers
+// requests one by one after delay and counts what the worker asked for
+type fakeSeeder struct {
+	conn     net.Conn
+	data     []byte
+	pieceLen int
+	delay    time.Duration
+
+	mu          sync.Mutex
+	inFlight    int
+	maxInFlight int
+	served      int
+	cancels     int
+	cancelled   map[blockRequest]bool
+}
+
+func newFakeSeeder(t *testing.T, data []byte, pieceLen int, delay time.Duration) (*fakeSeeder, *client.Client) {
+	local, remote := net.Pipe()
+	t.Cleanup(func() {
+		local.Close()
+		remote.Close()
+	})
+	s := &fakeSeeder{conn: remote, data: data, pieceLen: pieceLen, delay: delay, cancelled: make(map[blockRequest]bool)}
+	go s.serve()
+
+	numPieces := (len(data) + pieceLen - 1) / pieceLen
+	bf := bitfield.New(numPieces)
+	for i := 0; i < numPieces; i++ {
+		bf.SetPiece(i)
+	}
+	return s, &client.Client{Conn: local, Choked: true, Bitfield: bf}
+}
+
+func (s *fakeSeeder) serve() {
+	requests := make(chan blockRequest, 1024)
+	defer close(requests)
+	go s.answer(requests)
+
+	for {
+		msg, err := message.Read(s.conn)
+		if err != nil {
+			return
+		}
+		if msg == nil {
+			continue
+		}
+		switch msg.ID {
+		case message.MsgRequest, message.MsgCancel:
+			index, begin, length, err := message.ParseRequest(msg)
+			if err != nil {
+				return
+			}
+			req := blockRequest{index: index, begin: begin, length: length}
+			s.mu.Lock()
+			if msg.ID == message.MsgCancel {
+				s.cancels++
+				s.cancelled[req] = true
+			} else {
+				s.inFlight++
+				if s.inFlight > s.maxInFlight {
+					s.maxInFlight = s.inFlight
+				}
+			}
+			s.mu.Unlock()
+			if msg.ID == message.MsgRequest {
+				requests <- req
+			}
+		}
+	}
+}
+
+func (s *fakeSeeder) answer(requests <-chan blockRequest) {
+	if _, err := s.conn.Write((&message.Message{ID: message.MsgUnchoke}).Serialize()); err != nil {
+		return
+	}
+	for req := range requests {
+		time.Sleep(s.delay)
+
+		s.mu.Lock()
+		s.inFlight--
+		skip := s.cancelled[req]
+		if !skip {
+			s.served++
+		}
+		s.mu.Unlock()
+		if skip {
+			continue
+		}
+
+		payload := make([]byte, 8+req.length)
+		binary.BigEndian.PutUint32(payload[0:4], uint32(req.index))
+		binary.BigEndian.PutUint32(payload[4:8], uint32(req.begin))
+		copy(payload[8:], s.data[req.index*s.pieceLen+req.begin:])
+		if _, err := s.conn.Write((&message.Message{ID: message.MsgPiece, Payload: payload}).Serialize()); err != nil {
+			return
+		}
+	}
+}
+
+func (s *fakeSeeder) stats() (maxInFlight, served, cancels int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.maxInFlight, s.served, s.cancels
+}
+
+// newWorkerTestTorrent makes a v1 torrent of random data with a short last piece
+func newWorkerTestTorrent(pieceLen, numPieces int) ([]byte, *TorrentMeta) {
+	data := make([]byte, pieceLen*numPieces-1000)
+	rand.Read(data)
+	hashes := make([][20]byte, numPieces)
+	for i := range hashes {
+		begin, end := i*pieceLen, (i+1)*pieceLen
+		if end > len(data) {
+			end = len(data)
+		}
+		hashes[i] = sha1.Sum(data[begin:end])
+	}
+
+	tm := &TorrentMeta{FileId: "worker-test", PieceHashes: hashes, PieceLength: pieceLen, Length: len(data)}
+	tm.Picker = NewPicker(numPieces, nil, 1)
+	tm.Stats = NewTransferStats(tm.Length)
+	tm.choker = newChoker()
+	return data, tm
+}
+
+// collectPieces waits for every piece of tm and returns the downloaded data
+func collectPieces(ctx context.Context, t *testing.T, tm *TorrentMeta, results chan *pieceResult) []byte {
+	got := make([]byte, tm.Length)
+	for tm.Picker.Left() > 0 {
+		select {
+		case res := <-results:
+			copy(got[res.index*tm.PieceLength:], res.buf)
+			tm.Picker.MarkDone(res.index)
+		case <-ctx.Done():
+			t.Fatalf("download stalled with %v pieces left", tm.Picker.Left())
+		}
+	}
+	return got
+}
+
+// TestWorkersSlowAndFastPeers downloads from a fast peer and a peer which
+// answers a block per second. Requests to the fast one must be pipelined,
+// and the last blocks the slow one holds must be taken over in endgame
+func TestWorkersSlowAndFastPeers(t *testing.T) {
+	const pieceLen = 4 * MaxBlockSize
+	const numPieces = 8
+	data, tm := newWorkerTestTorrent(pieceLen, numPieces)
+	sched := newBlockScheduler()
+	results := make(chan *pieceResult)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+
+	// The slow peer connects first and gets the first requests
+	slow, slowClient := newFakeSeeder(t, data, pieceLen, time.Second)
+	fast, fastClient := newFakeSeeder(t, data, pieceLen, 2*time.Millisecond)
+	workers := sync.WaitGroup{}
+	workers.Add(2)
+	go func() {
+		defer workers.Done()
+		tm.startDownloadWorker(ctx, slowClient, sched, results)
+	}()
+	time.Sleep(50 * time.Millisecond)
+	go func() {
+		defer workers.Done()
+		tm.startDownloadWorker(ctx, fastClient, sched, results)
+	}()
+
+	started := time.Now()
+	got := collectPieces(ctx, t, tm, results)
+	elapsed := time.Since(started)
+	cancel()
+	workers.Wait()
+
+	if !bytes.Equal(got, data) {
+		t.Fatal("downloaded data differs")
+	}
+
+	fastInFlight, fastServed, _ := fast.stats()
+	_, slowServed, slowCancels := slow.stats()
+	if fastInFlight < 2 {
+		t.Errorf("fast peer had at most %v requests in flight, want them pipelined", fastInFlight)
+	}
+	if slowCancels == 0 {
+		t.Error("no cancels were sent to the slow peer in endgame")
+	}
+	if fastServed <= slowServed {
+		t.Errorf("fast peer served %v blocks, slow peer %v", fastServed, slowServed)
+	}
+	// Waiting for the slow peer would take a second per block it was asked for
+	if elapsed > 2*time.Second {
+		t.Errorf("download took %v, endgame didn't take over the slow peer's blocks", elapsed)
+	}
+}
+
+// TestWorkerHybridWithoutPieceLayers downloads a hybrid torrent resolved from
+// a magnet link, with SHA-1 hashes but no piece layers, from a v1 peer which
+// never answers hash requests
+func TestWorkerHybridWithoutPieceLayers(t *testing.T) {
+	const pieceLen = 2 * MaxBlockSize
+	const numPieces = 4
+	data, tm := newWorkerTestTorrent(pieceLen, numPieces)
+	tm.PieceHashesV2 = make([]PieceHashV2, numPieces)
+	for i := range tm.PieceHashesV2 {
+		tm.PieceHashesV2[i] = PieceHashV2{
+			Leaves:     pieceLen / MaxBlockSize,
+			DataLength: tm.calculatePieceSize(i),
+			FilePieces: numPieces,
+		}
+	}
+	results := make(chan *pieceResult)
+
+	// A worker waiting for hashes would give up only after hashesTimeout
+	ctx, cancel := context.WithTimeout(context.Background(), hashesTimeout/3)
+	defer cancel()
+
+	_, c := newFakeSeeder(t, data, pieceLen, 0)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		tm.startDownloadWorker(ctx, c, newBlockScheduler(), results)
+	}()
+
+	got := collectPieces(ctx, t, tm, results)
+	cancel()
+	<-done
+	if !bytes.Equal(got, data) {
+		t.Fatal("downloaded data differs")
+	}
+}
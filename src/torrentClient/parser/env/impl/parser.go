@@ -3,7 +3,9 @@ package impl
 import (
 	"fmt"
 	"os"
+	"path/filepath"
 	"strconv"
+	"strings"
 
 	"github.com/sirupsen/logrus"
 )
@@ -49,3 +51,125 @@ func (p *Parser) GetPostgresDbDsn() string {
 		os.Getenv("POSTGRES_PASSWORD"),
 		os.Getenv("POSTGRES_DB"))
 }
+
+func (p *Parser) IsDhtEnabled() bool {
+	return os.Getenv("DHT_ENABLED") != "off"
+}
+
+func (p *Parser) GetDhtPort() uint16 {
+	port, err := strconv.ParseUint(os.Getenv("DHT_PORT"), 10, 16)
+	if err != nil {
+		return p.GetTorrentPeerPort()
+	}
+	return uint16(port)
+}
+
+func (p *Parser) GetDhtBootstrapNodes() []string {
+	nodes := os.Getenv("DHT_BOOTSTRAP_NODES")
+	if nodes == "" {
+		return []string{
+			"router.bittorrent.com:6881",
+			"router.utorrent.com:6881",
+			"dht.transmissionbt.com:6881",
+		}
+	}
+	return strings.Split(nodes, ",")
+}
+
+func (p *Parser) GetDhtNodesFile() string {
+	if path := os.Getenv("DHT_NODES_FILE"); path != "" {
+		return path
+	}
+	if p.GetFilesDir() == "" {
+		return ""
+	}
+	return filepath.Join(p.GetFilesDir(), "dht_nodes.dat")
+}
+
+// GetPeerFamilyPolicy tells which address families of peers to use:
+// balance (default), prefer4, prefer6, ipv4 or ipv6
+func (p *Parser) GetPeerFamilyPolicy() string {
+	switch policy := os.Getenv("PEER_ADDRESS_FAMILY"); policy {
+	case "prefer4", "prefer6", "ipv4", "ipv6":
+		return policy
+	default:
+		return "balance"
+	}
+}
+
+// GetPiecePickerStrategy is the order pieces are downloaded in:
+// sequential (default), rarest or deadline
+func (p *Parser) GetPiecePickerStrategy() string {
+	return os.Getenv("PIECE_PICKER")
+}
+
+// GetMaxPeersPerTorrent is the number of peers of a torrent above which
+// incoming connections are refused, 50 by default
+func (p *Parser) GetMaxPeersPerTorrent() int {
+	return positiveIntOrDefault("MAX_PEERS_PER_TORRENT", 50)
+}
+
+// GetMaxPeers is the number of peers of all torrents above which
+// new connections are refused, 200 by default
+func (p *Parser) GetMaxPeers() int {
+	return positiveIntOrDefault("MAX_PEERS", 200)
+}
+
+// GetMaxHalfOpen is the number of outgoing peer connections which may be
+// dialed at once, 20 by default
+func (p *Parser) GetMaxHalfOpen() int {
+	return positiveIntOrDefault("MAX_HALF_OPEN", 20)
+}
+
+// GetMaxActiveDownloads is the number of torrents downloaded at once,
+// the rest wait in the queue. 3 by default
+func (p *Parser) GetMaxActiveDownloads() int {
+	return positiveIntOrDefault("MAX_ACTIVE_DOWNLOADS", 3)
+}
+
+// GetDownloadRateLimit is how fast all torrents may download in bytes per
+// second, DOWNLOAD_RATE_LIMIT is in KiB per second. Unlimited by default
+func (p *Parser) GetDownloadRateLimit() int64 {
+	return int64(positiveIntOrDefault("DOWNLOAD_RATE_LIMIT", 0)) * 1024
+}
+
+// GetUploadRateLimit is how fast all torrents may upload in bytes per
+// second, UPLOAD_RATE_LIMIT is in KiB per second. Unlimited by default
+func (p *Parser) GetUploadRateLimit() int64 {
+	return int64(positiveIntOrDefault("UPLOAD_RATE_LIMIT", 0)) * 1024
+}
+
+// GetTorrentDownloadRateLimit is how fast a torrent may download unless it's
+// given a limit of its own, in KiB per second as well. Unlimited by default
+func (p *Parser) GetTorrentDownloadRateLimit() int64 {
+	return int64(positiveIntOrDefault("TORRENT_DOWNLOAD_RATE_LIMIT", 0)) * 1024
+}
+
+// GetTorrentUploadRateLimit is how fast a torrent may upload unless it's
+// given a limit of its own, in KiB per second as well. Unlimited by default
+func (p *Parser) GetTorrentUploadRateLimit() int64 {
+	return int64(positiveIntOrDefault("TORRENT_UPLOAD_RATE_LIMIT", 0)) * 1024
+}
+
+func positiveIntOrDefault(name string, def int) int {
+	value, err := strconv.Atoi(os.Getenv(name))
+	if err != nil || value <= 0 {
+		return def
+	}
+	return value
+}
+
+// GetEncryptionPolicy tells whether peer connections are encrypted:
+// prefer (default), require or disable
+func (p *Parser) GetEncryptionPolicy() string {
+	switch policy := os.Getenv("PEER_ENCRYPTION"); policy {
+	case "require", "disable":
+		return policy
+	default:
+		return "prefer"
+	}
+}
+
+func (p *Parser) IsUtpEnabled() bool {
+	return os.Getenv("UTP_ENABLED") != "off"
+}
@@ -16,6 +16,22 @@ type Parser interface {
 	GetFilesDir() string
 	GetPostgresDbDsn() string
 	GetTorrentPeerPort() uint16
+	IsDhtEnabled() bool
+	GetDhtPort() uint16
+	GetDhtBootstrapNodes() []string
+	GetDhtNodesFile() string
+	GetPeerFamilyPolicy() string
+	GetPiecePickerStrategy() string
+	GetMaxPeersPerTorrent() int
+	GetMaxPeers() int
+	GetMaxHalfOpen() int
+	GetMaxActiveDownloads() int
+	GetDownloadRateLimit() int64
+	GetUploadRateLimit() int64
+	GetTorrentDownloadRateLimit() int64
+	GetTorrentUploadRateLimit() int64
+	GetEncryptionPolicy() string
+	IsUtpEnabled() bool
 }
 
 func GetParser() Parser {
@@ -0,0 +1,35 @@
+package peerServer
+
+import (
+	"net"
+	"sync"
+
+	"torrentClient/client"
+	"torrentClient/mse"
+)
+
+// Torrent is an active download incoming peers are accepted for
+type Torrent struct {
+	// InfoHashes are the swarms of the torrent, both v1 and v2 ones of a hybrid torrent
+	InfoHashes [][20]byte
+	PeerID     [20]byte
+	// Clients gets accepted peers, the same channel outbound peers go to
+	Clients chan<- *client.Client
+	// Peers returns the number of peers the download is connected to
+	Peers func() int
+}
+
+// Server accepts peer connections on TORRENT_PEER_PORT
+type Server struct {
+	port          uint16
+	maxPeers      int
+	maxPerTorrent int
+	encryption    mse.Policy
+
+	mu sync.Mutex
+	// listeners are the TCP listener and the uTP socket
+	listeners []net.Listener
+	torrents  map[[20]byte]*Torrent
+	// handshaking counts connections which aren't given to a torrent yet
+	handshaking int
+}
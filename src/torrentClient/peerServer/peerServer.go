@@ -0,0 +1,207 @@
+package peerServer
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"torrentClient/client"
+	"torrentClient/mse"
+	"torrentClient/parser/env"
+	"torrentClient/utp"
+
+	"github.com/sirupsen/logrus"
+)
+
+// handOverTimeout is how long an accepted peer may wait for the torrent to take it
+const handOverTimeout = 5 * time.Second
+
+var syncOnce sync.Once
+var server *Server
+
+func GetServer() *Server {
+	syncOnce.Do(func() {
+		parser := env.GetParser()
+		server = &Server{
+			port:          parser.GetTorrentPeerPort(),
+			maxPeers:      parser.GetMaxPeers(),
+			maxPerTorrent: parser.GetMaxPeersPerTorrent(),
+			encryption:    mse.ParsePolicy(parser.GetEncryptionPolicy()),
+			torrents:      make(map[[20]byte]*Torrent),
+		}
+	})
+	return server
+}
+
+// Register makes the server accept peers of the torrent in any of its swarms
+func (s *Server) Register(t *Torrent) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, infoHash := range t.InfoHashes {
+		s.torrents[infoHash] = t
+	}
+}
+
+// Unregister stops accepting peers of a torrent given to Register
+func (s *Server) Unregister(t *Torrent) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, infoHash := range t.InfoHashes {
+		if s.torrents[infoHash] == t {
+			delete(s.torrents, infoHash)
+		}
+	}
+}
+
+// Start listens for peers over TCP and uTP until Stop is called
+func (s *Server) Start() {
+	listener, err := net.Listen("tcp", fmt.Sprintf(":%v", s.port))
+	if err != nil {
+		logrus.Errorf("Error listening for peers on port %v: %v", s.port, err)
+		return
+	}
+	s.mu.Lock()
+	s.listeners = append(s.listeners, listener)
+	s.mu.Unlock()
+
+	if socket := utp.GetSocket(); socket != nil {
+		s.mu.Lock()
+		s.listeners = append(s.listeners, socket)
+		s.mu.Unlock()
+		go s.serve(socket)
+	}
+	s.serve(listener)
+}
+
+func (s *Server) serve(listener net.Listener) {
+	logrus.Infof("Listening for peers on %v", listener.Addr())
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				logrus.Warnf("Temporary accept error: %v", err)
+				time.Sleep(100 * time.Millisecond)
+				continue
+			}
+			logrus.Infof("Stopped listening for peers on %v: %v", listener.Addr(), err)
+			return
+		}
+		go s.handle(conn)
+	}
+}
+
+func (s *Server) Stop() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, listener := range s.listeners {
+		listener.Close()
+	}
+	s.listeners = nil
+}
+
+func (s *Server) handle(conn net.Conn) {
+	if !s.startHandshake() {
+		logrus.Debugf("Too many peers, dropping connection from %v", conn.RemoteAddr())
+		conn.Close()
+		return
+	}
+	defer s.finishHandshake()
+
+	conn, err := s.negotiateEncryption(conn)
+	if err != nil {
+		logrus.Debugf("Rejected peer %v: %v", conn.RemoteAddr(), err)
+		conn.Close()
+		return
+	}
+
+	var torrent *Torrent
+	c, err := client.Accept(conn, func(infoHash [20]byte) ([20]byte, error) {
+		t, err := s.find(infoHash)
+		if err != nil {
+			return [20]byte{}, err
+		}
+		torrent = t
+		return t.PeerID, nil
+	})
+	if err != nil {
+		logrus.Debugf("Rejected peer %v: %v", conn.RemoteAddr(), err)
+		conn.Close()
+		return
+	}
+	logrus.Infof("Accepted peer %v for %x", conn.RemoteAddr(), c.InfoHash())
+
+	timer := time.NewTimer(handOverTimeout)
+	defer timer.Stop()
+	select {
+	case torrent.Clients <- c:
+	case <-timer.C:
+		logrus.Warnf("Torrent %x didn't take peer %v", c.InfoHash(), conn.RemoteAddr())
+		c.Close()
+	}
+}
+
+// negotiateEncryption answers the MSE handshake if the peer starts with it.
+// Plaintext and encrypted peers are let in as the policy says
+func (s *Server) negotiateEncryption(conn net.Conn) (net.Conn, error) {
+	prefixed, plaintext, err := mse.IsPlaintext(conn)
+	if err != nil {
+		return conn, err
+	}
+	if plaintext {
+		if s.encryption == mse.PolicyRequire {
+			return conn, fmt.Errorf("plaintext connections are not allowed")
+		}
+		return prefixed, nil
+	}
+	if s.encryption == mse.PolicyDisable {
+		return conn, fmt.Errorf("encrypted connections are not allowed")
+	}
+
+	encrypted, _, err := mse.Receive(prefixed, s.infoHashes(), s.encryption.Provide())
+	if err != nil {
+		return conn, fmt.Errorf("encryption error: %v", err)
+	}
+	return encrypted, nil
+}
+
+func (s *Server) infoHashes() [][20]byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	res := make([][20]byte, 0, len(s.torrents))
+	for infoHash := range s.torrents {
+		res = append(res, infoHash)
+	}
+	return res
+}
+
+// startHandshake counts a new connection if the global limit allows it
+func (s *Server) startHandshake() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if client.OpenConnections()+s.handshaking >= s.maxPeers {
+		return false
+	}
+	s.handshaking++
+	return true
+}
+
+func (s *Server) finishHandshake() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.handshaking--
+}
+
+// find returns the torrent of the infohash if it may take one more peer
+func (s *Server) find(infoHash [20]byte) (*Torrent, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t, ok := s.torrents[infoHash]
+	if !ok {
+		return nil, fmt.Errorf("unknown infohash %x", infoHash)
+	}
+	if t.Peers() >= s.maxPerTorrent {
+		return nil, fmt.Errorf("torrent %x has %v peers already", infoHash, s.maxPerTorrent)
+	}
+	return t, nil
+}
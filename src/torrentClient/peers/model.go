@@ -6,6 +6,53 @@ type Peer struct {
 	IP   net.IP
 	Port uint16
 	IsDead bool
+	Flags  Flags
+	Source Source
+	// InfoHash is the swarm the peer was found in, zero if it isn't known.
+	// Hybrid torrents have peers in both the v1 and the v2 swarm
+	InfoHash [20]byte
 }
 
+// Flags describe peer capabilities as announced in ut_pex
+type Flags uint8
 
+const (
+	FlagPrefersEncryption Flags = 0x01
+	FlagSeed              Flags = 0x02
+	FlagUTP               Flags = 0x04
+	FlagHolepunch         Flags = 0x08
+	FlagReachable         Flags = 0x10
+)
+
+// Source tells where the peer was learned from
+type Source uint8
+
+const (
+	SourceTracker Source = iota
+	SourcePex
+	SourceDht
+	SourceMagnet
+	SourceIncoming
+)
+
+
+
+// Family is the address family of a peer
+type Family uint8
+
+const (
+	FamilyIPv4 Family = 4
+	FamilyIPv6 Family = 6
+)
+
+// FamilyPolicy tells which address families peers are used from and in which order
+type FamilyPolicy string
+
+const (
+	// FamilyPolicyBalance alternates IPv4 and IPv6 peers
+	FamilyPolicyBalance FamilyPolicy = "balance"
+	FamilyPolicyPrefer4 FamilyPolicy = "prefer4"
+	FamilyPolicyPrefer6 FamilyPolicy = "prefer6"
+	FamilyPolicyOnly4   FamilyPolicy = "ipv4"
+	FamilyPolicyOnly6   FamilyPolicy = "ipv6"
+)
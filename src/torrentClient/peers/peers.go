@@ -24,6 +24,105 @@ func Unmarshal(peersBin []byte) ([]Peer, error) {
 	return peers, nil
 }
 
+// Unmarshal6 parses peers in the compact IPv6 format (BEP 7)
+func Unmarshal6(peersBin []byte) ([]Peer, error) {
+	const peerSize = 18 // 16 for IP, 2 for port
+	numPeers := len(peersBin) / peerSize
+	if len(peersBin)%peerSize != 0 {
+		err := fmt.Errorf("received malformed peers6")
+		return nil, err
+	}
+	peers := make([]Peer, numPeers)
+	for i := 0; i < numPeers; i++ {
+		offset := i * peerSize
+		peers[i].IP = net.IP(peersBin[offset : offset+16])
+		peers[i].Port = binary.BigEndian.Uint16(peersBin[offset+16 : offset+18])
+	}
+	return peers, nil
+}
+
+// Marshal serializes IPv4 peers into the compact format, other peers are skipped
+func Marshal(src []Peer) []byte {
+	const peerSize = 6 // 4 for IP, 2 for port
+	res := make([]byte, 0, len(src)*peerSize)
+	for _, peer := range src {
+		if peer.Family() != FamilyIPv4 {
+			continue
+		}
+		res = append(res, peer.IP.To4()...)
+		res = append(res, byte(peer.Port>>8), byte(peer.Port))
+	}
+	return res
+}
+
+// Marshal6 serializes IPv6 peers into the compact format, other peers are skipped
+func Marshal6(src []Peer) []byte {
+	const peerSize = 18 // 16 for IP, 2 for port
+	res := make([]byte, 0, len(src)*peerSize)
+	for _, peer := range src {
+		if peer.Family() != FamilyIPv6 {
+			continue
+		}
+		res = append(res, peer.IP.To16()...)
+		res = append(res, byte(peer.Port>>8), byte(peer.Port))
+	}
+	return res
+}
+
+// Family returns the address family of the peer. IPv4-mapped IPv6
+// addresses are treated as IPv4
+func (p Peer) Family() Family {
+	if p.IP.To4() != nil {
+		return FamilyIPv4
+	}
+	return FamilyIPv6
+}
+
+// Allows reports whether peers of the family may be used under the policy
+func (policy FamilyPolicy) Allows(family Family) bool {
+	switch policy {
+	case FamilyPolicyOnly4:
+		return family == FamilyIPv4
+	case FamilyPolicyOnly6:
+		return family == FamilyIPv6
+	}
+	return true
+}
+
+// Order returns allowed peers ordered by the policy. Relative order of
+// peers of the same family is kept
+func (policy FamilyPolicy) Order(src []*Peer) []*Peer {
+	v4 := make([]*Peer, 0, len(src))
+	v6 := make([]*Peer, 0)
+	for _, peer := range src {
+		if !policy.Allows(peer.Family()) {
+			continue
+		}
+		if peer.Family() == FamilyIPv4 {
+			v4 = append(v4, peer)
+		} else {
+			v6 = append(v6, peer)
+		}
+	}
+
+	switch policy {
+	case FamilyPolicyPrefer6, FamilyPolicyOnly6:
+		return append(v6, v4...)
+	case FamilyPolicyBalance:
+		res := make([]*Peer, 0, len(v4)+len(v6))
+		for i := 0; i < len(v4) || i < len(v6); i++ {
+			if i < len(v4) {
+				res = append(res, v4[i])
+			}
+			if i < len(v6) {
+				res = append(res, v6[i])
+			}
+		}
+		return res
+	}
+	return append(v4, v6...)
+}
+
 func (p Peer) GetAddr() string {
 	return net.JoinHostPort(p.IP.String(), strconv.Itoa(int(p.Port)))
 }
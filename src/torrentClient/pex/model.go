@@ -0,0 +1,33 @@
+package pex
+
+import (
+	"sync"
+
+	"torrentClient/peers"
+)
+
+// ExtensionName is the name ut_pex is negotiated with (BEP 11)
+const ExtensionName = "ut_pex"
+
+// MaxPeersPerMessage is the max number of added or dropped peers in one message
+const MaxPeersPerMessage = 50
+
+// PeersCallback receives peers a remote peer told us about
+type PeersCallback func(added []peers.Peer, dropped []peers.Peer)
+
+// Handler is the ut_pex extension handler of a single client
+type Handler struct {
+	onPeers PeersCallback
+
+	mu       sync.Mutex
+	lastSent map[string]peers.Peer
+}
+
+type pexMessage struct {
+	Added    string `bencode:"added"`
+	AddedF   string `bencode:"added.f"`
+	Dropped  string `bencode:"dropped"`
+	Added6   string `bencode:"added6,omitempty"`
+	Added6F  string `bencode:"added6.f,omitempty"`
+	Dropped6 string `bencode:"dropped6,omitempty"`
+}
@@ -0,0 +1,136 @@
+package pex
+
+import (
+	"bytes"
+	"fmt"
+
+	"torrentClient/client"
+	"torrentClient/peers"
+
+	"github.com/jackpal/bencode-go"
+	"github.com/sirupsen/logrus"
+)
+
+// New creates a ut_pex handler passing received peers to onPeers
+func New(onPeers PeersCallback) *Handler {
+	return &Handler{
+		onPeers:  onPeers,
+		lastSent: make(map[string]peers.Peer),
+	}
+}
+
+func (h *Handler) Name() string {
+	return ExtensionName
+}
+
+func (h *Handler) HandleMessage(c *client.Client, payload []byte) error {
+	msg := pexMessage{}
+	if err := bencode.Unmarshal(bytes.NewReader(payload), &msg); err != nil {
+		return fmt.Errorf("error unmarshal pex msg: %v", err)
+	}
+
+	added, err := unmarshalAdded(msg.Added, msg.AddedF, peers.Unmarshal)
+	if err != nil {
+		return fmt.Errorf("malformed pex added: %v", err)
+	}
+	added6, err := unmarshalAdded(msg.Added6, msg.Added6F, peers.Unmarshal6)
+	if err != nil {
+		return fmt.Errorf("malformed pex added6: %v", err)
+	}
+	added = append(added, added6...)
+
+	dropped, err := peers.Unmarshal([]byte(msg.Dropped))
+	if err != nil {
+		return fmt.Errorf("malformed pex dropped: %v", err)
+	}
+	dropped6, err := peers.Unmarshal6([]byte(msg.Dropped6))
+	if err != nil {
+		return fmt.Errorf("malformed pex dropped6: %v", err)
+	}
+	dropped = append(dropped, dropped6...)
+
+	logrus.Debugf("Got pex from %v: added=%v, dropped=%v", c.GetShortInfo(), len(added), len(dropped))
+	if h.onPeers != nil {
+		h.onPeers(added, dropped)
+	}
+	return nil
+}
+
+// SendPeers sends the difference between connected and the set sent last time
+func (h *Handler) SendPeers(c *client.Client, connected []peers.Peer) error {
+	if !c.PeerSupportsExtension(ExtensionName) {
+		return nil
+	}
+
+	h.mu.Lock()
+	current := make(map[string]peers.Peer, len(connected))
+	added := make([]peers.Peer, 0)
+	for _, peer := range connected {
+		if peer.GetAddr() == c.GetPeer().GetAddr() {
+			continue
+		}
+		current[peer.GetAddr()] = peer
+		if _, ok := h.lastSent[peer.GetAddr()]; !ok && len(added) < MaxPeersPerMessage {
+			added = append(added, peer)
+		}
+	}
+	dropped := make([]peers.Peer, 0)
+	for addr, peer := range h.lastSent {
+		if _, ok := current[addr]; !ok && len(dropped) < MaxPeersPerMessage {
+			dropped = append(dropped, peer)
+		}
+	}
+	if len(added) == 0 && len(dropped) == 0 {
+		h.mu.Unlock()
+		return nil
+	}
+
+	// Remember exactly what the peer was told, the rest goes with the next message
+	for _, peer := range added {
+		h.lastSent[peer.GetAddr()] = peer
+	}
+	for _, peer := range dropped {
+		delete(h.lastSent, peer.GetAddr())
+	}
+	h.mu.Unlock()
+
+	msg := pexMessage{
+		Added:    string(peers.Marshal(added)),
+		AddedF:   string(marshalFlags(added, peers.FamilyIPv4)),
+		Dropped:  string(peers.Marshal(dropped)),
+		Added6:   string(peers.Marshal6(added)),
+		Added6F:  string(marshalFlags(added, peers.FamilyIPv6)),
+		Dropped6: string(peers.Marshal6(dropped)),
+	}
+
+	var buf bytes.Buffer
+	if err := bencode.Marshal(&buf, msg); err != nil {
+		return err
+	}
+	return c.SendExtended(ExtensionName, buf.Bytes())
+}
+
+func unmarshalAdded(compact string, flags string, unmarshal func([]byte) ([]peers.Peer, error)) ([]peers.Peer, error) {
+	added, err := unmarshal([]byte(compact))
+	if err != nil {
+		return nil, err
+	}
+	for i := range added {
+		if i < len(flags) {
+			added[i].Flags = peers.Flags(flags[i])
+		}
+		added[i].Source = peers.SourcePex
+	}
+	return added, nil
+}
+
+// marshalFlags returns flags of peers of the family in the order Marshal puts them
+func marshalFlags(src []peers.Peer, family peers.Family) []byte {
+	res := make([]byte, 0, len(src))
+	for _, peer := range src {
+		if peer.Family() == family {
+			res = append(res, byte(peer.Flags))
+		}
+	}
+	return res
+}
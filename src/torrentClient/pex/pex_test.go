@@ -0,0 +1,263 @@
+package pex
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"torrentClient/client"
+	"torrentClient/handshake"
+	"torrentClient/message"
+	"torrentClient/peers"
+
+	"github.com/jackpal/bencode-go"
+)
+
+// remotePexID is the ID the remote peer wants ut_pex messages sent with
+const remotePexID = 7
+
+var infoHash = [20]byte{1, 2, 3}
+
+// remotePeer is the other end of a net.Pipe speaking the wire protocol by hand
+type remotePeer struct {
+	conn     net.Conn
+	messages chan *message.Message
+}
+
+// connect accepts an in-memory peer and runs the client with a ut_pex
+// handler. The remote peer has negotiated ut_pex once connect returns
+func connect(t *testing.T, onPeers PeersCallback) (*client.Client, *Handler, *remotePeer) {
+	local, remote := net.Pipe()
+	r := &remotePeer{conn: remote, messages: make(chan *message.Message, 16)}
+
+	go func() {
+		remote.Write(handshake.New(infoHash, [20]byte{9}).Serialize())
+		if _, err := handshake.Read(remote); err != nil {
+			return
+		}
+		defer close(r.messages)
+		for {
+			msg, err := message.Read(remote)
+			if err != nil {
+				return
+			}
+			if msg != nil && msg.ID == message.MsgExtended {
+				r.messages <- msg
+			}
+		}
+	}()
+
+	c, err := client.Accept(local, func(hash [20]byte) ([20]byte, error) {
+		if hash != infoHash {
+			return [20]byte{}, fmt.Errorf("unknown infohash")
+		}
+		return [20]byte{8}, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close(); remote.Close() })
+
+	h := New(onPeers)
+	c.RegisterExtension(h)
+	c.Start()
+
+	hs, err := message.FormatExtendedHandshake(&message.ExtendedHandshake{M: map[string]int{ExtensionName: remotePexID}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := remote.Write(hs.Serialize()); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(time.Second)
+	for !c.PeerSupportsExtension(ExtensionName) {
+		if time.Now().After(deadline) {
+			t.Fatal("ut_pex wasn't negotiated")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	return c, h, r
+}
+
+// send sends a pex message from the remote peer
+func (r *remotePeer) send(t *testing.T, msg pexMessage) {
+	var buf bytes.Buffer
+	if err := bencode.Marshal(&buf, msg); err != nil {
+		t.Fatal(err)
+	}
+	// The client's handler is registered first, so it has local ID 1
+	if _, err := r.conn.Write(message.FormatExtended(1, buf.Bytes()).Serialize()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// receive returns the next pex message the client sent
+func (r *remotePeer) receive(t *testing.T) pexMessage {
+	select {
+	case msg, ok := <-r.messages:
+		if !ok {
+			t.Fatal("connection closed")
+		}
+		id, payload, err := message.ParseExtended(msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if id != remotePexID {
+			t.Fatalf("pex message sent with ID %v, expected %v", id, remotePexID)
+		}
+		res := pexMessage{}
+		if err := bencode.Unmarshal(bytes.NewReader(payload), &res); err != nil {
+			t.Fatal(err)
+		}
+		return res
+	case <-time.After(time.Second):
+		t.Fatal("no pex message")
+	}
+	return pexMessage{}
+}
+
+// expectNothing checks the client sent nothing
+func (r *remotePeer) expectNothing(t *testing.T) {
+	select {
+	case msg := <-r.messages:
+		t.Fatalf("unexpected message %v", msg)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func peer4(i int, flags peers.Flags) peers.Peer {
+	return peers.Peer{IP: net.IPv4(10, 0, byte(i/250), byte(i%250+1)).To4(), Port: 6881, Flags: flags}
+}
+
+func addrs(src []peers.Peer) []string {
+	res := make([]string, 0, len(src))
+	for _, peer := range src {
+		res = append(res, peer.GetAddr())
+	}
+	return res
+}
+
+func TestReceivePeers(t *testing.T) {
+	type update struct{ added, dropped []peers.Peer }
+	updates := make(chan update, 1)
+	_, _, remote := connect(t, func(added, dropped []peers.Peer) {
+		updates <- update{added, dropped}
+	})
+
+	seed := peer4(1, peers.FlagSeed|peers.FlagPrefersEncryption)
+	plain := peer4(2, 0)
+	v6 := peers.Peer{IP: net.ParseIP("2001:db8::1"), Port: 51413, Flags: peers.FlagUTP}
+	gone := peer4(3, 0)
+	remote.send(t, pexMessage{
+		Added:   string(peers.Marshal([]peers.Peer{seed, plain})),
+		AddedF:  string([]byte{byte(seed.Flags), byte(plain.Flags)}),
+		Added6:  string(peers.Marshal6([]peers.Peer{v6})),
+		Added6F: string([]byte{byte(v6.Flags)}),
+		Dropped: string(peers.Marshal([]peers.Peer{gone})),
+	})
+
+	var got update
+	select {
+	case got = <-updates:
+	case <-time.After(time.Second):
+		t.Fatal("no peers received")
+	}
+	if !reflect.DeepEqual(addrs(got.added), addrs([]peers.Peer{seed, plain, v6})) {
+		t.Fatalf("added %v", addrs(got.added))
+	}
+	for i, expected := range []peers.Flags{seed.Flags, plain.Flags, v6.Flags} {
+		if got.added[i].Flags != expected || got.added[i].Source != peers.SourcePex {
+			t.Errorf("peer %v has flags %v and source %v", got.added[i].GetAddr(), got.added[i].Flags, got.added[i].Source)
+		}
+	}
+	if !reflect.DeepEqual(addrs(got.dropped), addrs([]peers.Peer{gone})) {
+		t.Fatalf("dropped %v", addrs(got.dropped))
+	}
+}
+
+func TestSendDiffs(t *testing.T) {
+	c, h, remote := connect(t, nil)
+	a, b, d := peer4(1, peers.FlagSeed), peer4(2, 0), peer4(3, peers.FlagUTP)
+
+	if err := h.SendPeers(c, []peers.Peer{a, b, c.GetPeer()}); err != nil {
+		t.Fatal(err)
+	}
+	msg := remote.receive(t)
+	added, err := unmarshalAdded(msg.Added, msg.AddedF, peers.Unmarshal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(addrs(added), addrs([]peers.Peer{a, b})) || msg.Dropped != "" {
+		t.Fatalf("first message added %v, dropped %q", addrs(added), msg.Dropped)
+	}
+	if added[0].Flags != peers.FlagSeed || added[1].Flags != 0 {
+		t.Fatalf("flags %v %v", added[0].Flags, added[1].Flags)
+	}
+
+	if err := h.SendPeers(c, []peers.Peer{b, d}); err != nil {
+		t.Fatal(err)
+	}
+	msg = remote.receive(t)
+	added, _ = unmarshalAdded(msg.Added, msg.AddedF, peers.Unmarshal)
+	dropped, _ := peers.Unmarshal([]byte(msg.Dropped))
+	if !reflect.DeepEqual(addrs(added), addrs([]peers.Peer{d})) || !reflect.DeepEqual(addrs(dropped), addrs([]peers.Peer{a})) {
+		t.Fatalf("second message added %v, dropped %v", addrs(added), addrs(dropped))
+	}
+	if added[0].Flags != peers.FlagUTP {
+		t.Fatalf("flags %v", added[0].Flags)
+	}
+
+	if err := h.SendPeers(c, []peers.Peer{d, b}); err != nil {
+		t.Fatal(err)
+	}
+	remote.expectNothing(t)
+}
+
+func TestSendCap(t *testing.T) {
+	c, h, remote := connect(t, nil)
+	connected := make([]peers.Peer, 0, 120)
+	for i := 0; i < 120; i++ {
+		connected = append(connected, peer4(i, 0))
+	}
+
+	seen := make(map[string]bool)
+	for _, expected := range []int{MaxPeersPerMessage, MaxPeersPerMessage, 20} {
+		if err := h.SendPeers(c, connected); err != nil {
+			t.Fatal(err)
+		}
+		added, err := peers.Unmarshal([]byte(remote.receive(t).Added))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(added) != expected {
+			t.Fatalf("%v peers added, expected %v", len(added), expected)
+		}
+		for _, peer := range added {
+			if seen[peer.GetAddr()] {
+				t.Fatalf("%v is added twice", peer.GetAddr())
+			}
+			seen[peer.GetAddr()] = true
+		}
+	}
+
+	// Dropping everything is capped the same way
+	for _, expected := range []int{MaxPeersPerMessage, MaxPeersPerMessage, 20} {
+		if err := h.SendPeers(c, nil); err != nil {
+			t.Fatal(err)
+		}
+		dropped, err := peers.Unmarshal([]byte(remote.receive(t).Dropped))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(dropped) != expected {
+			t.Fatalf("%v peers dropped, expected %v", len(dropped), expected)
+		}
+	}
+	if err := h.SendPeers(c, nil); err != nil {
+		t.Fatal(err)
+	}
+	remote.expectNothing(t)
+}
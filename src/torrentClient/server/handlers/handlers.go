@@ -1,17 +1,21 @@
 package handlers
 
 import (
-	"bytes"
 	"fmt"
 	"net/http"
+	"strconv"
+	"time"
 
 	"torrentClient/db"
-	"torrentClient/magnetToTorrent"
+	"torrentClient/jobs"
 	"torrentClient/torrentfile"
 
 	"github.com/sirupsen/logrus"
 )
 
+// DownloadRequestsHandler starts downloading file_id. Repeated requests get
+// the state of the job already started instead of starting another one.
+// priority=prefetch queues the file after the ones being watched
 func DownloadRequestsHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method == http.MethodGet {
 		fileId := r.URL.Query().Get("file_id")
@@ -21,91 +25,105 @@ func DownloadRequestsHandler(w http.ResponseWriter, r *http.Request) {
 			Key			string	`json:"key"`
 			LoadedPiecesTable string	`json:"loadedPiecesTable"`
 			FileName	string		`json:"fileName"`
+			State		string		`json:"state"`
 		}{}
 
-		response.IsLoaded = false
 		response.Key = fileId
 		response.LoadedPiecesTable = db.GetFilesManagerDb().PartsTableNameForFile(fileId)
 
-		torrentBytes, magnetLink, ok := db.GetFilesManagerDb().GetTorrentOrMagnetForByFileId(fileId)
-		if !ok {
-			SendFailResponseWithCode(w, "File not found or not downloadable", http.StatusNotFound)
+		job, err := jobs.GetManager().Start(fileId, jobs.ParsePriority(r.URL.Query().Get("priority")))
+		if err != nil {
+			sendJobError(w, err)
 			return
 		}
+		response.IsLoaded = job.State == jobs.StateCompleted
+		response.FileName = job.FileName
+		response.State = job.State
+		SendDataResponse(w, response)
+	}
+}
 
-		doChangeAnnounce := false
+func WriteLoadedPartsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodGet {
+		fileId := r.URL.Query().Get("file_id")
 
-		if (torrentBytes == nil || len(torrentBytes) == 0) && len(magnetLink) > 0 {
-			torrentBytes = magnetToTorrent.ConvertMagnetToTorrent(magnetLink)
-			logrus.Info("Converted! ", len(torrentBytes))
-			doChangeAnnounce = true
+		torrentBytes, magnetLink, ok := db.GetFilesManagerDb().GetTorrentOrMagnetForByFileId(fileId)
+		if !ok {
+			SendFailResponseWithCode(w, "File not found or not downloadable", http.StatusNotFound)
+			return
 		}
 
-		torrent, err := torrentfile.GetManager().ReadTorrentFileFromBytes(bytes.NewBuffer(torrentBytes))
+		torrent, err := torrentfile.ReadTorrentOrMagnet(torrentBytes, magnetLink)
 		if err != nil {
 			logrus.Errorf("Error reading torrent file: %v", err)
-			SendFailResponseWithCode(w, fmt.Sprintf("Error reading body: %s; body: %s", err.Error(), string(torrentBytes)), http.StatusInternalServerError)
+			SendFailResponseWithCode(w, fmt.Sprintf("Error reading torrent: %s", err.Error()), http.StatusInternalServerError)
 			return
 		}
 		torrent.SysInfo.FileId = fileId
 
-		if doChangeAnnounce {
-			trackerUrl := GetTrackersFromMagnet(magnetLink)
-			logrus.Infof("Tracker url: %v", trackerUrl)
-			torrent.Announce = trackerUrl
-		}
-
-		if torrent.Announce == "" || len(torrent.AnnounceList) == 0 {
-			SendFailResponseWithCode(w, "Announce is empty", http.StatusBadRequest)
-			return
-		}
-
-		//logrus.Infof("Ready torrent info: %v %v", torrent.Announce, torrent.AnnounceList)
-		var fLen int64
-
-		response.FileName, fLen = torrent.PrepareFile()
-		db.GetFilesManagerDb().SetFileLengthForRecord(torrent.SysInfo.FileId, fLen)
-		go torrent.SaveLoadedPiecesToFS()
-
-		go func() {
-			db.GetFilesManagerDb().SetInProgressStatusForRecord(torrent.SysInfo.FileId, true)
-			defer db.GetFilesManagerDb().SetInProgressStatusForRecord(torrent.SysInfo.FileId, false)
-
-			err = torrent.DownloadToFile()
-			if err != nil {
-				logrus.Errorf("Error downloading to file: %v", err)
-			} else {
-				db.GetFilesManagerDb().SetLoadedStatusForRecord(torrent.SysInfo.FileId, true)
-			}
-		}()
-		SendDataResponse(w, response)
+		logs := torrent.SaveLoadedPiecesToFS()
+		SendDataResponse(w, logs)
 	}
 }
 
-func WriteLoadedPartsHandler(w http.ResponseWriter, r *http.Request) {
+func TrackersStatusHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method == http.MethodGet {
 		fileId := r.URL.Query().Get("file_id")
 
-		torrentBytes, magnetLink, ok := db.GetFilesManagerDb().GetTorrentOrMagnetForByFileId(fileId)
+		status, ok := torrentfile.GetTrackersStatus(fileId)
 		if !ok {
-			SendFailResponseWithCode(w, "File not found or not downloadable", http.StatusNotFound)
+			SendFailResponseWithCode(w, "No active download for file", http.StatusNotFound)
 			return
 		}
+		SendDataResponse(w, status)
+	} else {
+		SendFailResponseWithCode(w, "Incorrect method", http.StatusMethodNotAllowed)
+	}
+}
 
-		if (torrentBytes == nil || len(torrentBytes) == 0) && len(magnetLink) > 0 {
-			torrentBytes = magnetToTorrent.ConvertMagnetToTorrent(magnetLink)
-			logrus.Info("Converted! ", len(torrentBytes))
-		}
+// PrioritizeRangeHandler moves the active download of file_id to bytes
+// start..end of the file, e.g. when the viewer seeks. end is optional,
+// deadline is the optional number of seconds the bytes are needed in
+func PrioritizeRangeHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodGet {
+		query := r.URL.Query()
+		fileId := query.Get("file_id")
 
-		torrent, err := torrentfile.GetManager().ReadTorrentFileFromBytes(bytes.NewBuffer(torrentBytes))
+		start, err := strconv.ParseInt(query.Get("start"), 10, 64)
 		if err != nil {
-			logrus.Errorf("Error reading torrent file: %v", err)
-			SendFailResponseWithCode(w, fmt.Sprintf("Error reading body: %s; body: %s", err.Error(), string(torrentBytes)), http.StatusInternalServerError)
+			SendFailResponseWithCode(w, fmt.Sprintf("Invalid start: %v", err), http.StatusBadRequest)
 			return
 		}
-		torrent.SysInfo.FileId = fileId
+		end := start
+		if rawEnd := query.Get("end"); rawEnd != "" {
+			if end, err = strconv.ParseInt(rawEnd, 10, 64); err != nil {
+				SendFailResponseWithCode(w, fmt.Sprintf("Invalid end: %v", err), http.StatusBadRequest)
+				return
+			}
+		}
+		var deadline time.Time
+		if rawDeadline := query.Get("deadline"); rawDeadline != "" {
+			seconds, err := strconv.Atoi(rawDeadline)
+			if err != nil {
+				SendFailResponseWithCode(w, fmt.Sprintf("Invalid deadline: %v", err), http.StatusBadRequest)
+				return
+			}
+			deadline = time.Now().Add(time.Duration(seconds) * time.Second)
+		}
 
-		logs := torrent.SaveLoadedPiecesToFS()
-		SendDataResponse(w, logs)
+		torrent, ok := torrentfile.GetActiveTorrent(fileId)
+		if !ok {
+			SendFailResponseWithCode(w, "No active download for file", http.StatusNotFound)
+			return
+		}
+		if err := torrent.PrioritizeFileRange(start, end, deadline); err != nil {
+			logrus.Errorf("Error prioritizing %v-%v of %v: %v", start, end, fileId, err)
+			SendFailResponseWithCode(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		logrus.Infof("Prioritized bytes %v-%v of %v", start, end, fileId)
+		SendSuccessResponse(w)
+	} else {
+		SendFailResponseWithCode(w, "Incorrect method", http.StatusMethodNotAllowed)
 	}
 }
@@ -0,0 +1,92 @@
+package handlers
+
+import (
+	"net/http"
+
+	"torrentClient/jobs"
+
+	"github.com/gorilla/mux"
+)
+
+// ListJobsHandler returns all download jobs
+func ListJobsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodGet {
+		SendDataResponse(w, jobs.GetManager().List())
+	} else {
+		SendFailResponseWithCode(w, "Incorrect method", http.StatusMethodNotAllowed)
+	}
+}
+
+// JobHandler returns the job of file_id on GET. DELETE cancels it and
+// removes the loaded data
+func JobHandler(w http.ResponseWriter, r *http.Request) {
+	fileId := mux.Vars(r)["file_id"]
+
+	switch r.Method {
+	case http.MethodGet:
+		job, err := jobs.GetManager().Get(fileId)
+		if err != nil {
+			sendJobError(w, err)
+			return
+		}
+		SendDataResponse(w, job)
+	case http.MethodDelete:
+		if err := jobs.GetManager().Delete(fileId); err != nil {
+			sendJobError(w, err)
+			return
+		}
+		SendSuccessResponse(w)
+	default:
+		SendFailResponseWithCode(w, "Incorrect method", http.StatusMethodNotAllowed)
+	}
+}
+
+// PauseJobHandler stops the job of file_id keeping its data
+func PauseJobHandler(w http.ResponseWriter, r *http.Request) {
+	jobActionHandler(w, r, jobs.GetManager().Pause)
+}
+
+// ResumeJobHandler starts a paused or failed job of file_id again
+func ResumeJobHandler(w http.ResponseWriter, r *http.Request) {
+	jobActionHandler(w, r, jobs.GetManager().Resume)
+}
+
+// CancelJobHandler stops the job of file_id and forgets it, the data is kept
+func CancelJobHandler(w http.ResponseWriter, r *http.Request) {
+	jobActionHandler(w, r, jobs.GetManager().Cancel)
+}
+
+func jobActionHandler(w http.ResponseWriter, r *http.Request, action func(fileId string) error) {
+	if r.Method != http.MethodPost {
+		SendFailResponseWithCode(w, "Incorrect method", http.StatusMethodNotAllowed)
+		return
+	}
+	fileId := mux.Vars(r)["file_id"]
+	if err := action(fileId); err != nil {
+		sendJobError(w, err)
+		return
+	}
+	job, err := jobs.GetManager().Get(fileId)
+	if err != nil {
+		// Cancelled jobs are gone
+		SendSuccessResponse(w)
+		return
+	}
+	SendDataResponse(w, job)
+}
+
+// sendJobError answers with the status matching an error of the job manager
+func sendJobError(w http.ResponseWriter, err error) {
+	switch err {
+	case jobs.ErrNotFound:
+		SendFailResponseWithCode(w, "File not found or not downloadable", http.StatusNotFound)
+	case jobs.ErrJobNotFound:
+		SendFailResponseWithCode(w, "No job for file", http.StatusNotFound)
+	case jobs.ErrNoAnnounce:
+		SendFailResponseWithCode(w, "Announce is empty", http.StatusBadRequest)
+	case jobs.ErrInvalidState:
+		SendFailResponseWithCode(w, err.Error(), http.StatusConflict)
+	default:
+		SendFailResponseWithCode(w, err.Error(), http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,87 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"torrentClient/bandwidth"
+	"torrentClient/jobs"
+
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+)
+
+// LimitsHandler returns the global bandwidth limits on GET. POST changes
+// them, download and upload are in bytes per second, 0 is unlimited and
+// an omitted one is kept
+func LimitsHandler(w http.ResponseWriter, r *http.Request) {
+	limiter := bandwidth.GetLimiter()
+
+	switch r.Method {
+	case http.MethodGet:
+		SendDataResponse(w, limiter.Global())
+	case http.MethodPost:
+		limits, err := readLimits(r, limiter.Global())
+		if err != nil {
+			SendFailResponseWithCode(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		limiter.SetGlobal(limits)
+		logrus.Infof("Set global bandwidth limits to %+v", limits)
+		SendDataResponse(w, limits)
+	default:
+		SendFailResponseWithCode(w, "Incorrect method", http.StatusMethodNotAllowed)
+	}
+}
+
+// JobLimitsHandler returns the bandwidth limits of the job of file_id on GET.
+// POST changes them like LimitsHandler does the global ones
+func JobLimitsHandler(w http.ResponseWriter, r *http.Request) {
+	fileId := mux.Vars(r)["file_id"]
+
+	switch r.Method {
+	case http.MethodGet:
+		limits, err := jobs.GetManager().Limits(fileId)
+		if err != nil {
+			sendJobError(w, err)
+			return
+		}
+		SendDataResponse(w, limits)
+	case http.MethodPost:
+		current, err := jobs.GetManager().Limits(fileId)
+		if err != nil {
+			sendJobError(w, err)
+			return
+		}
+		limits, err := readLimits(r, current)
+		if err != nil {
+			SendFailResponseWithCode(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := jobs.GetManager().SetLimits(fileId, limits); err != nil {
+			sendJobError(w, err)
+			return
+		}
+		SendDataResponse(w, limits)
+	default:
+		SendFailResponseWithCode(w, "Incorrect method", http.StatusMethodNotAllowed)
+	}
+}
+
+// readLimits reads download and upload of the query over current
+func readLimits(r *http.Request, current bandwidth.Limits) (bandwidth.Limits, error) {
+	query := r.URL.Query()
+	for name, rate := range map[string]*int64{"download": &current.Download, "upload": &current.Upload} {
+		raw := query.Get(name)
+		if raw == "" {
+			continue
+		}
+		value, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil || value < 0 {
+			return bandwidth.Limits{}, fmt.Errorf("Invalid %v: %v", name, raw)
+		}
+		*rate = value
+	}
+	return current, nil
+}
@@ -0,0 +1,104 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"torrentClient/jobs"
+	"torrentClient/p2p"
+
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// progressStateInterval is how often the job's state is checked for changes
+	progressStateInterval = time.Second
+	// progressPingInterval keeps idle streams from being closed by proxies
+	progressPingInterval = 15 * time.Second
+)
+
+// JobProgressHandler streams the progress of the job of file_id as
+// Server-Sent Events. "state" events carry the job whenever its state
+// changes, "progress" events carry p2p.Progress while it downloads. The
+// stream ends when the job is gone
+func JobProgressHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		SendFailResponseWithCode(w, "Incorrect method", http.StatusMethodNotAllowed)
+		return
+	}
+	fileId := mux.Vars(r)["file_id"]
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		SendFailResponseWithCode(w, "Streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+	job, err := jobs.GetManager().Get(fileId)
+	if err != nil {
+		sendJobError(w, err)
+		return
+	}
+	events, cancel := p2p.SubscribeProgress(fileId)
+	defer cancel()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	if err := sendEvent(w, "state", job); err != nil {
+		return
+	}
+	if t, ok := p2p.GetActiveDownload(fileId); ok {
+		if err := sendEvent(w, "progress", t.Progress()); err != nil {
+			return
+		}
+	}
+	flusher.Flush()
+
+	stateTicker := time.NewTicker(progressStateInterval)
+	defer stateTicker.Stop()
+	lastWrite := time.Now()
+	for {
+		var err error
+		select {
+		case <-r.Context().Done():
+			return
+		case progress := <-events:
+			err = sendEvent(w, "progress", progress)
+		case <-stateTicker.C:
+			current, jobErr := jobs.GetManager().Get(fileId)
+			if jobErr != nil {
+				logrus.Debugf("Job of %v is gone, closing progress stream", fileId)
+				return
+			}
+			if current.State != job.State || current.Priority != job.Priority || current.QueuePosition != job.QueuePosition {
+				job = current
+				err = sendEvent(w, "state", job)
+			} else if time.Since(lastWrite) >= progressPingInterval {
+				_, err = fmt.Fprint(w, ": ping\n\n")
+			} else {
+				continue
+			}
+		}
+		if err != nil {
+			logrus.Debugf("Error writing progress of %v: %v", fileId, err)
+			return
+		}
+		lastWrite = time.Now()
+		flusher.Flush()
+	}
+}
+
+// sendEvent writes data as a Server-Sent Event named event
+func sendEvent(w http.ResponseWriter, event string, data interface{}) error {
+	packet, err := json.Marshal(data)
+	if err != nil {
+		return fmt.Errorf("marshal error: %v", err)
+	}
+	_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, packet)
+	return err
+}
@@ -28,6 +28,16 @@ func Start() {
 
 	router.HandleFunc("/download", handlers.DownloadRequestsHandler)
 	router.HandleFunc("/save", handlers.WriteLoadedPartsHandler)
+	router.HandleFunc("/trackers", handlers.TrackersStatusHandler)
+	router.HandleFunc("/prioritize", handlers.PrioritizeRangeHandler)
+	router.HandleFunc("/jobs", handlers.ListJobsHandler)
+	router.HandleFunc("/jobs/{file_id}", handlers.JobHandler)
+	router.HandleFunc("/jobs/{file_id}/pause", handlers.PauseJobHandler)
+	router.HandleFunc("/jobs/{file_id}/resume", handlers.ResumeJobHandler)
+	router.HandleFunc("/jobs/{file_id}/cancel", handlers.CancelJobHandler)
+	router.HandleFunc("/jobs/{file_id}/limits", handlers.JobLimitsHandler)
+	router.HandleFunc("/jobs/{file_id}/progress", handlers.JobProgressHandler)
+	router.HandleFunc("/limits", handlers.LimitsHandler)
 
 	logrus.Info("Listening localhost:2222")
 	if err := http.ListenAndServe(":2222", router); err != nil {
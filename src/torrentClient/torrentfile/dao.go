@@ -5,4 +5,5 @@ import "io"
 type TorrentFilesManager interface {
 	ReadTorrentFileFromFS(path string) (TorrentFile, error)
 	ReadTorrentFileFromBytes(body io.Reader) (TorrentFile, error)
+	ReadTorrentFileFromMagnet(link string) (TorrentFile, error)
 }
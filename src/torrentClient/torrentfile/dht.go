@@ -0,0 +1,48 @@
+package torrentfile
+
+import (
+	"context"
+	"time"
+
+	"torrentClient/dht"
+
+	"github.com/sirupsen/logrus"
+)
+
+// dhtLookupInterval is how often the DHT is asked for peers of an active torrent
+const dhtLookupInterval = 5 * time.Minute
+
+// CanUseDht reports whether peers of the torrent may be looked up in the DHT.
+// Private torrents must only use their trackers
+func (t *TorrentFile) CanUseDht() bool {
+	return !t.Private && dht.GetServer() != nil
+}
+
+// StartDhtLookup periodically announces the torrent to the DHT and
+// adds found peers to the pool alongside tracker ones
+func (p *PeersPool) StartDhtLookup(ctx context.Context) {
+	if !p.torrent.CanUseDht() {
+		return
+	}
+	server := dht.GetServer()
+
+	ticker := time.NewTicker(dhtLookupInterval)
+	defer ticker.Stop()
+
+	for {
+		for _, infoHash := range p.torrent.SwarmInfoHashes() {
+			found := server.Announce(ctx, infoHash, p.torrent.Download.MyPeerPort)
+			for i := range found {
+				found[i].InfoHash = infoHash
+			}
+			added := p.AddPeers(found)
+			logrus.Infof("DHT found %v peers for %x, %v new", len(found), infoHash, added)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
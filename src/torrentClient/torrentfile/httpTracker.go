@@ -0,0 +1,197 @@
+package torrentfile
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"torrentClient/peers"
+
+	"github.com/jackpal/bencode-go"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	httpTrackerTimeout = 15 * time.Second
+	// maxHttpTrackerResp guards against trackers sending endless bodies
+	maxHttpTrackerResp = 4 * 1024 * 1024
+	httpTrackerNumWant = 50
+)
+
+func (t *Tracker) callHttpTracker() ([]peers.Peer, error) {
+	urlStr, err := t.httpAnnounceURL()
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest(http.MethodGet, urlStr, nil)
+	if err != nil {
+		return nil, fmt.Errorf("error creating tracker req: %v", err)
+	}
+	// Setting the header manually disables transparent decompression,
+	// so trackers gzipping without the header are handled the same way
+	req.Header.Set("Accept-Encoding", "gzip")
+
+	c := &http.Client{Timeout: httpTrackerTimeout}
+	resp, err := c.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to send GET with client: %v; url: %v", err, urlStr)
+	}
+	defer resp.Body.Close()
+
+	body, err := readHttpTrackerBody(resp)
+	if err != nil {
+		return nil, err
+	}
+
+	parsedPeers, err := t.parseHttpAnnounceResp(body)
+	if err != nil && resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("tracker responded with status %v: %v", resp.StatusCode, err)
+	}
+	return parsedPeers, err
+}
+
+// httpAnnounceURL adds announce params to the tracker url keeping its own
+// query (passkeys and such)
+func (t *Tracker) httpAnnounceURL() (string, error) {
+	base, err := url.Parse(t.Announce)
+	if err != nil {
+		return "", fmt.Errorf("error parsing tracker url: %v", err)
+	}
+	params := base.Query()
+	params.Set("info_hash", string(t.InfoHash[:]))
+	params.Set("peer_id", string(t.MyPeerId[:]))
+	params.Set("port", strconv.Itoa(int(t.MyPeerPort)))
+	params.Set("uploaded", strconv.FormatInt(t.Uploaded, 10))
+	params.Set("downloaded", strconv.FormatInt(t.Downloaded, 10))
+	params.Set("left", strconv.FormatInt(t.Left, 10))
+	params.Set("compact", "1")
+	params.Set("numwant", strconv.Itoa(httpTrackerNumWant))
+	params.Set("key", strconv.FormatUint(uint64(udpKey), 16))
+	if t.Event != EventNone {
+		params.Set("event", t.Event)
+	}
+	if t.TrackerId != "" {
+		params.Set("trackerid", t.TrackerId)
+	}
+	base.RawQuery = params.Encode()
+	return base.String(), nil
+}
+
+func readHttpTrackerBody(resp *http.Response) ([]byte, error) {
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxHttpTrackerResp))
+	if err != nil {
+		return nil, fmt.Errorf("error reading resp body: %v", err)
+	}
+	isGzip := resp.Header.Get("Content-Encoding") == "gzip" ||
+		len(body) > 2 && body[0] == 0x1f && body[1] == 0x8b
+	if !isGzip {
+		return body, nil
+	}
+
+	reader, err := gzip.NewReader(bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("error opening gzip resp: %v", err)
+	}
+	defer reader.Close()
+	body, err = io.ReadAll(io.LimitReader(reader, maxHttpTrackerResp))
+	if err != nil {
+		return nil, fmt.Errorf("error reading gzip resp: %v", err)
+	}
+	return body, nil
+}
+
+// parseHttpAnnounceResp saves tracker fields of the response into t
+// and returns peers from both compact and dictionary models
+func (t *Tracker) parseHttpAnnounceResp(body []byte) ([]peers.Peer, error) {
+	decoded, err := bencode.Decode(bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("error unmarshal bencode: %v; body: %v", err, string(body))
+	}
+	resp, ok := decoded.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("tracker resp is not a dict")
+	}
+
+	if reason, ok := resp["failure reason"].(string); ok {
+		return nil, fmt.Errorf("tracker failure: %v", reason)
+	}
+	if warning, ok := resp["warning message"].(string); ok {
+		logrus.Warnf("Tracker %v warning: %v", t.Announce, warning)
+		t.Warning = warning
+	}
+	if interval, ok := resp["interval"].(int64); ok && interval > 0 {
+		t.TrackerCallInterval = time.Duration(interval) * time.Second
+	}
+	if minInterval, ok := resp["min interval"].(int64); ok && minInterval > 0 {
+		t.MinInterval = time.Duration(minInterval) * time.Second
+	}
+	if trackerId, ok := resp["tracker id"].(string); ok && trackerId != "" {
+		t.TrackerId = trackerId
+	}
+	if complete, ok := resp["complete"].(int64); ok {
+		t.Seeders = int(complete)
+	}
+	if incomplete, ok := resp["incomplete"].(int64); ok {
+		t.Leechers = int(incomplete)
+	}
+
+	res := make([]peers.Peer, 0)
+	switch peersValue := resp["peers"].(type) {
+	case string:
+		compact, err := peers.Unmarshal([]byte(peersValue))
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, compact...)
+	case []interface{}:
+		res = append(res, parseDictPeers(peersValue)...)
+	}
+	if peers6, ok := resp["peers6"].(string); ok {
+		compact, err := peers.Unmarshal6([]byte(peers6))
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, compact...)
+	}
+
+	logrus.Infof("Tracker %v: interval = %v; leechers = %v; seeders = %v; peers = %v",
+		t.Announce, t.TrackerCallInterval, t.Leechers, t.Seeders, len(res))
+	return res, nil
+}
+
+// parseDictPeers parses the original peers model: a list of dicts with
+// ip (address or dns name) and port
+func parseDictPeers(list []interface{}) []peers.Peer {
+	res := make([]peers.Peer, 0, len(list))
+	for _, item := range list {
+		dict, ok := item.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		host, _ := dict["ip"].(string)
+		port, _ := dict["port"].(int64)
+		if host == "" || port <= 0 || port > 65535 {
+			continue
+		}
+		ip := net.ParseIP(host)
+		if ip == nil {
+			resolved, err := net.LookupIP(host)
+			if err != nil || len(resolved) == 0 {
+				logrus.Debugf("Can't resolve peer host %v: %v", host, err)
+				continue
+			}
+			ip = resolved[0]
+		}
+		if ip4 := ip.To4(); ip4 != nil {
+			ip = ip4
+		}
+		res = append(res, peers.Peer{IP: ip, Port: uint16(port)})
+	}
+	return res
+}
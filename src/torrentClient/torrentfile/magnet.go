@@ -0,0 +1,187 @@
+package torrentfile
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"torrentClient/client"
+	"torrentClient/dht"
+	"torrentClient/magnet"
+	"torrentClient/peers"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// metadataFetchTimeout bounds the whole magnet resolution
+	metadataFetchTimeout = 2 * time.Minute
+	// metadataFetchWorkers is the number of peers asked for metadata in parallel
+	metadataFetchWorkers = 5
+)
+
+func (t *torrentsManager) ReadTorrentFileFromMagnet(link string) (TorrentFile, error) {
+	m, err := magnet.Parse(link)
+	if err != nil {
+		return TorrentFile{}, err
+	}
+	logrus.Infof("Resolving magnet: name='%v'; trackers=%v; peers=%v", m.Name, m.Trackers, len(m.Peers))
+
+	ctx, cancel := context.WithTimeout(context.Background(), metadataFetchTimeout)
+	defer cancel()
+
+	info, err := fetchMagnetMetadata(ctx, m)
+	if err != nil {
+		return TorrentFile{}, fmt.Errorf("failed to resolve magnet: %v", err)
+	}
+	return t.ParseReaderToTorrent(bytes.NewReader(buildTorrentBytes(m.Trackers, info)))
+}
+
+func fetchMagnetMetadata(ctx context.Context, m *magnet.Magnet) ([]byte, error) {
+	self := TorrentFile{}
+	self.InitMyPeerIDAndPort()
+	infoHash := m.SwarmInfoHash()
+
+	candidates := make(chan peers.Peer, 100)
+	go collectMagnetPeers(ctx, m, self.Download, candidates)
+
+	result := make(chan []byte, 1)
+	wg := sync.WaitGroup{}
+	for i := 0; i < metadataFetchWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case peer, ok := <-candidates:
+					if !ok {
+						return
+					}
+					c, err := client.New(peer, self.Download.MyPeerId, infoHash)
+					if err != nil {
+						logrus.Debugf("Metadata peer %v failed: %v", peer.GetAddr(), err)
+						continue
+					}
+					info, err := m.FetchMetadata(c)
+					c.Close()
+					if err != nil {
+						logrus.Debugf("Metadata fetch from %v failed: %v", peer.GetAddr(), err)
+						continue
+					}
+					select {
+					case result <- info:
+					default:
+					}
+					return
+				}
+			}
+		}()
+	}
+
+	go func() {
+		wg.Wait()
+		close(result)
+	}()
+
+	select {
+	case info, ok := <-result:
+		if !ok {
+			return nil, fmt.Errorf("no peer provided metadata")
+		}
+		return info, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// collectMagnetPeers sends peers from x.pe, the DHT and every tr of the magnet
+func collectMagnetPeers(ctx context.Context, m *magnet.Magnet, self DownloadUtils, candidates chan<- peers.Peer) {
+	defer close(candidates)
+
+	seen := make(map[string]bool)
+	send := func(peer peers.Peer) {
+		if seen[peer.GetAddr()] {
+			return
+		}
+		seen[peer.GetAddr()] = true
+		select {
+		case candidates <- peer:
+		case <-ctx.Done():
+		}
+	}
+
+	for _, peer := range m.Peers {
+		send(peer)
+	}
+
+	// left must be non-zero, otherwise trackers treat us as a seeder
+	left := m.Length
+	if left == 0 {
+		left = 1
+	}
+
+	// Trackers are called at once so a dead one doesn't hold the others back
+	trackerPeers := make(chan []peers.Peer, len(m.Trackers))
+	for _, announce := range m.Trackers {
+		go func(announce string) {
+			tracker := newTracker(announce, m.SwarmInfoHash(), self, left)
+			found, err := tracker.CallFittingScheme()
+			if err != nil {
+				logrus.Errorf("Error calling magnet tracker %v: %v", announce, err)
+			}
+			trackerPeers <- found
+		}(announce)
+	}
+
+	// Trackerless magnets can only be resolved through the DHT
+	if server := dht.GetServer(); server != nil {
+		for _, peer := range server.GetPeers(ctx, m.SwarmInfoHash()) {
+			send(peer)
+		}
+	}
+
+	for range m.Trackers {
+		select {
+		case found := <-trackerPeers:
+			for _, peer := range found {
+				send(peer)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// buildTorrentBytes wraps an info dict received from peers into a .torrent,
+// every tracker of the magnet gets its own tier
+func buildTorrentBytes(trackers []string, info []byte) []byte {
+	var buf bytes.Buffer
+	writeString := func(s string) {
+		buf.WriteString(strconv.Itoa(len(s)))
+		buf.WriteByte(':')
+		buf.WriteString(s)
+	}
+
+	buf.WriteByte('d')
+	if len(trackers) > 0 {
+		writeString("announce")
+		writeString(trackers[0])
+		writeString("announce-list")
+		buf.WriteByte('l')
+		for _, tracker := range trackers {
+			buf.WriteByte('l')
+			writeString(tracker)
+			buf.WriteByte('e')
+		}
+		buf.WriteByte('e')
+	}
+	writeString("info")
+	buf.Write(info)
+	buf.WriteByte('e')
+	return buf.Bytes()
+}
@@ -0,0 +1,161 @@
+package torrentfile
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"fmt"
+
+	"torrentClient/bencodeRaw"
+
+	"github.com/jackpal/bencode-go"
+)
+
+// bencodeInfo is a union of single- and multi-file info dictionaries.
+// Single-file torrents have Length set, multi-file torrents have Files set
+type bencodeInfo struct {
+	Pieces      string               `bencode:"pieces"`
+	PieceLength int                  `bencode:"piece length"`
+	Length      int                  `bencode:"length"`
+	Files       []bencodeTorrentFile `bencode:"files"`
+	Name        string               `bencode:"name"`
+	Private     int                  `bencode:"private"`
+	MetaVersion int                  `bencode:"meta version"`
+}
+
+type bencodeTorrent struct {
+	Announce     string      `bencode:"announce"`
+	AnnounceList [][]string  `bencode:"announce-list"`
+	Info         bencodeInfo `bencode:"info"`
+}
+
+// metaInfo is a decoded .torrent together with the raw bytes of its info
+// dictionary, exactly as they appeared in the source
+type metaInfo struct {
+	bencodeTorrent
+	rawTorrent []byte
+	rawInfo    []byte
+}
+
+func decodeMetaInfo(data []byte) (*metaInfo, error) {
+	rawInfo, err := bencodeRaw.DictValue(data, "info")
+	if err != nil {
+		return nil, fmt.Errorf("error locating info dict: %v", err)
+	}
+
+	meta := metaInfo{rawTorrent: data, rawInfo: rawInfo}
+	if err := bencode.Unmarshal(bytes.NewReader(data), &meta.bencodeTorrent); err != nil {
+		return nil, fmt.Errorf("error unmarshal metainfo: %v", err)
+	}
+	return &meta, nil
+}
+
+// infoHash hashes the info dict bytes as they are, so keys unknown to
+// bencodeInfo (source, md5sum, attr...) are still covered by the hash
+func (m *metaInfo) infoHash() [20]byte {
+	return sha1.Sum(m.rawInfo)
+}
+
+func (m *metaInfo) hasV1() bool {
+	return len(m.Info.Pieces) > 0
+}
+
+// announceTiers returns tracker tiers as BEP 12 defines them: announce-list
+// takes precedence, a lone announce becomes a single tier
+func (m *metaInfo) announceTiers() [][]string {
+	tiers := make([][]string, 0, len(m.AnnounceList))
+	for _, tier := range m.AnnounceList {
+		urls := make([]string, 0, len(tier))
+		for _, announce := range tier {
+			if announce != "" {
+				urls = append(urls, announce)
+			}
+		}
+		if len(urls) > 0 {
+			tiers = append(tiers, urls)
+		}
+	}
+	if len(tiers) == 0 && m.Announce != "" {
+		tiers = append(tiers, []string{m.Announce})
+	}
+	return tiers
+}
+
+func (m *metaInfo) isMultiFile() bool {
+	return len(m.Info.Files) > 0
+}
+
+// files returns the list of files in the torrent. Single-file torrents
+// are represented as a list with one file named after the torrent
+func (m *metaInfo) files() []bencodeTorrentFile {
+	if m.isMultiFile() {
+		return m.Info.Files
+	}
+	return []bencodeTorrentFile{{Length: m.Info.Length, Path: []string{m.Info.Name}}}
+}
+
+func (m *metaInfo) totalLength() int {
+	res := 0
+	for _, file := range m.files() {
+		res += file.Length
+	}
+	return res
+}
+
+func (i *bencodeInfo) splitPieceHashes() ([][20]byte, error) {
+	hashLen := 20 // Length of SHA-1 hash
+	buf := []byte(i.Pieces)
+	if len(buf)%hashLen != 0 {
+		err := fmt.Errorf("Received malformed pieces of length %d", len(buf))
+		return nil, err
+	}
+	numHashes := len(buf) / hashLen
+	hashes := make([][20]byte, numHashes)
+
+	for i := 0; i < numHashes; i++ {
+		copy(hashes[i][:], buf[i*hashLen:(i+1)*hashLen])
+	}
+	return hashes, nil
+}
+
+func (m *metaInfo) toTorrentFile() (TorrentFile, error) {
+	if m.Info.PieceLength <= 0 {
+		return TorrentFile{}, fmt.Errorf("invalid piece length: %v", m.Info.PieceLength)
+	}
+	if !m.hasV1() && !m.hasV2() {
+		return TorrentFile{}, fmt.Errorf("torrent has neither pieces nor file tree")
+	}
+
+	t := TorrentFile{
+		Announce:      m.Announce,
+		AnnounceList:  UnfoldArray(m.AnnounceList),
+		AnnounceTiers: m.announceTiers(),
+		PieceLength:   m.Info.PieceLength,
+		Name:          m.Info.Name,
+		Private:       m.Info.Private == 1,
+		MetaVersion:   1,
+		SysInfo:       SystemInfo{},
+		Download:      DownloadUtils{},
+	}
+
+	if m.hasV1() {
+		pieceHashes, err := m.Info.splitPieceHashes()
+		if err != nil {
+			return TorrentFile{}, err
+		}
+		t.InfoHash = m.infoHash()
+		t.PieceHashes = pieceHashes
+		t.Files = m.files()
+		t.Length = m.totalLength()
+	}
+
+	if m.hasV2() {
+		if err := m.fillV2(&t); err != nil {
+			return TorrentFile{}, err
+		}
+	}
+
+	if expected := (t.Length + t.PieceLength - 1) / t.PieceLength; m.hasV1() && expected != len(t.PieceHashes) {
+		return TorrentFile{}, fmt.Errorf("pieces count mismatch: got %v hashes, expected %v", len(t.PieceHashes), expected)
+	}
+	return t, nil
+}
@@ -0,0 +1,181 @@
+package torrentfile
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// parseCase is what is known about a testdata torrent without this package:
+// infohashes are published or computed by a separate bencode implementation
+// over the raw info dict, files are the ones the torrent was created from
+type parseCase struct {
+	file        string
+	infoHash    string
+	pieces      int
+	pieceLength int
+	length      int
+	files       []string
+
+	infoHashV2  string
+	piecesV2    int
+	pieceLayers int
+}
+
+var parseCases = []parseCase{
+	{
+		// The infohash archlinux.org published for this ISO
+		file:        "archlinux-2019.12.01-x86_64.iso.torrent",
+		infoHash:    "dee86a7fa6f286a9d74c362014616a0ff5e4843d",
+		pieces:      1278,
+		pieceLength: 524288,
+		length:      670040064,
+		files:       []string{"archlinux-2019.12.01-x86_64.iso 670040064"},
+	},
+	{
+		// The info dict has a "source" key bencodeInfo doesn't know
+		file:        "multi_v1.torrent",
+		infoHash:    "3ada29ae2b68f9b37a6b8bad29cfefb1a7e26b7f",
+		pieces:      5,
+		pieceLength: 32768,
+		length:      141000,
+		files:       []string{"docs/readme.txt 1000", "video.mkv 100000", "zsub.srt 40000"},
+	},
+	{
+		// The v2 swarm uses the SHA-256 infohash truncated to 20 bytes
+		file:        "pure_v2.torrent",
+		infoHash:    "fbc36e608959686d7b053c8e11daa9b9089f0675",
+		pieceLength: 32768,
+		length:      203840,
+		files: []string{
+			"docs/readme.txt 1000", ".pad/31768 31768", "video.mkv 100000", ".pad/31072 31072", "zsub.srt 40000",
+		},
+		infoHashV2:  "fbc36e608959686d7b053c8e11daa9b9089f06750ac4c27635859cc1ee2d2275",
+		piecesV2:    7,
+		pieceLayers: 2,
+	},
+	{
+		file:        "hybrid.torrent",
+		infoHash:    "bad79cc3f2b8a1c173c609ad4f4a1708964fe61d",
+		pieces:      7,
+		pieceLength: 32768,
+		length:      203840,
+		files: []string{
+			"docs/readme.txt 1000", ".pad/31768 31768", "video.mkv 100000", ".pad/31072 31072", "zsub.srt 40000",
+		},
+		infoHashV2:  "dfffa6b23c4d422ed8afffa19a3c511d1cbb0b7b4552974a281c79ae05b606f3",
+		piecesV2:    7,
+		pieceLayers: 2,
+	},
+}
+
+func parseTestdata(t *testing.T, name string) TorrentFile {
+	file, err := os.Open(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	torrent, err := (&torrentsManager{}).ParseReaderToTorrent(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return torrent
+}
+
+// describeFiles lists files as "path length"
+func describeFiles(files []bencodeTorrentFile) []string {
+	res := make([]string, 0, len(files))
+	for _, file := range files {
+		res = append(res, fmt.Sprintf("%v %v", strings.Join(file.Path, "/"), file.Length))
+	}
+	return res
+}
+
+func TestParse(t *testing.T) {
+	for _, c := range parseCases {
+		c := c
+		t.Run(c.file, func(t *testing.T) {
+			torrent := parseTestdata(t, c.file)
+			if got := hex.EncodeToString(torrent.InfoHash[:]); got != c.infoHash {
+				t.Errorf("got infohash %v, want %v", got, c.infoHash)
+			}
+			if len(torrent.PieceHashes) != c.pieces {
+				t.Errorf("got %v piece hashes, want %v", len(torrent.PieceHashes), c.pieces)
+			}
+			if torrent.PieceLength != c.pieceLength || torrent.Length != c.length {
+				t.Errorf("got piece length %v and length %v, want %v and %v", torrent.PieceLength, torrent.Length, c.pieceLength, c.length)
+			}
+			if got := describeFiles(torrent.Files); !reflect.DeepEqual(got, c.files) {
+				t.Errorf("got files %q, want %q", got, c.files)
+			}
+
+			if c.infoHashV2 == "" {
+				if torrent.IsV2() {
+					t.Error("v1 torrent is taken for a v2 one")
+				}
+				return
+			}
+			if got := hex.EncodeToString(torrent.InfoHashV2[:]); got != c.infoHashV2 {
+				t.Errorf("got v2 infohash %v, want %v", got, c.infoHashV2)
+			}
+			if got := len(torrent.piecesV2()); got != c.piecesV2 {
+				t.Errorf("got %v v2 pieces, want %v", got, c.piecesV2)
+			}
+			if len(torrent.PieceLayers) != c.pieceLayers {
+				t.Errorf("got %v piece layers, want %v", len(torrent.PieceLayers), c.pieceLayers)
+			}
+			if torrent.IsHybrid() != (c.pieces > 0) {
+				t.Errorf("got hybrid %v with %v v1 pieces", torrent.IsHybrid(), c.pieces)
+			}
+		})
+	}
+}
+
+// goldenTorrent is what testdata/*.golden.json files keep of a torrent
+type goldenTorrent struct {
+	Announce    string
+	InfoHash    [20]byte
+	PieceHashes [][20]byte
+	PieceLength int
+	Length      int
+	Name        string
+}
+
+func TestParseGolden(t *testing.T) {
+	paths, err := filepath.Glob("testdata/*.torrent.golden.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range paths {
+		path := path
+		name := strings.TrimSuffix(filepath.Base(path), ".golden.json")
+		t.Run(name, func(t *testing.T) {
+			serialized, err := ioutil.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var expected goldenTorrent
+			if err := json.Unmarshal(serialized, &expected); err != nil {
+				t.Fatal(err)
+			}
+			torrent := parseTestdata(t, name)
+			got := goldenTorrent{
+				Announce:    torrent.Announce,
+				InfoHash:    torrent.InfoHash,
+				PieceHashes: torrent.PieceHashes,
+				PieceLength: torrent.PieceLength,
+				Length:      torrent.Length,
+				Name:        torrent.Name,
+			}
+			if !reflect.DeepEqual(expected, got) {
+				t.Errorf("%v doesn't match its golden file", name)
+			}
+		})
+	}
+}
@@ -0,0 +1,291 @@
+package torrentfile
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"sort"
+	"strconv"
+
+	"torrentClient/bencodeRaw"
+	"torrentClient/merkle"
+	"torrentClient/p2p"
+
+	"github.com/jackpal/bencode-go"
+	"github.com/sirupsen/logrus"
+)
+
+// v2File is a file from the "file tree" of a BitTorrent v2 info dict
+type v2File struct {
+	Path       []string
+	Length     int
+	PiecesRoot merkle.Hash
+}
+
+func (m *metaInfo) hasV2() bool {
+	return m.Info.MetaVersion == 2
+}
+
+func (m *metaInfo) infoHashV2() merkle.Hash {
+	return sha256.Sum256(m.rawInfo)
+}
+
+// fileTree flattens the "file tree" dict in its canonical (sorted) order
+func (m *metaInfo) fileTree() ([]v2File, error) {
+	raw, err := bencodeRaw.DictValue(m.rawInfo, "file tree")
+	if err != nil {
+		return nil, err
+	}
+	decoded, err := bencode.Decode(bytes.NewReader(raw))
+	if err != nil {
+		return nil, fmt.Errorf("error decoding file tree: %v", err)
+	}
+	root, ok := decoded.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("file tree is not a dict")
+	}
+
+	res := make([]v2File, 0)
+	if err := walkFileTree(root, nil, &res); err != nil {
+		return nil, err
+	}
+	if len(res) == 0 {
+		return nil, fmt.Errorf("file tree is empty")
+	}
+	return res, nil
+}
+
+func walkFileTree(node map[string]interface{}, path []string, res *[]v2File) error {
+	names := make([]string, 0, len(node))
+	for name := range node {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		child, ok := node[name].(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("file tree node '%v' is not a dict", name)
+		}
+		childPath := append(append([]string{}, path...), name)
+
+		leaf, isFile := child[""].(map[string]interface{})
+		if !isFile {
+			if err := walkFileTree(child, childPath, res); err != nil {
+				return err
+			}
+			continue
+		}
+
+		length, ok := leaf["length"].(int64)
+		if !ok || length < 0 {
+			return fmt.Errorf("file '%v' has invalid length", childPath)
+		}
+		file := v2File{Path: childPath, Length: int(length)}
+		if length > 0 {
+			root, ok := leaf["pieces root"].(string)
+			if !ok || len(root) != merkle.HashSize {
+				return fmt.Errorf("file '%v' has invalid pieces root", childPath)
+			}
+			copy(file.PiecesRoot[:], root)
+		}
+		*res = append(*res, file)
+	}
+	return nil
+}
+
+// pieceLayers decodes the top-level "piece layers" dict. It is absent
+// in torrents created from magnet links, layers are requested from peers then
+func (m *metaInfo) pieceLayers() (map[merkle.Hash][]merkle.Hash, error) {
+	res := make(map[merkle.Hash][]merkle.Hash)
+
+	raw, err := bencodeRaw.DictValue(m.rawTorrent, "piece layers")
+	if err != nil {
+		return res, nil
+	}
+	decoded, err := bencode.Decode(bytes.NewReader(raw))
+	if err != nil {
+		return nil, fmt.Errorf("error decoding piece layers: %v", err)
+	}
+	layers, ok := decoded.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("piece layers is not a dict")
+	}
+
+	for key, value := range layers {
+		hashes, ok := value.(string)
+		if len(key) != merkle.HashSize || !ok || len(hashes)%merkle.HashSize != 0 {
+			return nil, fmt.Errorf("malformed piece layer entry")
+		}
+		var root merkle.Hash
+		copy(root[:], key)
+		layer := make([]merkle.Hash, len(hashes)/merkle.HashSize)
+		for i := range layer {
+			copy(layer[i][:], hashes[i*merkle.HashSize:(i+1)*merkle.HashSize])
+		}
+		res[root] = layer
+	}
+	return res, nil
+}
+
+// fillV2 sets v2 specific fields of t. For pure v2 torrents it also builds
+// the file list, aligning each file to a piece boundary with padding files
+// the same way hybrid torrents do in their v1 part
+func (m *metaInfo) fillV2(t *TorrentFile) error {
+	if t.PieceLength < merkle.BlockSize || t.PieceLength&(t.PieceLength-1) != 0 {
+		return fmt.Errorf("v2 piece length must be a power of two >= %v, got %v", merkle.BlockSize, t.PieceLength)
+	}
+	files, err := m.fileTree()
+	if err != nil {
+		return err
+	}
+	layers, err := m.pieceLayers()
+	if err != nil {
+		return err
+	}
+	if err := validatePieceLayers(files, layers, t.PieceLength); err != nil {
+		return err
+	}
+
+	t.InfoHashV2 = m.infoHashV2()
+	t.PieceLayers = layers
+
+	if m.hasV1() {
+		return attachPiecesRoots(t.Files, files)
+	}
+
+	t.MetaVersion = 2
+	copy(t.InfoHash[:], t.InfoHashV2[:20])
+	t.Files = make([]bencodeTorrentFile, 0, len(files))
+	t.Length = 0
+	for i, file := range files {
+		t.Files = append(t.Files, bencodeTorrentFile{Length: file.Length, Path: file.Path, PiecesRoot: file.PiecesRoot})
+		t.Length += file.Length
+		if tail := t.Length % t.PieceLength; tail != 0 && i != len(files)-1 {
+			padLength := t.PieceLength - tail
+			t.Files = append(t.Files, bencodeTorrentFile{
+				Length: padLength,
+				Path:   []string{".pad", strconv.Itoa(padLength)},
+				Attr:   "p",
+			})
+			t.Length += padLength
+		}
+	}
+	return nil
+}
+
+// attachPiecesRoots matches the v1 files list of a hybrid torrent
+// with its file tree
+func attachPiecesRoots(v1Files []bencodeTorrentFile, files []v2File) error {
+	idx := 0
+	for i := range v1Files {
+		if v1Files[i].IsPadding() {
+			continue
+		}
+		if idx >= len(files) || files[idx].Length != v1Files[i].Length {
+			return fmt.Errorf("hybrid torrent v1 files don't match its file tree")
+		}
+		v1Files[i].PiecesRoot = files[idx].PiecesRoot
+		idx++
+	}
+	if idx != len(files) {
+		return fmt.Errorf("hybrid torrent v1 files don't match its file tree")
+	}
+	return nil
+}
+
+// validatePieceLayers checks that every present piece layer hashes up
+// to the pieces root of its file
+func validatePieceLayers(files []v2File, layers map[merkle.Hash][]merkle.Hash, pieceLength int) error {
+	pad := merkle.PadHash(merkle.Log2(pieceLength / merkle.BlockSize))
+	for _, file := range files {
+		if file.Length <= pieceLength {
+			continue
+		}
+		layer, ok := layers[file.PiecesRoot]
+		if !ok {
+			logrus.Warnf("No piece layer for %v, hashes will be requested from peers", file.Path)
+			continue
+		}
+		if expected := (file.Length + pieceLength - 1) / pieceLength; len(layer) != expected {
+			return fmt.Errorf("piece layer of %v has %v hashes, expected %v", file.Path, len(layer), expected)
+		}
+		root, err := merkle.Root(layer, merkle.NextPowerOfTwo(len(layer)), pad)
+		if err != nil {
+			return err
+		}
+		if root != file.PiecesRoot {
+			return fmt.Errorf("piece layer of %v doesn't match its pieces root", file.Path)
+		}
+	}
+	return nil
+}
+
+// IsV2 reports whether the torrent can be verified with v2 merkle hashes
+func (t *TorrentFile) IsV2() bool {
+	return t.InfoHashV2 != merkle.Hash{}
+}
+
+// IsHybrid reports whether the torrent can join both v1 and v2 swarms
+func (t *TorrentFile) IsHybrid() bool {
+	return t.IsV2() && len(t.PieceHashes) > 0
+}
+
+// SwarmInfoHashes returns 20-byte infohashes used in handshakes and
+// tracker announces: SHA-1 for v1 and truncated SHA-256 for v2
+func (t *TorrentFile) SwarmInfoHashes() [][20]byte {
+	res := [][20]byte{t.InfoHash}
+	if t.IsHybrid() {
+		var truncated [20]byte
+		copy(truncated[:], t.InfoHashV2[:20])
+		res = append(res, truncated)
+	}
+	return res
+}
+
+// piecesV2 describes how every piece of a v2 torrent is verified
+func (t *TorrentFile) piecesV2() []p2p.PieceHashV2 {
+	if !t.IsV2() {
+		return nil
+	}
+
+	numPieces := (t.Length + t.PieceLength - 1) / t.PieceLength
+	res := make([]p2p.PieceHashV2, numPieces)
+	leavesPerPiece := t.PieceLength / merkle.BlockSize
+
+	offset := 0
+	for _, file := range t.Files {
+		start := offset
+		offset += file.Length
+		if file.IsPadding() || file.Length == 0 {
+			continue
+		}
+
+		firstPiece := start / t.PieceLength
+		filePieces := (file.Length + t.PieceLength - 1) / t.PieceLength
+		layer := t.PieceLayers[file.PiecesRoot]
+		for k := 0; k < filePieces; k++ {
+			piece := p2p.PieceHashV2{
+				PiecesRoot: file.PiecesRoot,
+				FirstPiece: firstPiece,
+				FilePieces: filePieces,
+				DataLength: t.PieceLength,
+				Leaves:     leavesPerPiece,
+			}
+			if k == filePieces-1 {
+				piece.DataLength = file.Length - k*t.PieceLength
+			}
+
+			if filePieces == 1 {
+				piece.Root = file.PiecesRoot
+				piece.Leaves = merkle.NextPowerOfTwo((file.Length + merkle.BlockSize - 1) / merkle.BlockSize)
+				piece.Known = true
+			} else if len(layer) == filePieces {
+				piece.Root = layer[k]
+				piece.Known = true
+			}
+			res[firstPiece+k] = piece
+		}
+	}
+	return res
+}
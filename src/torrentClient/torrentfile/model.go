@@ -4,10 +4,13 @@ import (
 	"crypto/md5"
 	"fmt"
 	"strings"
+	"sync"
 	"time"
 
 	"torrentClient/client"
+	"torrentClient/merkle"
 	"torrentClient/peers"
+	"torrentClient/pex"
 )
 
 // Port to listen on
@@ -17,12 +20,17 @@ const Port uint16 = 6881
 type TorrentFile struct {
 	Announce    string
 	AnnounceList	[]string
+	AnnounceTiers	[][]string
 	InfoHash    [20]byte
 	PieceHashes [][20]byte
 	PieceLength int
 	Length      int
 	Files		[]bencodeTorrentFile
 	Name        string
+	Private     bool
+	MetaVersion int
+	InfoHashV2  merkle.Hash
+	PieceLayers map[merkle.Hash][]merkle.Hash
 	SysInfo     SystemInfo
 	Download    DownloadUtils
 }
@@ -47,23 +55,16 @@ type UdpConnManager struct {
 	IsValid	bool
 }
 
-type bencodeInfoSingleFile struct {
-	Pieces      string `bencode:"pieces"`
-	PieceLength int    `bencode:"piece length"`
-	Length      int    `bencode:"length"`
-	Name        string `bencode:"name"`
+type bencodeTorrentFile struct {
+	Length     int         `bencode:"length"`
+	Path       []string    `bencode:"path"`
+	Attr       string      `bencode:"attr"`
+	PiecesRoot merkle.Hash `bencode:"-"`
 }
 
-type bencodeInfoMultiFiles struct {
-	Pieces      string `bencode:"pieces"`
-	PieceLength int    `bencode:"piece length"`
-	Files      []bencodeTorrentFile    `bencode:"files"`
-	Name        string `bencode:"name"`
-}
-
-type bencodeTorrentFile struct {
-	Length int      `bencode:"length"`
-	Path   []string `bencode:"path"`
+// IsPadding reports whether the file only aligns the next file to a piece boundary
+func (b *bencodeTorrentFile) IsPadding() bool {
+	return strings.Contains(b.Attr, "p")
 }
 
 func (b *bencodeTorrentFile) EncodeFileName() string {
@@ -71,32 +72,21 @@ func (b *bencodeTorrentFile) EncodeFileName() string {
 	return fmt.Sprintf("%x", hash[:])
 }
 
-type bencodeTorrentSingleFile struct {
-	Announce     string                `bencode:"announce"`
-	AnnounceList [][]string            `bencode:"announce-list"`
-	Info         bencodeInfoSingleFile `bencode:"info"`
-}
-
-type bencodeTorrentMultiFiles struct {
-	Announce     string                `bencode:"announce"`
-	AnnounceList [][]string            `bencode:"announce-list"`
-	Info         bencodeInfoMultiFiles `bencode:"info"`
-}
-
-func (bto *bencodeTorrentMultiFiles) SumFilesLength() int {
-	res := 0
-	for _, file := range bto.Info.Files {
-		res += file.Length
-	}
-	return res
+// filesStorage reads torrent bytes back from the files fsWriter saves them to
+type filesStorage struct {
+	dir   string
+	files []bencodeTorrentFile
 }
 
-
 type PeersPool struct {
 	Peers             []*peers.Peer
 	ActiveClientsChan chan *client.Client
 
 	torrent *TorrentFile
+
+	peersMu    sync.Mutex
+	pexMu      sync.Mutex
+	pexClients map[*client.Client]*pex.Handler
 }
 
 func (p *PeersPool) SetTorrent(src *TorrentFile) {
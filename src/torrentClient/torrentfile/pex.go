@@ -0,0 +1,167 @@
+package torrentfile
+
+import (
+	"context"
+	"time"
+
+	"torrentClient/client"
+	"torrentClient/parser/env"
+	"torrentClient/peers"
+	"torrentClient/pex"
+
+	"github.com/sirupsen/logrus"
+)
+
+// pexInterval is how often connected peers are sent over ut_pex,
+// BEP 11 asks not to do it more than once a minute
+const pexInterval = time.Minute
+
+// AddPeers merges peers into the pool. Peers already known (e.g. from trackers)
+// are not duplicated, only their flags are updated. Peers are filtered and
+// ordered by address family as PEER_ADDRESS_FAMILY says. Returns the number of new peers
+func (p *PeersPool) AddPeers(src []peers.Peer) int {
+	p.peersMu.Lock()
+	defer p.peersMu.Unlock()
+
+	known := make(map[string]*peers.Peer, len(p.Peers))
+	for _, peer := range p.Peers {
+		known[peer.GetAddr()] = peer
+	}
+
+	policy := peers.FamilyPolicy(env.GetParser().GetPeerFamilyPolicy())
+	added := 0
+	for i := range src {
+		if existing, ok := known[src[i].GetAddr()]; ok {
+			existing.Flags |= src[i].Flags
+			continue
+		}
+		if !policy.Allows(src[i].Family()) {
+			continue
+		}
+		peer := src[i]
+		p.Peers = append(p.Peers, &peer)
+		known[peer.GetAddr()] = &peer
+		added++
+	}
+	if added > 0 {
+		p.Peers = policy.Order(p.Peers)
+	}
+	return added
+}
+
+// DropPeers marks peers as dead. Only peers learnt from pex are affected,
+// peers given by trackers stay as they are
+func (p *PeersPool) DropPeers(dropped []peers.Peer) {
+	p.peersMu.Lock()
+	defer p.peersMu.Unlock()
+
+	droppedAddrs := make(map[string]bool, len(dropped))
+	for _, peer := range dropped {
+		droppedAddrs[peer.GetAddr()] = true
+	}
+	for _, peer := range p.Peers {
+		if peer.Source == peers.SourcePex && droppedAddrs[peer.GetAddr()] {
+			peer.IsDead = true
+		}
+	}
+}
+
+// Dial connects to a peer of the pool. The handshake is done with the
+// infohash of the swarm the peer was found in, a peer of the v2 swarm of a
+// hybrid torrent doesn't know the v1 one
+func (p *PeersPool) Dial(peer *peers.Peer) (*client.Client, error) {
+	infoHash := p.torrent.InfoHash
+	for _, swarm := range p.torrent.SwarmInfoHashes() {
+		if swarm == peer.InfoHash {
+			infoHash = swarm
+		}
+	}
+	return client.New(*peer, p.torrent.Download.MyPeerId, infoHash)
+}
+
+// StartPex plugs ut_pex into every client coming from in and passes
+// the client further to the returned channel
+func (p *PeersPool) StartPex(ctx context.Context, in <-chan *client.Client) <-chan *client.Client {
+	out := make(chan *client.Client)
+
+	p.pexMu.Lock()
+	p.pexClients = make(map[*client.Client]*pex.Handler)
+	p.pexMu.Unlock()
+
+	go func() {
+		ticker := time.NewTicker(pexInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				p.sendPex()
+			case c := <-in:
+				if c == nil {
+					continue
+				}
+				p.attachPex(ctx, c)
+				select {
+				case out <- c:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+	return out
+}
+
+func (p *PeersPool) attachPex(ctx context.Context, c *client.Client) {
+	if !c.SupportsExtensions() {
+		return
+	}
+
+	handler := pex.New(func(added []peers.Peer, dropped []peers.Peer) {
+		// Peers we learn from a peer are in its swarm
+		for i := range added {
+			added[i].InfoHash = c.InfoHash()
+		}
+		newPeers := p.AddPeers(added)
+		p.DropPeers(dropped)
+		logrus.Debugf("Pex from %v: %v new peers, %v dropped", c.GetShortInfo(), newPeers, len(dropped))
+	})
+	c.RegisterExtension(handler)
+	if err := c.SendExtendedHandshake(); err != nil {
+		logrus.Errorf("Error sending ext handshake to %v: %v", c.GetShortInfo(), err)
+		return
+	}
+
+	p.pexMu.Lock()
+	p.pexClients[c] = handler
+	p.pexMu.Unlock()
+
+	go func() {
+		select {
+		case <-c.Done():
+		case <-ctx.Done():
+		}
+		p.pexMu.Lock()
+		delete(p.pexClients, c)
+		p.pexMu.Unlock()
+	}()
+}
+
+func (p *PeersPool) sendPex() {
+	p.pexMu.Lock()
+	connected := make([]peers.Peer, 0, len(p.pexClients))
+	handlers := make(map[*client.Client]*pex.Handler, len(p.pexClients))
+	for c, handler := range p.pexClients {
+		connected = append(connected, c.GetPeer())
+		handlers[c] = handler
+	}
+	p.pexMu.Unlock()
+
+	for c, handler := range handlers {
+		if err := handler.SendPeers(c, connected); err != nil {
+			logrus.Errorf("Error sending pex to %v: %v", c.GetShortInfo(), err)
+		}
+	}
+}
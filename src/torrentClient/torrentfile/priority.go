@@ -0,0 +1,69 @@
+package torrentfile
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"torrentClient/p2p"
+)
+
+var activeTorrentsMu sync.Mutex
+var activeTorrents = make(map[string]*TorrentFile)
+
+// GetActiveTorrent returns the torrent of a running download
+func GetActiveTorrent(fileId string) (*TorrentFile, bool) {
+	activeTorrentsMu.Lock()
+	defer activeTorrentsMu.Unlock()
+	t, ok := activeTorrents[fileId]
+	return t, ok
+}
+
+func registerActiveTorrent(t *TorrentFile) {
+	activeTorrentsMu.Lock()
+	defer activeTorrentsMu.Unlock()
+	activeTorrents[t.SysInfo.FileId] = t
+}
+
+func unregisterActiveTorrent(t *TorrentFile) {
+	activeTorrentsMu.Lock()
+	defer activeTorrentsMu.Unlock()
+	if activeTorrents[t.SysInfo.FileId] == t {
+		delete(activeTorrents, t.SysInfo.FileId)
+	}
+}
+
+// PrioritizeFileRange moves the download to bytes start..end (inclusive)
+// of the file the record is served as, i.e. the heaviest file of the torrent.
+// end is cut to the file length
+func (t *TorrentFile) PrioritizeFileRange(start, end int64, deadline time.Time) error {
+	download, ok := p2p.GetActiveDownload(t.SysInfo.FileId)
+	if !ok {
+		return fmt.Errorf("download of %v isn't running", t.SysInfo.FileId)
+	}
+
+	fileStart, fileLength := t.heaviestFileBounds()
+	if end >= fileLength {
+		end = fileLength - 1
+	}
+	if start < 0 || start > end {
+		return fmt.Errorf("invalid range %v-%v of file with length %v", start, end, fileLength)
+	}
+	return download.PrioritizeBytes(fileStart+start, fileStart+end, deadline)
+}
+
+// heaviestFileBounds returns the offset of the heaviest file in the torrent and its length
+func (t *TorrentFile) heaviestFileBounds() (int64, int64) {
+	heaviest := 0
+	for i, file := range t.Files {
+		if file.Length > t.Files[heaviest].Length {
+			heaviest = i
+		}
+	}
+
+	offset := int64(0)
+	for _, file := range t.Files[:heaviest] {
+		offset += int64(file.Length)
+	}
+	return offset, int64(t.Files[heaviest].Length)
+}
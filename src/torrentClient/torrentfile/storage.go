@@ -0,0 +1,78 @@
+package torrentfile
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"torrentClient/parser/env"
+)
+
+func (t *TorrentFile) newFilesStorage() *filesStorage {
+	return &filesStorage{dir: env.GetParser().GetFilesDir(), files: t.Files}
+}
+
+// RemoveFiles deletes the files of the torrent written to disk
+func (t *TorrentFile) RemoveFiles() error {
+	dir := env.GetParser().GetFilesDir()
+	for _, file := range t.Files {
+		if file.IsPadding() {
+			continue
+		}
+		if err := os.Remove(filepath.Join(dir, file.EncodeFileName())); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("remove file error: %v", err)
+		}
+	}
+	return nil
+}
+
+// ReadAt reads torrent bytes starting at off, spanning files if needed.
+// Padding files are not written to disk and read as zeroes
+func (s *filesStorage) ReadAt(buf []byte, off int64) (int, error) {
+	read := 0
+	fileStart := int64(0)
+	for i := range s.files {
+		if read == len(buf) {
+			break
+		}
+		file := &s.files[i]
+		fileEnd := fileStart + int64(file.Length)
+		pos := off + int64(read)
+		if pos >= fileEnd {
+			fileStart = fileEnd
+			continue
+		}
+
+		chunk := buf[read:]
+		if rest := fileEnd - pos; int64(len(chunk)) > rest {
+			chunk = chunk[:rest]
+		}
+		if file.IsPadding() {
+			for j := range chunk {
+				chunk[j] = 0
+			}
+		} else if err := s.readFile(file, chunk, pos-fileStart); err != nil {
+			return read, err
+		}
+		read += len(chunk)
+		fileStart = fileEnd
+	}
+	if read < len(buf) {
+		return read, io.EOF
+	}
+	return read, nil
+}
+
+func (s *filesStorage) readFile(file *bencodeTorrentFile, buf []byte, off int64) error {
+	f, err := os.Open(filepath.Join(s.dir, file.EncodeFileName()))
+	if err != nil {
+		return fmt.Errorf("open file error: %v", err)
+	}
+	defer f.Close()
+
+	if _, err := f.ReadAt(buf, off); err != nil {
+		return fmt.Errorf("read file error: %v", err)
+	}
+	return nil
+}
@@ -4,7 +4,6 @@ import (
 	"bytes"
 	"context"
 	"crypto/rand"
-	"crypto/sha1"
 	"encoding/hex"
 	"fmt"
 	"io"
@@ -14,8 +13,8 @@ import (
 	"torrentClient/fsWriter"
 	"torrentClient/p2p"
 	"torrentClient/parser/env"
+	"torrentClient/peerServer"
 
-	"github.com/jackpal/bencode-go"
 	"github.com/sirupsen/logrus"
 )
 
@@ -37,39 +36,26 @@ func (t *torrentsManager) ReadTorrentFileFromBytes(body io.Reader) (TorrentFile,
 }
 
 func (t *torrentsManager) ParseReaderToTorrent(body io.Reader) (TorrentFile, error) {
-	btoSingle := bencodeTorrentSingleFile{}
-	btoMultiFile := bencodeTorrentMultiFiles{}
-
 	readBody, err := io.ReadAll(body)
 	if err != nil {
 		logrus.Errorf("error readall body: %v", err)
 		return TorrentFile{}, err
 	}
-	err = bencode.Unmarshal(bytes.NewBuffer(readBody), &btoSingle)
-	if err != nil {
-		return TorrentFile{}, err
-	}
-	err = bencode.Unmarshal(bytes.NewBuffer(readBody), &btoMultiFile)
+	meta, err := decodeMetaInfo(readBody)
 	if err != nil {
 		return TorrentFile{}, err
 	}
 	logrus.Infof("Parsed torrent!")
 
-	var result TorrentFile
-
-	if btoSingle.Info.Length == 0 {
-		result, err = btoMultiFile.toTorrentFile()
-	} else {
-		result, err = btoSingle.toTorrentFile()
-	}
+	result, err := meta.toTorrentFile()
 	if err != nil {
 		logrus.Errorf("Error creating torret from bto: %v", err)
+		return TorrentFile{}, err
 	}
 
-	logrus.Infof("Bto info: name='%v'; len=%v; files = %v; pieces = (%v)",
-		result.Name, result.Length, result.Files,
-		[]string{hex.EncodeToString(result.PieceHashes[0][:]),
-			hex.EncodeToString(result.PieceHashes[1][:])})
+	logrus.Infof("Bto info: name='%v'; len=%v; files = %v; pieces = %v; info_hash = %v",
+		result.Name, result.Length, result.Files, len(result.PieceHashes),
+		hex.EncodeToString(result.InfoHash[:]))
 	return result, nil
 }
 
@@ -77,31 +63,56 @@ func GetManager() TorrentFilesManager {
 	return &torrentsManager{}
 }
 
-func (t *TorrentFile) DownloadToFile() error {
-	downloadCtx, downloadCancel := context.WithCancel(context.Background())
+// ReadTorrentOrMagnet parses the stored .torrent or, if there is none,
+// resolves the magnet link through the swarm
+func ReadTorrentOrMagnet(torrentBytes []byte, magnetLink string) (TorrentFile, error) {
+	if len(torrentBytes) == 0 && len(magnetLink) > 0 {
+		return GetManager().ReadTorrentFileFromMagnet(magnetLink)
+	}
+	return GetManager().ReadTorrentFileFromBytes(bytes.NewBuffer(torrentBytes))
+}
+
+// DownloadToFile downloads the torrent until it's complete or ctx is done
+func (t *TorrentFile) DownloadToFile(ctx context.Context) error {
+	downloadCtx, downloadCancel := context.WithCancel(ctx)
 	defer downloadCancel()
 
 	t.InitMyPeerIDAndPort()
+	registerActiveTorrent(t)
+	defer unregisterActiveTorrent(t)
 
 	peersPoolObj := PeersPool{}
 	peersPoolObj.InitPool()
 	defer peersPoolObj.DestroyPool()
 	peersPoolObj.SetTorrent(t)
+
+	torrent := t.torrentMeta()
+	torrent.ResultsChan = make(chan p2p.LoadedPiece, 100)
+	torrent.Strategy = p2p.NewStrategy(env.GetParser().GetPiecePickerStrategy())
+	torrent.Storage = t.newFilesStorage()
+	// Parts kept in the database are written to disk once the recheck has read it
+	torrent.AfterRecheck = func() {
+		go t.SaveLoadedPiecesToFS()
+	}
+	stats := p2p.NewTransferStats(torrent.DataLength())
+	torrent.Stats = stats
+
+	trackers := NewTrackerManager(t, stats)
 	poolCtx, poolCancel := context.WithCancel(downloadCtx)
 	defer poolCancel()
 	go peersPoolObj.StartRefreshing(poolCtx)
-
-	torrent := p2p.TorrentMeta{
-		ActiveClientsChan: peersPoolObj.ActiveClientsChan,
-		PeerID:      t.Download.MyPeerId,
-		InfoHash:    t.InfoHash,
-		PieceHashes: t.PieceHashes,
-		PieceLength: t.PieceLength,
-		Length:      t.Length,
-		Name:        t.Name,
-		FileId: 	 t.SysInfo.FileId,
-		ResultsChan: make(chan p2p.LoadedPiece, 100),
+	go peersPoolObj.StartTrackerAnnounces(poolCtx, trackers)
+	go peersPoolObj.StartDhtLookup(poolCtx)
+	torrent.ActiveClientsChan = peersPoolObj.StartPex(poolCtx, peersPoolObj.ActiveClientsChan)
+
+	incoming := &peerServer.Torrent{
+		InfoHashes: t.SwarmInfoHashes(),
+		PeerID:     t.Download.MyPeerId,
+		Clients:    peersPoolObj.ActiveClientsChan,
+		Peers:      torrent.ConnectedPeers,
 	}
+	peerServer.GetServer().Register(incoming)
+	defer peerServer.GetServer().Unregister(incoming)
 
 	db.GetFilesManagerDb().PreparePlaceForFile(torrent.FileId)
 	//defer db.GetFilesManagerDb().RemoveFilePartsPlace(torrent.FileId)
@@ -109,16 +120,49 @@ func (t *TorrentFile) DownloadToFile() error {
 	videoFile := t.getHeaviestFile()
 	db.GetFilesManagerDb().SetFileNameForRecord(t.SysInfo.FileId, videoFile.EncodeFileName())
 
-	go t.WaitForDataAndWriteToDisk(downloadCtx, torrent.ResultsChan)
+	written := make(chan struct{})
+	go func() {
+		t.WaitForDataAndWriteToDisk(downloadCtx, torrent.ResultsChan)
+		close(written)
+	}()
 
-	if err := torrent.Download(downloadCtx); err != nil {
+	err := torrent.Download(downloadCtx)
+	// Download is the only sender, the writer returns once it has written what was sent
+	close(torrent.ResultsChan)
+	<-written
+	if err != nil {
 		return fmt.Errorf("file download error: %v", err)
 	}
 
+	if ctx.Err() != nil {
+		logrus.Infof("Download for %v stopped", t.SysInfo.FileId)
+		return nil
+	}
+	if stats.Left() == 0 {
+		trackers.Completed()
+	}
 	logrus.Infof("Download for %v completed!", t.SysInfo.FileId)
 	return nil
 }
 
+// torrentMeta describes the torrent to the p2p download
+func (t *TorrentFile) torrentMeta() p2p.TorrentMeta {
+	fileOffset, fileLength := t.heaviestFileBounds()
+	return p2p.TorrentMeta{
+		PeerID:      t.Download.MyPeerId,
+		InfoHash:    t.InfoHash,
+		SwarmInfoHashes: t.SwarmInfoHashes(),
+		PieceHashes: t.PieceHashes,
+		PieceHashesV2: t.piecesV2(),
+		PieceLength: t.PieceLength,
+		Length:      t.Length,
+		Name:        t.Name,
+		FileId: 	 t.SysInfo.FileId,
+		FileOffset:  int(fileOffset),
+		FileLength:  int(fileLength),
+	}
+}
+
 func (t *TorrentFile) PrepareFile() (string, int64) {
 	videoFile := t.getHeaviestFile()
 	fsWriter.GetWriter().CreateEmptyFile(videoFile.EncodeFileName())
@@ -176,11 +220,17 @@ func (t *TorrentFile) WaitForDataAndWriteToDisk(ctx context.Context, dataParts c
 		select {
 		case <- ctx.Done():
 			logrus.Debugf("Got DONE in ctx in WaitForDataAndWriteToDisk, exiting!")
-			close(dataParts)
 			return
-		case loaded := <- dataParts:
+		case loaded, ok := <- dataParts:
+			if !ok {
+				logrus.Debugf("All loaded parts are written, exiting WaitForDataAndWriteToDisk")
+				return
+			}
 			logrus.Debugf("Got loaded part: start=%v, len=%v", loaded.StartByte, loaded.Len)
 			for _, file := range files {
+				if t.Files[file.Index].IsPadding() {
+					continue
+				}
 				if loaded.StartByte > file.End || loaded.StartByte + loaded.Len < file.Start {
 					//logrus.Debugf("Skipping '%v' write due to (%v, %v); (%v, %v)", file.FileName, loaded.StartByte > file.End, loaded.StartByte + loaded.Len < file.Start, file.Start, file.End)
 					continue
@@ -216,16 +266,6 @@ func (t *TorrentFile) WaitForDataAndWriteToDisk(ctx context.Context, dataParts c
 	}
 }
 
-func (i *bencodeInfoSingleFile) hash() ([20]byte, error) {
-	var buf bytes.Buffer
-	err := bencode.Marshal(&buf, *i)
-	if err != nil {
-		return [20]byte{}, err
-	}
-	h := sha1.Sum(buf.Bytes())
-	return h, nil
-}
-
 func (t *TorrentFile) SaveLoadedPiecesToFS() error {
 	start := 0
 
@@ -253,90 +293,3 @@ func (t *TorrentFile) SaveLoadedPiecesToFS() error {
 	loadCtx.Done()
 	return nil
 }
-
-func (i *bencodeInfoMultiFiles) hash() ([20]byte, error) {
-	var buf bytes.Buffer
-	err := bencode.Marshal(&buf, *i)
-	if err != nil {
-		return [20]byte{}, err
-	}
-	h := sha1.Sum(buf.Bytes())
-	return h, nil
-}
-
-func (i *bencodeInfoSingleFile) splitPieceHashes() ([][20]byte, error) {
-	hashLen := 20 // Length of SHA-1 hash
-	buf := []byte(i.Pieces)
-	if len(buf)%hashLen != 0 {
-		err := fmt.Errorf("Received malformed pieces of length %d", len(buf))
-		return nil, err
-	}
-	numHashes := len(buf) / hashLen
-	hashes := make([][20]byte, numHashes)
-
-	for i := 0; i < numHashes; i++ {
-		copy(hashes[i][:], buf[i*hashLen:(i+1)*hashLen])
-	}
-	return hashes, nil
-}
-
-func (i *bencodeInfoMultiFiles) splitPieceHashes() ([][20]byte, error) {
-	hashLen := 20 // Length of SHA-1 hash
-	buf := []byte(i.Pieces)
-	if len(buf)%hashLen != 0 {
-		err := fmt.Errorf("Received malformed pieces of length %d", len(buf))
-		return nil, err
-	}
-	numHashes := len(buf) / hashLen
-	hashes := make([][20]byte, numHashes)
-
-	for i := 0; i < numHashes; i++ {
-		copy(hashes[i][:], buf[i*hashLen:(i+1)*hashLen])
-	}
-	return hashes, nil
-}
-
-func (bto *bencodeTorrentSingleFile) toTorrentFile() (TorrentFile, error) {
-	infoHash, err := bto.Info.hash()
-	if err != nil {
-		return TorrentFile{}, err
-	}
-	pieceHashes, err := bto.Info.splitPieceHashes()
-	if err != nil {
-		return TorrentFile{}, err
-	}
-	t := TorrentFile{
-		Announce:    bto.Announce,
-		AnnounceList: UnfoldArray(bto.AnnounceList),
-		InfoHash:    infoHash,
-		PieceHashes: pieceHashes,
-		PieceLength: bto.Info.PieceLength,
-		Length:      bto.Info.Length,
-		Name:        bto.Info.Name,
-	}
-	return t, nil
-}
-
-func (bto *bencodeTorrentMultiFiles) toTorrentFile() (TorrentFile, error) {
-	infoHash, err := bto.Info.hash()
-	if err != nil {
-		return TorrentFile{}, err
-	}
-	pieceHashes, err := bto.Info.splitPieceHashes()
-	if err != nil {
-		return TorrentFile{}, err
-	}
-	t := TorrentFile{
-		Announce:     bto.Announce,
-		AnnounceList: UnfoldArray(bto.AnnounceList),
-		InfoHash:     infoHash,
-		PieceHashes:  pieceHashes,
-		PieceLength:  bto.Info.PieceLength,
-		Length:       bto.SumFilesLength(),
-		Files:        bto.Info.Files,
-		Name:         bto.Info.Name,
-		SysInfo:      SystemInfo{},
-		Download:     DownloadUtils{},
-	}
-	return t, nil
-}
@@ -0,0 +1,48 @@
+package torrentfile
+
+import (
+	"testing"
+
+	"torrentClient/p2p"
+)
+
+// TestTransferStatsSkipPadding loads every piece of a pure v2 multi-file
+// torrent, whose Length counts the padding between files peers don't send
+func TestTransferStatsSkipPadding(t *testing.T) {
+	torrent := parseTestdata(t, "pure_v2.torrent")
+	meta := torrent.torrentMeta()
+
+	// Lengths of docs/readme.txt, video.mkv and zsub.srt
+	const filesLength = 1000 + 100000 + 40000
+	if got := meta.DataLength(); got != filesLength {
+		t.Fatalf("got data length %v, want %v", got, filesLength)
+	}
+
+	stats := p2p.NewTransferStats(meta.DataLength())
+	for _, piece := range meta.PieceHashesV2 {
+		stats.Loaded(piece.DataLength)
+	}
+	if left := stats.Left(); left != 0 {
+		t.Errorf("%v bytes are left after loading every piece", left)
+	}
+}
+
+func TestTransferStatsHybrid(t *testing.T) {
+	torrent := parseTestdata(t, "hybrid.torrent")
+	meta := torrent.torrentMeta()
+
+	// Hybrid torrents send padding files as parts of v1 pieces
+	if got := meta.DataLength(); got != torrent.Length {
+		t.Errorf("got data length %v, want %v", got, torrent.Length)
+	}
+}
+
+func TestServedFileBounds(t *testing.T) {
+	torrent := parseTestdata(t, "multi_v1.torrent")
+	meta := torrent.torrentMeta()
+
+	// video.mkv goes after the 1000 bytes of docs/readme.txt
+	if meta.FileOffset != 1000 || meta.FileLength != 100000 {
+		t.Errorf("served file is at %v with length %v, want 1000 and 100000", meta.FileOffset, meta.FileLength)
+	}
+}
@@ -0,0 +1,324 @@
+package torrentfile
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	mathRand "math/rand"
+	"sync"
+	"time"
+
+	"torrentClient/p2p"
+	"torrentClient/peers"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// trackerMinBackoff is the delay after the first failure, doubled on every next one
+	trackerMinBackoff = 15 * time.Second
+	trackerMaxBackoff = 30 * time.Minute
+	// defaultAnnounceInterval is used until a tracker tells its own interval
+	defaultAnnounceInterval = 30 * time.Minute
+	minAnnounceInterval     = time.Minute
+)
+
+// TrackerStatus is the state of one tracker as shown through the API
+type TrackerStatus struct {
+	Announce     string    `json:"announce"`
+	Tier         int       `json:"tier"`
+	Failures     int       `json:"failures"`
+	LastError    string    `json:"lastError,omitempty"`
+	LastAnnounce time.Time `json:"lastAnnounce"`
+	LastSuccess  time.Time `json:"lastSuccess"`
+	NextRetry    time.Time `json:"nextRetry"`
+	Interval     float64   `json:"intervalSeconds"`
+	Peers        int       `json:"peers"`
+	Seeders      int       `json:"seeders"`
+	Leechers     int       `json:"leechers"`
+	Warning      string    `json:"warning,omitempty"`
+
+	trackerId string
+	started   bool
+}
+
+// TrackerManager announces a torrent to its trackers honouring BEP 12 tiers:
+// trackers in a tier are shuffled once, the one that answered is moved to
+// the front of its tier and next tiers are only tried if a whole tier fails
+type TrackerManager struct {
+	mu      sync.Mutex
+	torrent *TorrentFile
+	stats   *p2p.TransferStats
+	tiers   [][]*TrackerStatus
+}
+
+var trackerManagersMu sync.Mutex
+var trackerManagers = make(map[string]*TrackerManager)
+
+// NewTrackerManager creates a manager for the torrent's announce tiers,
+// stats are reported to trackers in every announce
+func NewTrackerManager(t *TorrentFile, stats *p2p.TransferStats) *TrackerManager {
+	m := &TrackerManager{torrent: t, stats: stats}
+	for i, tier := range t.AnnounceTiers {
+		states := make([]*TrackerStatus, len(tier))
+		for j, announce := range tier {
+			states[j] = &TrackerStatus{Announce: announce, Tier: i}
+		}
+		mathRand.Shuffle(len(states), func(a, b int) {
+			states[a], states[b] = states[b], states[a]
+		})
+		m.tiers = append(m.tiers, states)
+	}
+	return m
+}
+
+// GetTrackersStatus returns trackers state of an active download
+func GetTrackersStatus(fileId string) ([]TrackerStatus, bool) {
+	trackerManagersMu.Lock()
+	m, ok := trackerManagers[fileId]
+	trackerManagersMu.Unlock()
+	if !ok {
+		return nil, false
+	}
+	return m.Status(), true
+}
+
+func registerTrackerManager(fileId string, m *TrackerManager) {
+	trackerManagersMu.Lock()
+	defer trackerManagersMu.Unlock()
+	trackerManagers[fileId] = m
+}
+
+func unregisterTrackerManager(fileId string, m *TrackerManager) {
+	trackerManagersMu.Lock()
+	defer trackerManagersMu.Unlock()
+	if trackerManagers[fileId] == m {
+		delete(trackerManagers, fileId)
+	}
+}
+
+// Status returns a copy of every tracker state in tier order
+func (m *TrackerManager) Status() []TrackerStatus {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	res := make([]TrackerStatus, 0)
+	for _, tier := range m.tiers {
+		for _, state := range tier {
+			res = append(res, *state)
+		}
+	}
+	return res
+}
+
+// Announce asks trackers tier by tier until one of them answers.
+// Trackers which weren't announced to yet get the started event
+func (m *TrackerManager) Announce(event string) ([]peers.Peer, time.Duration, error) {
+	for tierIdx := range m.tiers {
+		m.mu.Lock()
+		tier := append([]*TrackerStatus{}, m.tiers[tierIdx]...)
+		m.mu.Unlock()
+
+		for _, state := range tier {
+			m.mu.Lock()
+			skip := time.Now().Before(state.NextRetry)
+			m.mu.Unlock()
+			if skip {
+				continue
+			}
+
+			res, err := m.announceTo(state, event)
+			m.saveResult(tierIdx, state, res, err)
+			if err != nil {
+				logrus.Errorf("Tracker %v failed: %v", state.Announce, err)
+				continue
+			}
+			return res.peers, res.interval, nil
+		}
+	}
+	return nil, trackerMinBackoff, fmt.Errorf("no tracker answered")
+}
+
+type announceResult struct {
+	peers     []peers.Peer
+	interval  time.Duration
+	trackerId string
+	warning   string
+	seeders   int
+	leechers  int
+}
+
+func (m *TrackerManager) announceTo(state *TrackerStatus, event string) (announceResult, error) {
+	m.mu.Lock()
+	trackerId := state.trackerId
+	if event == EventNone && !state.started {
+		event = EventStarted
+	}
+	m.mu.Unlock()
+
+	res := announceResult{peers: make([]peers.Peer, 0), interval: defaultAnnounceInterval, trackerId: trackerId}
+	// A hybrid torrent is announced under both infohashes, it fails only if every one fails
+	var lastErr error
+	answered := false
+
+	for _, infoHash := range m.torrent.SwarmInfoHashes() {
+		tracker := newTracker(state.Announce, infoHash, m.torrent.Download, m.torrent.Length)
+		tracker.Event = event
+		tracker.TrackerId = trackerId
+		if m.stats != nil {
+			tracker.Downloaded = m.stats.Downloaded()
+			tracker.Uploaded = m.stats.Uploaded()
+			tracker.Left = m.stats.Left()
+		}
+
+		found, err := tracker.CallFittingScheme()
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		for i := range found {
+			found[i].InfoHash = infoHash
+		}
+		res.peers = append(res.peers, found...)
+		interval := tracker.TrackerCallInterval
+		if tracker.MinInterval > interval {
+			interval = tracker.MinInterval
+		}
+		if interval > 0 && interval < res.interval {
+			res.interval = interval
+		}
+		if tracker.TrackerId != "" {
+			res.trackerId = tracker.TrackerId
+		}
+		res.warning = tracker.Warning
+		res.seeders += tracker.Seeders
+		res.leechers += tracker.Leechers
+		answered = true
+	}
+	if !answered {
+		return res, lastErr
+	}
+	if res.interval < minAnnounceInterval {
+		res.interval = minAnnounceInterval
+	}
+	return res, nil
+}
+
+func (m *TrackerManager) saveResult(tierIdx int, state *TrackerStatus, res announceResult, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	state.LastAnnounce = time.Now()
+	if err != nil {
+		state.Failures++
+		state.LastError = err.Error()
+		backoff := trackerMinBackoff << uint(state.Failures-1)
+		if backoff > trackerMaxBackoff || backoff <= 0 {
+			backoff = trackerMaxBackoff
+		}
+		state.NextRetry = time.Now().Add(backoff)
+		return
+	}
+
+	state.Failures = 0
+	state.LastError = ""
+	state.LastSuccess = state.LastAnnounce
+	state.NextRetry = time.Time{}
+	state.Interval = res.interval.Seconds()
+	state.Peers = len(res.peers)
+	state.Seeders = res.seeders
+	state.Leechers = res.leechers
+	state.Warning = res.warning
+	state.trackerId = res.trackerId
+	state.started = true
+
+	// Promote the tracker that answered to the front of its tier
+	tier := m.tiers[tierIdx]
+	for i, existing := range tier {
+		if existing == state {
+			copy(tier[1:i+1], tier[:i])
+			tier[0] = state
+			break
+		}
+	}
+}
+
+// Completed tells trackers the download has finished
+func (m *TrackerManager) Completed() {
+	if _, _, err := m.Announce(EventCompleted); err != nil {
+		logrus.Errorf("Completed announce for %v failed: %v", m.torrent.SysInfo.FileId, err)
+	}
+}
+
+// Stopped tells every tracker which knows about us that we leave the swarm
+func (m *TrackerManager) Stopped() {
+	m.mu.Lock()
+	started := make([]*TrackerStatus, 0)
+	for _, tier := range m.tiers {
+		for _, state := range tier {
+			if state.started {
+				started = append(started, state)
+			}
+		}
+	}
+	m.mu.Unlock()
+
+	for _, state := range started {
+		if _, err := m.announceTo(state, EventStopped); err != nil {
+			logrus.Warnf("Stopped announce to %v failed: %v", state.Announce, err)
+		}
+		m.mu.Lock()
+		state.started = false
+		m.mu.Unlock()
+	}
+}
+
+// StartTrackerAnnounces announces the torrent with its tracker manager
+// and adds received peers to the pool. Trackers get the stopped event
+// once ctx is done
+func (p *PeersPool) StartTrackerAnnounces(ctx context.Context, manager *TrackerManager) {
+	if len(p.torrent.AnnounceTiers) == 0 {
+		return
+	}
+	registerTrackerManager(p.torrent.SysInfo.FileId, manager)
+	defer unregisterTrackerManager(p.torrent.SysInfo.FileId, manager)
+	defer manager.Stopped()
+
+	for {
+		found, interval, err := manager.Announce(EventNone)
+		if err != nil {
+			logrus.Errorf("Announce for %v failed: %v", p.torrent.SysInfo.FileId, err)
+		} else {
+			added := p.AddPeers(found)
+			logrus.Infof("Trackers gave %v peers for %v, %v new", len(found), p.torrent.SysInfo.FileId, added)
+		}
+
+		timer := time.NewTimer(interval)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+	}
+}
+
+func newTracker(announce string, infoHash [20]byte, self DownloadUtils, left int) *Tracker {
+	var transactionId [4]byte
+	rand.Read(transactionId[:])
+	return &Tracker{
+		Announce:      announce,
+		TransactionId: binary.BigEndian.Uint32(transactionId[:]),
+		MyPeerId:      self.MyPeerId,
+		MyPeerPort:    self.MyPeerPort,
+		InfoHash:      infoHash,
+		Length:        left,
+		Left:          int64(left),
+	}
+}
+
+// HasTrackers reports whether the torrent has at least one tracker
+func (t *TorrentFile) HasTrackers() bool {
+	return len(t.AnnounceTiers) > 0
+}
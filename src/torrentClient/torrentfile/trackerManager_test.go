@@ -0,0 +1,47 @@
+package torrentfile
+
+import (
+	"fmt"
+	"testing"
+
+	"torrentClient/merkle"
+)
+
+func TestHybridAnnounceOneHashFails(t *testing.T) {
+	torrent := &TorrentFile{
+		InfoHash:    [20]byte{1},
+		InfoHashV2:  merkle.Hash{2},
+		PieceHashes: [][20]byte{{3}},
+		Length:      100,
+	}
+	swarms := torrent.SwarmInfoHashes()
+	if len(swarms) != 2 {
+		t.Fatalf("hybrid torrent has %v swarms", len(swarms))
+	}
+
+	// The tracker knows the torrent under its v1 infohash only, the v2 one is announced last
+	fake := newFakeUdpTracker(t, func(transId uint32, infoHash [20]byte) [][]byte {
+		if infoHash != swarms[0] {
+			return [][]byte{errorResp(transId, "torrent not registered")}
+		}
+		return announceResp(transId, infoHash)
+	})
+	m := &TrackerManager{torrent: torrent}
+	state := &TrackerStatus{Announce: fmt.Sprintf("udp://%v", fake.addr())}
+
+	res, err := m.announceTo(state, EventNone)
+	if err != nil {
+		t.Fatalf("announce failed though the v1 swarm answered: %v", err)
+	}
+	if len(res.peers) != 2 || res.seeders != 5 {
+		t.Errorf("got %v peers and %v seeders, want the v1 swarm's 2 and 5", len(res.peers), res.seeders)
+	}
+
+	fake = newFakeUdpTracker(t, func(transId uint32, _ [20]byte) [][]byte {
+		return [][]byte{errorResp(transId, "torrent not registered")}
+	})
+	state = &TrackerStatus{Announce: fmt.Sprintf("udp://%v", fake.addr())}
+	if _, err := m.announceTo(state, EventNone); err == nil {
+		t.Error("announce succeeded though every infohash failed")
+	}
+}
@@ -0,0 +1,337 @@
+package torrentfile
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"net/url"
+	"sync"
+	"time"
+
+	"torrentClient/parser/env"
+	"torrentClient/peers"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// udpConnIdLifetime is how long a connection id may be used (BEP 15)
+	udpConnIdLifetime = time.Minute
+	// udpMaxRetries caps n in the 15 * 2 ^ n retransmission timeout
+	udpMaxRetries = 3
+
+	udpConnectRespLength  = 16
+	udpAnnounceRespLength = 20
+	udpScrapeRespLength   = 20
+	udpErrorRespLength    = 8
+)
+
+// udpEvents maps announce events to their BEP 15 codes
+var udpEvents = map[string]uint32{
+	EventNone:      0,
+	EventCompleted: 1,
+	EventStarted:   2,
+	EventStopped:   3,
+}
+
+// udpBaseTimeout is the first retransmission timeout, it doubles on every retry
+var udpBaseTimeout = 15 * time.Second
+
+// udpAnnounceTimeout bounds a whole announce including connects and retransmissions
+var udpAnnounceTimeout = time.Minute
+
+type udpConnId struct {
+	id       uint64
+	obtained time.Time
+}
+
+// udpConnIds caches connection ids per tracker address
+var udpConnIds = struct {
+	sync.Mutex
+	ids map[string]udpConnId
+}{ids: make(map[string]udpConnId)}
+
+// udpKey identifies this client to trackers across announces
+var udpKey = func() uint32 {
+	var buf [4]byte
+	rand.Read(buf[:])
+	return binary.BigEndian.Uint32(buf[:])
+}()
+
+// callUdpTracker announces over every address family the tracker has
+// and the family policy allows, peers from all of them are merged
+func (t *Tracker) callUdpTracker() ([]peers.Peer, error) {
+	trackerUrl, err := url.Parse(t.Announce)
+	if err != nil {
+		logrus.Errorf("Error parsing tracker url (%v): %v", t.Announce, err)
+		return nil, err
+	}
+
+	type familyResult struct {
+		tracker Tracker
+		peers   []peers.Peer
+		err     error
+	}
+	policy := peers.FamilyPolicy(env.GetParser().GetPeerFamilyPolicy())
+	results := make(chan familyResult, 2)
+	started := 0
+	for network, family := range map[string]peers.Family{"udp4": peers.FamilyIPv4, "udp6": peers.FamilyIPv6} {
+		if !policy.Allows(family) {
+			continue
+		}
+		addr, err := net.ResolveUDPAddr(network, trackerUrl.Host)
+		if err != nil {
+			continue
+		}
+		started++
+		go func(network string, addr *net.UDPAddr, tracker Tracker) {
+			found, err := tracker.announceUdpAddr(network, addr)
+			results <- familyResult{tracker: tracker, peers: found, err: err}
+		}(network, addr, *t)
+	}
+	if started == 0 {
+		return nil, fmt.Errorf("error resolving tracker addr: %v", trackerUrl.Host)
+	}
+
+	res := make([]peers.Peer, 0)
+	var lastErr error
+	answered := false
+	for i := 0; i < started; i++ {
+		result := <-results
+		if result.err != nil {
+			lastErr = result.err
+			continue
+		}
+		res = append(res, result.peers...)
+		if !answered || result.tracker.TrackerCallInterval < t.TrackerCallInterval {
+			t.TrackerCallInterval = result.tracker.TrackerCallInterval
+		}
+		if result.tracker.Seeders > t.Seeders {
+			t.Seeders = result.tracker.Seeders
+		}
+		if result.tracker.Leechers > t.Leechers {
+			t.Leechers = result.tracker.Leechers
+		}
+		t.ConnectionId = result.tracker.ConnectionId
+		t.TransactionId = result.tracker.TransactionId
+		answered = true
+	}
+	if !answered {
+		return nil, lastErr
+	}
+	return res, nil
+}
+
+func (t *Tracker) announceUdpAddr(network string, addr *net.UDPAddr) ([]peers.Peer, error) {
+	conn, err := net.DialUDP(network, nil, addr)
+	if err != nil {
+		return nil, fmt.Errorf("error dialing tracker: %v", err)
+	}
+	defer conn.Close()
+
+	return t.makeAnnounceUdpReq(conn, time.Now().Add(udpAnnounceTimeout))
+}
+
+// getUdpConnectionId returns a cached connection id or requests a new one before deadline
+func (t *Tracker) getUdpConnectionId(conn *net.UDPConn, deadline time.Time) (uint64, error) {
+	key := conn.RemoteAddr().String()
+
+	udpConnIds.Lock()
+	cached, ok := udpConnIds.ids[key]
+	udpConnIds.Unlock()
+	if ok && time.Since(cached.obtained) < udpConnIdLifetime {
+		return cached.id, nil
+	}
+
+	for n := 0; n <= udpMaxRetries && time.Now().Before(deadline); n++ {
+		transId := t.newTransactionId()
+		req := make([]byte, 16)
+		binary.BigEndian.PutUint64(req[0:8], protocolId)
+		binary.BigEndian.PutUint32(req[8:12], connectAction)
+		binary.BigEndian.PutUint32(req[12:16], transId)
+
+		body, err := t.udpRoundTrip(conn, req, connectAction, transId, udpConnectRespLength, udpRetryDeadline(n, deadline))
+		if err == errUdpTimeout {
+			continue
+		}
+		if err != nil {
+			return 0, err
+		}
+
+		id := binary.BigEndian.Uint64(body[8:16])
+		udpConnIds.Lock()
+		udpConnIds.ids[key] = udpConnId{id: id, obtained: time.Now()}
+		udpConnIds.Unlock()
+		t.ConnectionId = id
+		logrus.Infof("Connect announce resp: conn_id=%v trans_id=%v", id, transId)
+		return id, nil
+	}
+	return 0, fmt.Errorf("tracker connect timed out")
+}
+
+func forgetUdpConnectionId(conn *net.UDPConn) {
+	udpConnIds.Lock()
+	delete(udpConnIds.ids, conn.RemoteAddr().String())
+	udpConnIds.Unlock()
+}
+
+func (t *Tracker) makeAnnounceUdpReq(conn *net.UDPConn, deadline time.Time) ([]peers.Peer, error) {
+	retries := udpMaxRetries
+	if t.Event == EventStopped {
+		// Nobody waits for an answer on stop, don't hold the caller for minutes
+		retries = 0
+	}
+	for n := 0; n <= retries && time.Now().Before(deadline); n++ {
+		connId, err := t.getUdpConnectionId(conn, deadline)
+		if err != nil {
+			return nil, err
+		}
+
+		transId := t.newTransactionId()
+		body, err := t.udpRoundTrip(conn, t.udpAnnounceRequest(connId, transId), announceAction, transId, udpAnnounceRespLength, udpRetryDeadline(n, deadline))
+		if err == errUdpTimeout {
+			continue
+		}
+		if err != nil {
+			// The connection id may be stale for the tracker, take a new one next time
+			forgetUdpConnectionId(conn)
+			return nil, err
+		}
+
+		interval := binary.BigEndian.Uint32(body[8:12])
+		t.Leechers = int(binary.BigEndian.Uint32(body[12:16]))
+		t.Seeders = int(binary.BigEndian.Uint32(body[16:20]))
+		t.TrackerCallInterval = time.Duration(interval) * time.Second
+
+		logrus.Infof("Interval = %v; leechers = %v; seeders = %v;", t.TrackerCallInterval, t.Leechers, t.Seeders)
+		// Trackers answer IPv6 announces with 18-byte IPv6 peers
+		unmarshal := peers.Unmarshal
+		if remote, ok := conn.RemoteAddr().(*net.UDPAddr); ok && remote.IP.To4() == nil {
+			unmarshal = peers.Unmarshal6
+		}
+		parsedPeers, err := unmarshal(body[20:])
+		if err != nil {
+			return nil, fmt.Errorf("error parsing udp announce peers: %v", err)
+		}
+		logrus.Infof("Got peers: %v", parsedPeers)
+		return parsedPeers, nil
+	}
+	return nil, fmt.Errorf("tracker announce timed out")
+}
+
+// makeScrapeUdpReq asks the tracker for swarm stats of the torrent before deadline
+func (t *Tracker) makeScrapeUdpReq(conn *net.UDPConn, deadline time.Time) error {
+	for n := 0; n <= udpMaxRetries && time.Now().Before(deadline); n++ {
+		connId, err := t.getUdpConnectionId(conn, deadline)
+		if err != nil {
+			return err
+		}
+
+		transId := t.newTransactionId()
+		req := make([]byte, 36)
+		binary.BigEndian.PutUint64(req[0:8], connId)
+		binary.BigEndian.PutUint32(req[8:12], scrapeAction)
+		binary.BigEndian.PutUint32(req[12:16], transId)
+		copy(req[16:36], t.InfoHash[:])
+
+		body, err := t.udpRoundTrip(conn, req, scrapeAction, transId, udpScrapeRespLength, udpRetryDeadline(n, deadline))
+		if err == errUdpTimeout {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		t.Seeders = int(binary.BigEndian.Uint32(body[8:12]))
+		completed := binary.BigEndian.Uint32(body[12:16])
+		t.Leechers = int(binary.BigEndian.Uint32(body[16:20]))
+		logrus.Infof("Scrape res: completed = %v; leechers = %v; seeders = %v;", completed, t.Leechers, t.Seeders)
+		return nil
+	}
+	return fmt.Errorf("tracker scrape timed out")
+}
+
+func (t *Tracker) udpAnnounceRequest(connId uint64, transId uint32) []byte {
+	req := make([]byte, 98)
+	binary.BigEndian.PutUint64(req[0:8], connId)
+	binary.BigEndian.PutUint32(req[8:12], announceAction)
+	binary.BigEndian.PutUint32(req[12:16], transId)
+	copy(req[16:36], t.InfoHash[:])
+	copy(req[36:56], t.MyPeerId[:])
+	binary.BigEndian.PutUint64(req[56:64], uint64(t.Downloaded))
+	binary.BigEndian.PutUint64(req[64:72], uint64(t.Left))
+	binary.BigEndian.PutUint64(req[72:80], uint64(t.Uploaded))
+	binary.BigEndian.PutUint32(req[80:84], udpEvents[t.Event])
+	binary.BigEndian.PutUint32(req[84:88], 0) // IP, 0 means the sender's one
+	binary.BigEndian.PutUint32(req[88:92], udpKey)
+	binary.BigEndian.PutUint32(req[92:96], 0xFFFFFFFF) // num_want -1: tracker default
+	binary.BigEndian.PutUint16(req[96:98], t.MyPeerPort)
+	return req
+}
+
+var errUdpTimeout = fmt.Errorf("udp tracker timeout")
+
+// udpRoundTrip sends req and waits until deadline for a response with the same transaction id.
+// Packets with other transaction ids are skipped, error responses are returned as errors
+func (t *Tracker) udpRoundTrip(conn *net.UDPConn, req []byte, action uint32, transId uint32, minLen int, deadline time.Time) ([]byte, error) {
+	if _, err := conn.Write(req); err != nil {
+		return nil, fmt.Errorf("error sending udp tracker req: %v", err)
+	}
+
+	defer conn.SetReadDeadline(time.Time{})
+	buf := make([]byte, 65536)
+
+	for {
+		conn.SetReadDeadline(deadline)
+		n, err := conn.Read(buf)
+		if err != nil {
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+				return nil, errUdpTimeout
+			}
+			return nil, fmt.Errorf("error reading udp tracker resp: %v", err)
+		}
+		body := buf[:n]
+
+		if len(body) < udpErrorRespLength {
+			logrus.Warnf("Skipping too short udp tracker resp (%v bytes)", len(body))
+			continue
+		}
+		if respTransId := binary.BigEndian.Uint32(body[4:8]); respTransId != transId {
+			logrus.Warnf("Tracker resp trans_id (%v) != sent trans_id (%v), skipping", respTransId, transId)
+			continue
+		}
+
+		respAction := binary.BigEndian.Uint32(body[0:4])
+		if respAction == errorAction {
+			return nil, fmt.Errorf("tracker error: %v", string(body[8:]))
+		}
+		if respAction != action {
+			return nil, fmt.Errorf("tracker responded with action %v, expected %v", respAction, action)
+		}
+		if len(body) < minLen {
+			return nil, fmt.Errorf("tracker resp too short: %v < %v", len(body), minLen)
+		}
+		return append([]byte{}, body...), nil
+	}
+}
+
+func (t *Tracker) newTransactionId() uint32 {
+	var buf [4]byte
+	rand.Read(buf[:])
+	t.TransactionId = binary.BigEndian.Uint32(buf[:])
+	return t.TransactionId
+}
+
+func udpTimeout(n int) time.Duration {
+	return udpBaseTimeout * time.Duration(1<<uint(n))
+}
+
+// udpRetryDeadline is when the n-th retransmission times out, never later than the announce deadline
+func udpRetryDeadline(n int, deadline time.Time) time.Time {
+	retry := time.Now().Add(udpTimeout(n))
+	if retry.After(deadline) {
+		return deadline
+	}
+	return retry
+}
@@ -0,0 +1,242 @@
+package torrentfile
+
+import (
+	"encoding/binary"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const fakeConnId = 0xC0FFEE
+
+// fakeUdpTracker answers BEP 15 requests on a local socket
+type fakeUdpTracker struct {
+	conn *net.UDPConn
+
+	mu        sync.Mutex
+	connects  int
+	announces int
+	// answer builds responses to a valid announce, nil answers drop every request
+	answer udpAnswer
+}
+
+// udpAnswer builds responses to an announce of infoHash
+type udpAnswer func(transId uint32, infoHash [20]byte) [][]byte
+
+func newFakeUdpTracker(t *testing.T, answer udpAnswer) *fakeUdpTracker {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &fakeUdpTracker{conn: conn, answer: answer}
+	t.Cleanup(func() {
+		conn.Close()
+		udpConnIds.Lock()
+		delete(udpConnIds.ids, conn.LocalAddr().String())
+		udpConnIds.Unlock()
+	})
+	go f.serve()
+	return f
+}
+
+func (f *fakeUdpTracker) addr() *net.UDPAddr {
+	return f.conn.LocalAddr().(*net.UDPAddr)
+}
+
+func (f *fakeUdpTracker) counts() (connects, announces int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.connects, f.announces
+}
+
+func (f *fakeUdpTracker) serve() {
+	buf := make([]byte, 1500)
+	for {
+		n, from, err := f.conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		for _, resp := range f.handle(buf[:n]) {
+			f.conn.WriteToUDP(resp, from)
+		}
+	}
+}
+
+func (f *fakeUdpTracker) handle(req []byte) [][]byte {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.answer == nil || len(req) < 16 {
+		return nil
+	}
+
+	action := binary.BigEndian.Uint32(req[8:12])
+	transId := binary.BigEndian.Uint32(req[12:16])
+	switch {
+	case action == connectAction && binary.BigEndian.Uint64(req[0:8]) == protocolId:
+		f.connects++
+		resp := make([]byte, 16)
+		binary.BigEndian.PutUint32(resp[0:4], connectAction)
+		binary.BigEndian.PutUint32(resp[4:8], transId)
+		binary.BigEndian.PutUint64(resp[8:16], fakeConnId)
+		return [][]byte{resp}
+	case action == announceAction && len(req) == 98:
+		if binary.BigEndian.Uint64(req[0:8]) != fakeConnId {
+			return [][]byte{errorResp(transId, "bad connection id")}
+		}
+		f.announces++
+		var infoHash [20]byte
+		copy(infoHash[:], req[16:36])
+		return f.answer(transId, infoHash)
+	}
+	return nil
+}
+
+// announceResp has an interval of 30 minutes, 3 leechers, 5 seeders and two peers
+func announceResp(transId uint32, _ [20]byte) [][]byte {
+	resp := make([]byte, 20, 32)
+	binary.BigEndian.PutUint32(resp[0:4], announceAction)
+	binary.BigEndian.PutUint32(resp[4:8], transId)
+	binary.BigEndian.PutUint32(resp[8:12], 1800)
+	binary.BigEndian.PutUint32(resp[12:16], 3)
+	binary.BigEndian.PutUint32(resp[16:20], 5)
+	resp = append(resp, 10, 0, 0, 1, 0x1A, 0xE1, 10, 0, 0, 2, 0x1A, 0xE2)
+	return [][]byte{resp}
+}
+
+func errorResp(transId uint32, text string) []byte {
+	resp := make([]byte, 8)
+	binary.BigEndian.PutUint32(resp[0:4], errorAction)
+	binary.BigEndian.PutUint32(resp[4:8], transId)
+	return append(resp, text...)
+}
+
+func testUdpTracker() *Tracker {
+	return &Tracker{InfoHash: [20]byte{1}, MyPeerId: [20]byte{2}, MyPeerPort: 6881, Left: 100}
+}
+
+// fastUdpTimeouts shortens retransmissions so dropped packets don't stall the tests
+func fastUdpTimeouts(t *testing.T, base, announce time.Duration) {
+	prevBase, prevAnnounce := udpBaseTimeout, udpAnnounceTimeout
+	udpBaseTimeout, udpAnnounceTimeout = base, announce
+	t.Cleanup(func() {
+		udpBaseTimeout, udpAnnounceTimeout = prevBase, prevAnnounce
+	})
+}
+
+func TestUdpAnnounce(t *testing.T) {
+	fake := newFakeUdpTracker(t, announceResp)
+	tracker := testUdpTracker()
+
+	found, err := tracker.announceUdpAddr("udp4", fake.addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(found) != 2 || found[0].GetAddr() != "10.0.0.1:6881" || found[1].GetAddr() != "10.0.0.2:6882" {
+		t.Errorf("got peers %v", found)
+	}
+	if tracker.TrackerCallInterval != 30*time.Minute {
+		t.Errorf("got interval %v, want 30m", tracker.TrackerCallInterval)
+	}
+	if tracker.Leechers != 3 || tracker.Seeders != 5 {
+		t.Errorf("got %v leechers and %v seeders, want 3 and 5", tracker.Leechers, tracker.Seeders)
+	}
+	if tracker.ConnectionId != fakeConnId {
+		t.Errorf("got connection id %x, want %x", tracker.ConnectionId, fakeConnId)
+	}
+}
+
+func TestUdpTransactionIdMismatch(t *testing.T) {
+	fake := newFakeUdpTracker(t, func(transId uint32, infoHash [20]byte) [][]byte {
+		stale := announceResp(transId+1, infoHash)[0]
+		binary.BigEndian.PutUint32(stale[12:16], 99)
+		return append([][]byte{stale}, announceResp(transId, infoHash)...)
+	})
+	tracker := testUdpTracker()
+
+	if _, err := tracker.announceUdpAddr("udp4", fake.addr()); err != nil {
+		t.Fatal(err)
+	}
+	if tracker.Leechers != 3 {
+		t.Errorf("got %v leechers from a response with another transaction id", tracker.Leechers)
+	}
+}
+
+func TestUdpErrorAction(t *testing.T) {
+	fake := newFakeUdpTracker(t, func(transId uint32, _ [20]byte) [][]byte {
+		return [][]byte{errorResp(transId, "torrent not registered")}
+	})
+
+	_, err := testUdpTracker().announceUdpAddr("udp4", fake.addr())
+	if err == nil || !strings.Contains(err.Error(), "torrent not registered") {
+		t.Fatalf("got error %v, want the tracker's message", err)
+	}
+
+	udpConnIds.Lock()
+	_, cached := udpConnIds.ids[fake.addr().String()]
+	udpConnIds.Unlock()
+	if cached {
+		t.Error("connection id is kept after a tracker error")
+	}
+}
+
+func TestUdpConnectionIdCache(t *testing.T) {
+	fake := newFakeUdpTracker(t, announceResp)
+
+	for i := 0; i < 3; i++ {
+		if _, err := testUdpTracker().announceUdpAddr("udp4", fake.addr()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if connects, announces := fake.counts(); connects != 1 || announces != 3 {
+		t.Fatalf("got %v connects for %v announces, want 1 for 3", connects, announces)
+	}
+
+	key := fake.addr().String()
+	udpConnIds.Lock()
+	cached := udpConnIds.ids[key]
+	cached.obtained = cached.obtained.Add(-udpConnIdLifetime)
+	udpConnIds.ids[key] = cached
+	udpConnIds.Unlock()
+
+	if _, err := testUdpTracker().announceUdpAddr("udp4", fake.addr()); err != nil {
+		t.Fatal(err)
+	}
+	if connects, _ := fake.counts(); connects != 2 {
+		t.Errorf("got %v connects, an expired connection id must be renewed", connects)
+	}
+}
+
+func TestUdpRetransmission(t *testing.T) {
+	fastUdpTimeouts(t, 20*time.Millisecond, time.Second)
+	dropped := 0
+	fake := newFakeUdpTracker(t, func(transId uint32, infoHash [20]byte) [][]byte {
+		if dropped < 2 {
+			dropped++
+			return nil
+		}
+		return announceResp(transId, infoHash)
+	})
+
+	if _, err := testUdpTracker().announceUdpAddr("udp4", fake.addr()); err != nil {
+		t.Fatal(err)
+	}
+	if _, announces := fake.counts(); announces != 3 {
+		t.Errorf("got %v announces, want 3", announces)
+	}
+}
+
+func TestUdpAnnounceDeadline(t *testing.T) {
+	// Without the total deadline the nested connect retries would take seconds here
+	fastUdpTimeouts(t, 100*time.Millisecond, 300*time.Millisecond)
+	fake := newFakeUdpTracker(t, nil)
+
+	started := time.Now()
+	if _, err := testUdpTracker().announceUdpAddr("udp4", fake.addr()); err == nil {
+		t.Fatal("announce to a dead tracker succeeded")
+	}
+	if elapsed := time.Since(started); elapsed > time.Second {
+		t.Errorf("announce to a dead tracker took %v", elapsed)
+	}
+}
@@ -0,0 +1,542 @@
+package utp
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"os"
+	"time"
+)
+
+var errClosed = errors.New("use of closed utp connection")
+var errReset = errors.New("utp connection reset by peer")
+
+// maxReorder is how far ahead of the missing packet received packets are kept
+const maxReorder = recvBufferSize / maxPayload
+
+func newConn(s *Socket, remote net.Addr, recvID, sendID uint16) *Conn {
+	return &Conn{
+		socket:     s,
+		remote:     remote,
+		recvID:     recvID,
+		sendID:     sendID,
+		changed:    make(chan struct{}),
+		window:     minWindow,
+		slowStart:  true,
+		peerWindow: recvBufferSize,
+		timeout:    initialTimeout,
+		reorder:    make(map[uint16]inbound),
+	}
+}
+
+func (c *Conn) Read(b []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for len(c.readBuf) == 0 {
+		if c.eof {
+			return 0, io.EOF
+		}
+		if c.err != nil {
+			return 0, c.err
+		}
+		if c.state != stateConnected {
+			return 0, errClosed
+		}
+		if !c.wait(c.readDeadline) {
+			return 0, os.ErrDeadlineExceeded
+		}
+	}
+
+	wasFull := c.recvWindow() < packetSize
+	n := copy(b, c.readBuf)
+	c.readBuf = c.readBuf[n:]
+	if len(c.readBuf) == 0 {
+		c.readBuf = nil
+	}
+	if wasFull {
+		// The peer waits for the window to open
+		c.sendState()
+	}
+	return n, nil
+}
+
+// Write sends the data in packets as the congestion window allows. It
+// returns when everything is sent, not acked
+func (c *Conn) Write(b []byte) (int, error) {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	written := 0
+	for written < len(b) {
+		if c.err != nil {
+			return written, c.err
+		}
+		if c.state != stateConnected {
+			return written, errClosed
+		}
+		chunk := len(b) - written
+		if chunk > maxPayload {
+			chunk = maxPayload
+		}
+		if c.inFlight > 0 && c.inFlight+chunk > c.sendWindow() {
+			if !c.wait(c.writeDeadline) {
+				return written, os.ErrDeadlineExceeded
+			}
+			continue
+		}
+		c.queue(stData, append([]byte{}, b[written:written+chunk]...))
+		written += chunk
+	}
+	return written, nil
+}
+
+// Close sends FIN after the data written before. The connection stays
+// on the socket until the peer acks everything or stops answering
+func (c *Conn) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	switch c.state {
+	case stateConnected:
+		c.queue(stFin, nil)
+		c.state = stateFinSent
+		c.notify()
+	case stateSynSent:
+		c.closeLocked()
+	}
+	return nil
+}
+
+func (c *Conn) LocalAddr() net.Addr {
+	return c.socket.conn.LocalAddr()
+}
+
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+func (c *Conn) SetDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.readDeadline = t
+	c.writeDeadline = t
+	c.notify()
+	return nil
+}
+
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.readDeadline = t
+	c.notify()
+	return nil
+}
+
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.writeDeadline = t
+	c.notify()
+	return nil
+}
+
+// handle processes a packet of the connection got by the socket
+func (c *Conn) handle(h header, payload []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.state == stateClosed {
+		return
+	}
+	defer c.notify()
+
+	if h.typ == stReset {
+		c.fail(errReset)
+		return
+	}
+	c.peerWindow = int(h.wndSize)
+	c.replyMicro = nowMicro() - h.timestamp
+	if h.timestampDiff != 0 {
+		c.addDelaySample(h.timestampDiff)
+	}
+
+	switch h.typ {
+	case stSyn:
+		// Our answer got lost
+		c.sendState()
+		return
+	case stState:
+		if c.state == stateSynSent {
+			c.state = stateConnected
+			c.ack = h.seq - 1
+		}
+	}
+	c.processAck(h)
+
+	if h.typ == stData || h.typ == stFin {
+		c.receive(h, payload)
+	}
+}
+
+func (c *Conn) processAck(h header) {
+	acked := 0
+	now := time.Now()
+	for len(c.unacked) > 0 && !seqLess(h.ack, c.unacked[0].seq) {
+		p := c.unacked[0]
+		c.unacked = c.unacked[1:]
+		if !p.sacked {
+			c.inFlight -= len(p.payload)
+			acked += len(p.payload)
+		}
+		// Packets acked together with a retransmitted hole waited for it, only
+		// the packet the ack is sent for measures the round trip
+		if p.seq == h.ack && !p.sacked && p.transmissions == 1 {
+			c.updateRtt(now.Sub(p.sent))
+		}
+	}
+	acked += c.processSack(h, now)
+	if c.inRecovery && !seqLess(h.ack, c.recoverySeq) {
+		c.inRecovery = false
+	}
+
+	if acked > 0 {
+		c.dupAcks = 0
+		c.updateWindow(acked)
+		// A partial ack during recovery shows the next hole
+		if c.inRecovery && len(c.unacked) > 0 && !c.unacked[0].sacked && now.Sub(c.unacked[0].sent) > c.rtt {
+			c.transmit(c.unacked[0])
+		}
+	} else if h.typ == stState && h.ack == c.lastAck && len(c.unacked) > 0 {
+		c.dupAcks++
+		if c.dupAcks == 3 {
+			// The packet after the acked one is lost, the rest goes through
+			c.lost(c.unacked[0])
+		}
+	}
+	c.lastAck = h.ack
+	c.retransmitLost(now)
+}
+
+// processSack marks packets the peer has got ahead of missing ones, it
+// returns the number of newly acked bytes
+func (c *Conn) processSack(h header, now time.Time) int {
+	if len(h.sack) == 0 {
+		return 0
+	}
+	acked := 0
+	for _, p := range c.unacked {
+		bit := int(p.seq - h.ack - 2)
+		if p.sacked || bit < 0 || bit >= len(h.sack)*8 {
+			continue
+		}
+		if h.sack[bit/8]&(1<<(bit%8)) != 0 {
+			p.sacked = true
+			c.inFlight -= len(p.payload)
+			acked += len(p.payload)
+			if p.transmissions == 1 {
+				c.updateRtt(now.Sub(p.sent))
+			}
+		}
+	}
+	return acked
+}
+
+// retransmitLost resends packets which lostAfterSacked later packets have overtaken
+func (c *Conn) retransmitLost(now time.Time) {
+	sackedAfter := 0
+	for i := len(c.unacked) - 1; i >= 0; i-- {
+		p := c.unacked[i]
+		if p.sacked {
+			sackedAfter++
+			continue
+		}
+		if sackedAfter >= lostAfterSacked && now.Sub(p.sent) > c.rtt {
+			c.lost(p)
+		}
+	}
+}
+
+// lost resends a lost packet, the window is cut once per loss event
+func (c *Conn) lost(p *packet) {
+	if !c.inRecovery {
+		c.window = math.Max(c.window/2, minWindow)
+		c.slowStart = false
+		c.inRecovery = true
+		c.recoverySeq = c.seq
+	}
+	c.transmit(p)
+}
+
+// receive puts data and FIN packets in order
+func (c *Conn) receive(h header, payload []byte) {
+	if !seqLess(c.ack, h.seq) {
+		// Duplicate, our ack got lost
+		c.sendState()
+		return
+	}
+	if h.seq != c.ack+1 {
+		if uint16(h.seq-c.ack) <= maxReorder {
+			c.reorder[h.seq] = inbound{typ: h.typ, payload: payload}
+		}
+		c.sendState()
+		return
+	}
+
+	c.deliver(inbound{typ: h.typ, payload: payload})
+	for {
+		next, found := c.reorder[c.ack+1]
+		if !found {
+			break
+		}
+		delete(c.reorder, c.ack+1)
+		c.deliver(next)
+	}
+	c.sendState()
+}
+
+func (c *Conn) deliver(in inbound) {
+	c.ack++
+	if in.typ == stFin {
+		c.eof = true
+		c.reorder = make(map[uint16]inbound)
+		return
+	}
+	c.readBuf = append(c.readBuf, in.payload...)
+}
+
+func (c *Conn) tick(now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.state == stateClosed {
+		return
+	}
+
+	if c.state == stateFinSent && len(c.unacked) == 0 {
+		c.closeLocked()
+		return
+	}
+	if len(c.unacked) == 0 {
+		return
+	}
+	p := c.unacked[0]
+	if now.Sub(p.sent) < c.timeout {
+		return
+	}
+	if p.transmissions >= maxTransmissions {
+		c.fail(fmt.Errorf("utp connection to %v timed out", c.remote))
+		return
+	}
+	c.timeout *= 2
+	if c.timeout > maxTimeout {
+		c.timeout = maxTimeout
+	}
+	c.window = minWindow
+	c.slowStart = false
+	c.inRecovery = true
+	c.recoverySeq = c.seq
+	c.transmit(p)
+}
+
+func (c *Conn) updateRtt(sample time.Duration) {
+	if c.rtt == 0 {
+		c.rtt = sample
+		c.rttVar = sample / 2
+	} else {
+		delta := c.rtt - sample
+		if delta < 0 {
+			delta = -delta
+		}
+		c.rttVar += (delta - c.rttVar) / 4
+		c.rtt += (sample - c.rtt) / 8
+	}
+	c.timeout = c.rtt + 4*c.rttVar
+	if c.timeout < minTimeout {
+		c.timeout = minTimeout
+	}
+	if c.timeout > maxTimeout {
+		c.timeout = maxTimeout
+	}
+}
+
+// addDelaySample remembers the one way delay the peer measured on our packets.
+// The lowest delay of the last baseDelayWindow is taken as the delay without queuing
+func (c *Conn) addDelaySample(sample uint32) {
+	now := time.Now()
+	if c.baseStart.IsZero() {
+		c.baseDelays = [2]uint32{sample, sample}
+		c.baseStart = now
+	} else if now.Sub(c.baseStart) > baseDelayWindow/2 {
+		c.baseDelays[0] = c.baseDelays[1]
+		c.baseDelays[1] = sample
+		c.baseStart = now
+	}
+	if sample < c.baseDelays[1] {
+		c.baseDelays[1] = sample
+	}
+	c.recentDelays[c.delayIndex%len(c.recentDelays)] = sample
+	c.delayIndex++
+}
+
+// queuingDelay is how much the lowest recent delay is above the base delay
+func (c *Conn) queuingDelay() time.Duration {
+	if c.delayIndex == 0 {
+		return 0
+	}
+	base := c.baseDelays[0]
+	if c.baseDelays[1] < base {
+		base = c.baseDelays[1]
+	}
+	recent := uint32(math.MaxUint32)
+	for i := 0; i < len(c.recentDelays) && i < c.delayIndex; i++ {
+		if c.recentDelays[i] < recent {
+			recent = c.recentDelays[i]
+		}
+	}
+	if recent < base {
+		return 0
+	}
+	return time.Duration(recent-base) * time.Microsecond
+}
+
+// updateWindow grows the window in slow start until queuing shows up, then
+// LEDBAT moves it towards targetDelay: it shrinks when we add to the queue
+func (c *Conn) updateWindow(acked int) {
+	delay := c.queuingDelay()
+	if c.slowStart && delay > targetDelay/2 {
+		c.slowStart = false
+	}
+	if c.slowStart {
+		c.window += float64(acked)
+	} else {
+		offTarget := float64(targetDelay-delay) / float64(targetDelay)
+		if offTarget < -1 {
+			offTarget = -1
+		}
+		c.window += maxWindowIncrease * offTarget * float64(acked) / math.Max(c.window, float64(acked))
+	}
+	c.window = math.Max(math.Min(c.window, maxWindow), minWindow)
+}
+
+func (c *Conn) sendWindow() int {
+	if c.peerWindow < int(c.window) {
+		return c.peerWindow
+	}
+	return int(c.window)
+}
+
+func (c *Conn) recvWindow() int {
+	if free := recvBufferSize - len(c.readBuf); free > 0 {
+		return free
+	}
+	return 0
+}
+
+// queue sends a packet taking the next sequence number, it's kept until acked
+func (c *Conn) queue(typ uint8, payload []byte) {
+	p := &packet{typ: typ, seq: c.seq, payload: payload}
+	c.seq++
+	c.unacked = append(c.unacked, p)
+	c.inFlight += len(payload)
+	c.transmit(p)
+}
+
+func (c *Conn) transmit(p *packet) {
+	p.sent = time.Now()
+	p.transmissions++
+	c.send(p.typ, p.seq, p.payload)
+}
+
+func (c *Conn) sendState() {
+	c.send(stState, c.seq, nil)
+}
+
+func (c *Conn) send(typ uint8, seq uint16, payload []byte) {
+	h := header{
+		typ:           typ,
+		connID:        c.sendID,
+		timestamp:     nowMicro(),
+		timestampDiff: c.replyMicro,
+		wndSize:       uint32(c.recvWindow()),
+		seq:           seq,
+		ack:           c.ack,
+	}
+	if typ == stSyn {
+		// SYN carries the id the peer sends its packets with
+		h.connID = c.recvID
+	}
+	if len(c.reorder) > 0 {
+		h.sack = c.sackMask()
+	}
+	c.socket.conn.WriteTo(h.serialize(payload), c.remote)
+}
+
+// sackMask tells the peer which packets after the missing one we have
+func (c *Conn) sackMask() []byte {
+	mask := make([]byte, maxSackBytes)
+	last := -1
+	for seq := range c.reorder {
+		bit := int(seq - c.ack - 2)
+		if bit < 0 || bit >= maxSackBytes*8 {
+			continue
+		}
+		mask[bit/8] |= 1 << (bit % 8)
+		if bit > last {
+			last = bit
+		}
+	}
+	// The mask is sent in 4 byte words
+	return mask[:(last/32+1)*4]
+}
+
+// wait unlocks the connection until it changes or the deadline passes,
+// false is returned on the deadline
+func (c *Conn) wait(deadline time.Time) bool {
+	changed := c.changed
+	c.mu.Unlock()
+	defer c.mu.Lock()
+
+	if deadline.IsZero() {
+		<-changed
+		return true
+	}
+	d := time.Until(deadline)
+	if d <= 0 {
+		return false
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-changed:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
+
+func (c *Conn) notify() {
+	close(c.changed)
+	c.changed = make(chan struct{})
+}
+
+func (c *Conn) fail(err error) {
+	if c.err == nil {
+		c.err = err
+	}
+	c.closeLocked()
+}
+
+func (c *Conn) closeLocked() {
+	if c.state == stateClosed {
+		return
+	}
+	c.state = stateClosed
+	if c.err == nil {
+		c.err = errClosed
+	}
+	c.socket.remove(c)
+	c.notify()
+}
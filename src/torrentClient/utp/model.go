@@ -0,0 +1,176 @@
+package utp
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// Packet types
+const (
+	stData  = 0
+	stFin   = 1
+	stState = 2
+	stReset = 3
+	stSyn   = 4
+)
+
+const (
+	version    = 1
+	headerSize = 20
+	// packetSize is the largest datagram sent, it fits into common MTUs
+	packetSize = 1400
+	maxPayload = packetSize - headerSize
+
+	// targetDelay is the queuing delay LEDBAT aims at
+	targetDelay = 100 * time.Millisecond
+	// maxWindowIncrease is how much the window grows per RTT at zero delay
+	maxWindowIncrease = 3000
+	minWindow         = 2 * packetSize
+	maxWindow         = 1024 * 1024
+	// recvBufferSize is how much received data may wait for Read
+	recvBufferSize = 1024 * 1024
+	// baseDelayWindow is how long the lowest delay is remembered
+	baseDelayWindow = 2 * time.Minute
+
+	initialTimeout = time.Second
+	minTimeout     = 500 * time.Millisecond
+	maxTimeout     = 30 * time.Second
+	// extSack is the selective ack extension
+	extSack = 1
+	// maxSackBytes limits the selective ack bitmask
+	maxSackBytes = 128
+	// lostAfterSacked is how many packets acked after a missing one mark it lost
+	lostAfterSacked = 3
+	// maxTransmissions is how many times a packet is sent before the connection is dropped
+	maxTransmissions = 6
+	// tickInterval is how often connections are checked for timeouts
+	tickInterval = 100 * time.Millisecond
+	// finTimeout is how long a closed connection waits for its data to be acked
+	finTimeout    = 5 * time.Second
+	acceptBacklog = 32
+)
+
+type header struct {
+	typ           uint8
+	extension     uint8
+	connID        uint16
+	timestamp     uint32
+	timestampDiff uint32
+	wndSize       uint32
+	seq           uint16
+	ack           uint16
+	// sack is the selective ack bitmask, bit i stands for packet ack+2+i
+	sack []byte
+}
+
+// packet is a sent packet waiting for an ack
+type packet struct {
+	typ           uint8
+	seq           uint16
+	payload       []byte
+	sent          time.Time
+	transmissions int
+	// sacked is set when the peer has got the packet ahead of a lost one
+	sacked bool
+}
+
+// inbound is a packet received ahead of a missing one
+type inbound struct {
+	typ     uint8
+	payload []byte
+}
+
+type connKey struct {
+	addr string
+	id   uint16
+}
+
+// Socket runs uTP connections over one UDP socket. It implements
+// net.Listener for incoming connections, Dial makes outgoing ones
+type Socket struct {
+	conn net.PacketConn
+
+	mu     sync.Mutex
+	conns  map[connKey]*Conn
+	accept chan *Conn
+
+	fallback  *packetPipe
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+type connState int
+
+const (
+	stateSynSent connState = iota
+	stateConnected
+	stateFinSent
+	stateClosed
+)
+
+// Conn is a uTP connection. It implements net.Conn, the congestion
+// window follows LEDBAT so other traffic of the link goes first
+type Conn struct {
+	socket *Socket
+	remote net.Addr
+	recvID uint16
+	sendID uint16
+
+	// writeMu keeps data of concurrent Writes from interleaving
+	writeMu sync.Mutex
+
+	mu    sync.Mutex
+	state connState
+	err   error
+	// changed is closed and replaced on every change Read, Write and Dial wait for
+	changed chan struct{}
+
+	// Sending side
+	seq        uint16
+	unacked    []*packet
+	inFlight   int
+	window     float64
+	slowStart  bool
+	peerWindow int
+	lastAck    uint16
+	dupAcks    int
+	// recoverySeq ends the loss recovery, the window is cut once per loss event
+	recoverySeq uint16
+	inRecovery  bool
+	rtt         time.Duration
+	rttVar      time.Duration
+	timeout     time.Duration
+
+	// LEDBAT delay measurements in microseconds
+	baseDelays   [2]uint32
+	baseStart    time.Time
+	recentDelays [3]uint32
+	delayIndex   int
+	replyMicro   uint32
+
+	// Receiving side
+	ack     uint16
+	readBuf []byte
+	reorder map[uint16]inbound
+	gotFin  bool
+	finSeq  uint16
+	eof     bool
+
+	readDeadline  time.Time
+	writeDeadline time.Time
+}
+
+// packetPipe gets datagrams which are not uTP, e.g. DHT messages
+// sharing the socket
+type packetPipe struct {
+	socket    *Socket
+	packets   chan datagram
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+type datagram struct {
+	data []byte
+	addr net.Addr
+}
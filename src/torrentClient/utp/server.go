@@ -0,0 +1,32 @@
+package utp
+
+import (
+	"fmt"
+	"sync"
+
+	"torrentClient/parser/env"
+
+	"github.com/sirupsen/logrus"
+)
+
+var syncOnce sync.Once
+var socket *Socket
+
+// GetSocket returns the uTP socket on the UDP peer port, nil if uTP is
+// disabled or the port can't be taken
+func GetSocket() *Socket {
+	syncOnce.Do(func() {
+		if !env.GetParser().IsUtpEnabled() {
+			logrus.Infof("uTP is disabled")
+			return
+		}
+
+		var err error
+		socket, err = Listen(fmt.Sprintf(":%v", env.GetParser().GetTorrentPeerPort()))
+		if err != nil {
+			logrus.Errorf("Error creating uTP socket: %v", err)
+			socket = nil
+		}
+	})
+	return socket
+}
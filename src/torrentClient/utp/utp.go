@@ -0,0 +1,344 @@
+package utp
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Listen opens a UDP socket for uTP connections
+func Listen(addr string) (*Socket, error) {
+	conn, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("error listening utp addr: %v", err)
+	}
+	return NewSocket(conn), nil
+}
+
+// NewSocket runs uTP over the packet conn
+func NewSocket(conn net.PacketConn) *Socket {
+	s := &Socket{
+		conn:   conn,
+		conns:  make(map[connKey]*Conn),
+		accept: make(chan *Conn, acceptBacklog),
+		closed: make(chan struct{}),
+	}
+	s.fallback = &packetPipe{
+		socket:  s,
+		packets: make(chan datagram, 256),
+		closed:  make(chan struct{}),
+	}
+	go s.readLoop()
+	go s.tickLoop()
+	return s
+}
+
+// Dial connects to a uTP peer
+func (s *Socket) Dial(addr string, timeout time.Duration) (*Conn, error) {
+	remote, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	var recvID uint16
+	for {
+		recvID = randomUint16()
+		if _, exists := s.conns[connKey{remote.String(), recvID}]; !exists {
+			break
+		}
+	}
+	c := newConn(s, remote, recvID, recvID+1)
+	s.conns[connKey{remote.String(), recvID}] = c
+	s.mu.Unlock()
+
+	c.mu.Lock()
+	c.state = stateSynSent
+	c.seq = 1
+	c.queue(stSyn, nil)
+	c.mu.Unlock()
+
+	deadline := time.Now().Add(timeout)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for c.state == stateSynSent {
+		if c.err != nil {
+			break
+		}
+		if !c.wait(deadline) {
+			c.err = fmt.Errorf("utp dial %v timed out", addr)
+			break
+		}
+	}
+	if c.err != nil {
+		err := c.err
+		c.closeLocked()
+		return nil, err
+	}
+	return c, nil
+}
+
+// Accept waits for an incoming connection
+func (s *Socket) Accept() (net.Conn, error) {
+	select {
+	case c := <-s.accept:
+		return c, nil
+	case <-s.closed:
+		return nil, fmt.Errorf("utp socket is closed")
+	}
+}
+
+// Close closes the UDP socket with every connection on it
+func (s *Socket) Close() error {
+	var err error
+	s.closeOnce.Do(func() {
+		close(s.closed)
+		err = s.conn.Close()
+
+		s.mu.Lock()
+		conns := make([]*Conn, 0, len(s.conns))
+		for _, c := range s.conns {
+			conns = append(conns, c)
+		}
+		s.mu.Unlock()
+		for _, c := range conns {
+			c.mu.Lock()
+			c.fail(fmt.Errorf("utp socket is closed"))
+			c.mu.Unlock()
+		}
+	})
+	return err
+}
+
+func (s *Socket) Addr() net.Addr {
+	return s.conn.LocalAddr()
+}
+
+// Fallback returns a packet conn getting datagrams which are not uTP, so
+// another protocol, e.g. DHT, can share the port. Closing it leaves the socket open
+func (s *Socket) Fallback() net.PacketConn {
+	return s.fallback
+}
+
+func (s *Socket) readLoop() {
+	buf := make([]byte, 65536)
+	for {
+		n, addr, err := s.conn.ReadFrom(buf)
+		if err != nil {
+			select {
+			case <-s.closed:
+				return
+			default:
+			}
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				continue
+			}
+			logrus.Errorf("utp read error: %v", err)
+			s.Close()
+			return
+		}
+
+		h, payload, err := parsePacket(buf[:n])
+		if err != nil {
+			s.fallback.deliver(append([]byte{}, buf[:n]...), addr)
+			continue
+		}
+		s.dispatch(h, append([]byte{}, payload...), addr)
+	}
+}
+
+func (s *Socket) dispatch(h header, payload []byte, addr net.Addr) {
+	s.mu.Lock()
+	c, found := s.conns[connKey{addr.String(), h.connID}]
+	if !found && h.typ == stSyn {
+		// A retransmitted SYN finds the connection it has created
+		c, found = s.conns[connKey{addr.String(), h.connID + 1}]
+		if !found {
+			c = newConn(s, addr, h.connID+1, h.connID)
+			s.conns[connKey{addr.String(), h.connID + 1}] = c
+			s.mu.Unlock()
+			s.accepted(c, h)
+			return
+		}
+	}
+	s.mu.Unlock()
+
+	if !found {
+		if h.typ != stReset {
+			s.sendReset(addr, h)
+		}
+		return
+	}
+	c.handle(h, payload)
+}
+
+// accepted answers the SYN of a new connection and queues it for Accept
+func (s *Socket) accepted(c *Conn, syn header) {
+	c.mu.Lock()
+	c.state = stateConnected
+	c.seq = randomUint16()
+	c.ack = syn.seq
+	c.peerWindow = int(syn.wndSize)
+	c.replyMicro = nowMicro() - syn.timestamp
+	c.sendState()
+	c.mu.Unlock()
+
+	select {
+	case s.accept <- c:
+	default:
+		logrus.Debugf("utp accept backlog is full, resetting %v", c.remote)
+		c.mu.Lock()
+		c.send(stReset, c.seq, nil)
+		c.closeLocked()
+		c.mu.Unlock()
+	}
+}
+
+func (s *Socket) sendReset(addr net.Addr, h header) {
+	reply := header{typ: stReset, connID: h.connID, timestamp: nowMicro(), seq: randomUint16(), ack: h.seq}
+	s.conn.WriteTo(reply.serialize(nil), addr)
+}
+
+func (s *Socket) remove(c *Conn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := connKey{c.remote.String(), c.recvID}
+	if s.conns[key] == c {
+		delete(s.conns, key)
+	}
+}
+
+func (s *Socket) tickLoop() {
+	ticker := time.NewTicker(tickInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.closed:
+			return
+		case now := <-ticker.C:
+			s.mu.Lock()
+			conns := make([]*Conn, 0, len(s.conns))
+			for _, c := range s.conns {
+				conns = append(conns, c)
+			}
+			s.mu.Unlock()
+			for _, c := range conns {
+				c.tick(now)
+			}
+		}
+	}
+}
+
+// parsePacket parses the header and skips extensions. Packets which are not
+// uTP, e.g. bencoded DHT messages, fail to parse
+func parsePacket(buf []byte) (header, []byte, error) {
+	if len(buf) < headerSize {
+		return header{}, nil, fmt.Errorf("packet is too short")
+	}
+	h := header{
+		typ:           buf[0] >> 4,
+		extension:     buf[1],
+		connID:        binary.BigEndian.Uint16(buf[2:4]),
+		timestamp:     binary.BigEndian.Uint32(buf[4:8]),
+		timestampDiff: binary.BigEndian.Uint32(buf[8:12]),
+		wndSize:       binary.BigEndian.Uint32(buf[12:16]),
+		seq:           binary.BigEndian.Uint16(buf[16:18]),
+		ack:           binary.BigEndian.Uint16(buf[18:20]),
+	}
+	if buf[0]&0x0f != version || h.typ > stSyn {
+		return header{}, nil, fmt.Errorf("not a utp packet")
+	}
+
+	rest := buf[headerSize:]
+	for ext := h.extension; ext != 0; {
+		if len(rest) < 2 || len(rest) < 2+int(rest[1]) {
+			return header{}, nil, fmt.Errorf("invalid extension")
+		}
+		if ext == extSack {
+			h.sack = append([]byte{}, rest[2:2+int(rest[1])]...)
+		}
+		ext = rest[0]
+		rest = rest[2+int(rest[1]):]
+	}
+	return h, rest, nil
+}
+
+func (h *header) serialize(payload []byte) []byte {
+	extLength := 0
+	if len(h.sack) > 0 {
+		extLength = 2 + len(h.sack)
+	}
+	buf := make([]byte, headerSize+extLength+len(payload))
+	buf[0] = h.typ<<4 | version
+	if extLength > 0 {
+		buf[1] = extSack
+		buf[headerSize] = 0
+		buf[headerSize+1] = byte(len(h.sack))
+		copy(buf[headerSize+2:], h.sack)
+	}
+	binary.BigEndian.PutUint16(buf[2:4], h.connID)
+	binary.BigEndian.PutUint32(buf[4:8], h.timestamp)
+	binary.BigEndian.PutUint32(buf[8:12], h.timestampDiff)
+	binary.BigEndian.PutUint32(buf[12:16], h.wndSize)
+	binary.BigEndian.PutUint16(buf[16:18], h.seq)
+	binary.BigEndian.PutUint16(buf[18:20], h.ack)
+	copy(buf[headerSize+extLength:], payload)
+	return buf
+}
+
+func nowMicro() uint32 {
+	return uint32(time.Now().UnixNano() / int64(time.Microsecond))
+}
+
+func randomUint16() uint16 {
+	var buf [2]byte
+	rand.Read(buf[:])
+	return binary.BigEndian.Uint16(buf[:])
+}
+
+// seqLess compares sequence numbers which wrap around
+func seqLess(a, b uint16) bool {
+	return int16(a-b) < 0
+}
+
+func (p *packetPipe) deliver(data []byte, addr net.Addr) {
+	select {
+	case p.packets <- datagram{data, addr}:
+	default:
+		// Nobody reads, e.g. DHT is disabled
+	}
+}
+
+func (p *packetPipe) ReadFrom(b []byte) (int, net.Addr, error) {
+	select {
+	case d := <-p.packets:
+		return copy(b, d.data), d.addr, nil
+	case <-p.closed:
+		return 0, nil, fmt.Errorf("fallback conn is closed")
+	case <-p.socket.closed:
+		return 0, nil, fmt.Errorf("utp socket is closed")
+	}
+}
+
+func (p *packetPipe) WriteTo(b []byte, addr net.Addr) (int, error) {
+	return p.socket.conn.WriteTo(b, addr)
+}
+
+func (p *packetPipe) Close() error {
+	p.closeOnce.Do(func() {
+		close(p.closed)
+	})
+	return nil
+}
+
+func (p *packetPipe) LocalAddr() net.Addr {
+	return p.socket.conn.LocalAddr()
+}
+
+func (p *packetPipe) SetDeadline(t time.Time) error      { return nil }
+func (p *packetPipe) SetReadDeadline(t time.Time) error  { return nil }
+func (p *packetPipe) SetWriteDeadline(t time.Time) error { return nil }